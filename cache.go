@@ -3,19 +3,162 @@ package levelcache
 import (
 	"context"
 	"errors"
+	"io"
+	"time"
+
+	"github.com/go-redis/redis"
 )
 
+// ErrInvalidKey returned if a key is rejected by Options.KeyValidator and Options.FailOnInvalidKey is set
+var ErrInvalidKey = errors.New("invalid key")
+
 // Cache cache interface
+// empty string keys are invalid, they are skipped by all methods and always reported as misses
 type Cache interface {
 	// if error is not nil, user decide whether to use expired values
 	// second map, true for valid and false for expired
+	// returned values must not be modified unless Options.CopyOnRead is set
 	MGet(ctx context.Context, keys []string) (map[string][]byte, map[string]bool, error)
 
+	// MGet into caller provided maps, so they can be reused. maps are cleared first if reset, otherwise results are
+	// added to existing entries.
+	MGetInto(ctx context.Context, keys []string, valuesOut map[string][]byte, validsOut map[string]bool, reset bool) error
+
+	// MGet calling fn per found key as each level resolves it, instead of collecting all values in maps.
+	// valid is false for expired values, which are called last. an error of fn stops MGetStream and is returned.
+	MGetStream(ctx context.Context, keys []string, fn func(key string, value []byte, valid bool) error) error
+
+	// MGet also reporting keys known to be missing, negatively cached or just missed by loader. negative keys are
+	// absent from the other maps.
+	MGetDetailed(ctx context.Context, keys []string) (map[string][]byte, map[string]bool, map[string]bool, error)
+
+	// MGet returning a result per key, with the level it is resolved by and its modify time
+	MGetFull(ctx context.Context, keys []string) (map[string]MGetResult, error)
+
+	// MGet also counting keys by the level resolving them, e.g. for per call logging
+	MGetWithSummary(ctx context.Context, keys []string) (map[string][]byte, map[string]bool, Summary, error)
+
+	// MGet returning values decorated by Options.Decorator, valids as of MGet. keys failed to decorate are absent,
+	// and the first error of them returned unless MGet fails.
+	MGetDecorated(ctx context.Context, keys []string) (map[string]interface{}, map[string]bool, error)
+
+	// MGet returning cached values right away, valid or not, while keys expired or missing are loaded in the
+	// background. fresh receives the loaded values once and is closed, it is closed without a value if nothing is
+	// loaded. ctx is used by the background load too.
+	MGetWithRefresh(ctx context.Context, keys []string) (map[string][]byte, <-chan map[string][]byte, error)
+
+	// MGet within budget, of which Options.CacheBudgetShare is for cache reads and the rest for loader. once the
+	// budget runs out, returns what is gathered so far with context.DeadlineExceeded, while the load goes on in the
+	// background with its ctx done. waiting for Options.MaxConcurrentMGet counts too. redis reads are bounded only by
+	// a RedisCacheOptions.ContextClient honoring ctx, the go-redis v6 Client ignores it.
+	MGetWithBudget(ctx context.Context, keys []string, budget time.Duration) (map[string][]byte, map[string]bool,
+		error)
+
+	// get entries from redis cache as stored, without decompressing. lru cache and loader are not consulted.
+	// second map, true for valid and false for soft expired. a redis error is returned with entries of keys read.
+	MGetRaw(ctx context.Context, keys []string) (map[string]RawEntry, map[string]bool, error)
+
+	// get the redis entry of key as stored, not decompressed and regardless of timeouts, e.g. for support tooling.
+	// an error is returned if key is absent or negatively cached.
+	InspectRedis(ctx context.Context, key string) (*Data, error)
+
+	// check keys are cached without fetching values, the lru cache and then redis cache, loader is not called.
+	// a negative cache entry counts as present, as redis can not tell it from a value without fetching it.
+	// soft expired redis entries count as present too.
+	MExists(ctx context.Context, keys []string) (map[string]bool, error)
+
 	//  warm up cache
 	MSet(ctx context.Context, kvs map[string][]byte) error
 
 	// delete keys from cache, include local cache and redis cache.
 	MDel(ctx context.Context, keys []string) error
+
+	// MSet kvs only if keys are absent from redis cache(SET NX), or only if present(SET XX). lru cache is set with the
+	// keys written to redis only. negative cache entries count as present. redis cache is required, and a
+	// RedisCacheOptions.ContextClient implementing RedisConditionalSetter. keys RedisWriteFilter rejects are skipped.
+	MSetNX(ctx context.Context, kvs map[string][]byte) error
+	MSetXX(ctx context.Context, kvs map[string][]byte) error
+
+	// MSet entries only if they are modified after the cached ones, so a stale write never overwrites a newer one.
+	// compared by seconds in both lru cache and redis cache, values written by MSet count as modified at the time of
+	// MSet. redis cache requires lua scripting.
+	MSetIfNewer(ctx context.Context, entries map[string]MetaEntry) error
+
+	// extend lru and redis ttl of cached keys to ttl from now, missing and lru expired keys are skipped. negative
+	// cache entries are extended too. the soft timeout of a redis entry still counts from its modify time. ttl must
+	// be positive.
+	Touch(ctx context.Context, keys []string, ttl time.Duration) error
+
+	// atomically increase the counter of key by delta in redis cache and return it, the lru cache entry is deleted.
+	// counters are read by MGet as decimal strings, absent and negatively cached keys count as 0. a value not a
+	// counter(e.g. set by MSet compressed) is an error. redis cache requires lua scripting.
+	Incr(ctx context.Context, key string, delta int64) (int64, error)
+
+	// MSet entries with their modify time and soft timeout
+	MSetWithMeta(ctx context.Context, entries map[string]MetaEntry) error
+
+	// MSet canonicalKVs and their aliases, aliases maps alias to canonical key. aliases are stored as copies, so they
+	// are not updated or deleted together with the canonical key afterwards.
+	MSetAliases(ctx context.Context, canonicalKVs map[string][]byte, aliases map[string]string) error
+
+	// MSet kvs and index keys by tags in redis, so they can be deleted together by InvalidateTag.
+	// tags maps key to its tags, redis cache is required.
+	MSetTagged(ctx context.Context, kvs map[string][]byte, tags map[string][]string) error
+
+	// delete all keys tagged with tag from lru cache and redis cache
+	InvalidateTag(ctx context.Context, tag string) error
+
+	// increase RedisCacheOptions.PrefixVersion of this cache and the version kept in redis, so all keys cached before
+	// miss. requires lua scripting.
+	BumpVersion(ctx context.Context) error
+
+	// rewrite redis entries of keys with current compression type, modify time and ttl are preserved.
+	// missing keys are skipped, so are keys written since read.
+	Recompress(ctx context.Context, keys []string) error
+
+	// evict least recently used lru cache entries right away until it holds at most targetSize items, or bytes if
+	// LRUMaxBytes is set, e.g. under memory pressure. LRUCacheOptions.Trimmable is required.
+	TrimLRU(targetSize int64) error
+
+	// write unexpired lru cache entries with their expiry to w, e.g. on shutdown, to be read by LoadLRU of the next
+	// process for a warm start. LRUCacheOptions.Trimmable is required.
+	DumpLRU(w io.Writer) error
+
+	// set entries written by DumpLRU to lru cache, those expired meanwhile are skipped
+	LoadLRU(r io.Reader) error
+
+	// copy keys from redis cache to lru cache without calling loader, e.g. on startup. keys absent or soft expired
+	// in redis are skipped, negative cache entries are copied. both lru cache and redis cache are required.
+	PrewarmFromRedis(ctx context.Context, keys []string) error
+
+	// check options and redis connectivity, nil if only lru cache is configured
+	Ping(ctx context.Context) error
+
+	// cache statistics
+	Stats() Stats
+
+	// at most n keys of the most lru hits, the most first. nil unless LRUCacheOptions.HotKeysCapacity is set.
+	HotKeys(n int) []string
+
+	// refresh keys with loader right away and then every interval in a background goroutine until Close, so they
+	// stay warm. loader is required.
+	RegisterRefresh(keys []string, interval time.Duration) error
+
+	// stop background refresh workers and wait for them and async redis writes to finish, the cache can still be read
+	// and written
+	Close() error
+
+	// name passed to NewCache
+	Name() string
+
+	// a copy of the options, redis clients are omitted
+	Options() Options
+}
+
+// RawEntry a redis entry as stored, Raw is compressed with CompressionType
+type RawEntry struct {
+	Raw             []byte
+	CompressionType CompressionType
 }
 
 // NewCache create a new cache
@@ -31,3 +174,32 @@ func NewCache(name string, options *Options) Cache {
 
 	return newCacheImpl(name, options)
 }
+
+// NewLRUCache create a cache with only lru cache
+// panic if options invalid
+func NewLRUCache(name string, size int64, timeout, missTimeout time.Duration, loader LoaderFunc) Cache {
+	return NewCache(name, &Options{
+		LRUCacheOptions: &LRUCacheOptions{
+			Size:        size,
+			Timeout:     timeout,
+			MissTimeout: missTimeout,
+		},
+		Loader: loader,
+	})
+}
+
+// NewRedisCache create a cache with only redis cache
+// panic if options invalid
+func NewRedisCache(name string, client *redis.Client, prefix string,
+	hardTimeout, softTimeout, missTimeout time.Duration, loader LoaderFunc) Cache {
+	return NewCache(name, &Options{
+		RedisCacheOptions: &RedisCacheOptions{
+			Client:      client,
+			Prefix:      prefix,
+			HardTimeout: hardTimeout,
+			SoftTimeout: softTimeout,
+			MissTimeout: missTimeout,
+		},
+		Loader: loader,
+	})
+}
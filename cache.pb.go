@@ -23,15 +23,18 @@ type CompressionType int32
 const (
 	CompressionType_None   CompressionType = 0
 	CompressionType_Snappy CompressionType = 1
+	CompressionType_Zstd   CompressionType = 2
 )
 
 var CompressionType_name = map[int32]string{
 	0: "None",
 	1: "Snappy",
+	2: "Zstd",
 }
 var CompressionType_value = map[string]int32{
 	"None":   0,
 	"Snappy": 1,
+	"Zstd":   2,
 }
 
 func (x CompressionType) String() string {
@@ -42,6 +45,11 @@ type Data struct {
 	Raw             []byte          `protobuf:"bytes,1,opt,name=raw,proto3" json:"raw,omitempty"`
 	ModifyTime      int64           `protobuf:"varint,2,opt,name=modify_time" json:"modify_time,omitempty"`
 	CompressionType CompressionType `protobuf:"varint,3,opt,name=compression_type,enum=levelcache.CompressionType" json:"compression_type,omitempty"`
+	Miss            bool            `protobuf:"varint,4,opt,name=miss" json:"miss,omitempty"`
+	DictionaryId    uint32          `protobuf:"varint,5,opt,name=dictionary_id" json:"dictionary_id,omitempty"`
+	SoftTimeout     int64           `protobuf:"varint,6,opt,name=soft_timeout" json:"soft_timeout,omitempty"`
+	Checksum        uint32          `protobuf:"fixed32,7,opt,name=checksum" json:"checksum,omitempty"`
+	UncompressedLen uint32          `protobuf:"varint,8,opt,name=uncompressed_len" json:"uncompressed_len,omitempty"`
 }
 
 func (m *Data) Reset()         { *m = Data{} }
@@ -3,10 +3,15 @@ package levelcache
 import (
 	"bytes"
 	"context"
+	"hash/crc32"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ericuni/errs"
-	"github.com/go-redis/redis"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
@@ -15,6 +20,14 @@ import (
 
 var (
 	missBytes = []byte("")
+
+	// kept in lru cache for keys loader missed, shared by all of them so never modified
+	lruMiss = &Data{Miss: true}
+
+	// replaced in tests to simulate marshal failures
+	marshalData = func(data *Data) ([]byte, error) {
+		return proto.Marshal(data)
+	}
 )
 
 // cacheImpl cache implementation
@@ -22,41 +35,311 @@ type cacheImpl struct {
 	name    string
 	options *Options
 
-	lruData *ccache.Cache
+	lruData *lruCache
+	stats   *stats
+	clock   Clock
+	redis   RedisClient
+	limiter *rateLimiter
+	// taken by running MGet calls if MaxConcurrentMGet is set
+	mGetSlots chan struct{}
+	// held across loading keys if LoaderLockStripes is set
+	loadLocks *keyLocks
+	// open batch of LoaderCoalesceWindow, nil if none
+	coalesceMu sync.Mutex
+	loadBatch  *loadBatch
+	// taken by redis writes in flight if AsyncWrite is set
+	asyncWrites  chan struct{}
+	asyncWriteWG sync.WaitGroup
+	setGens      *setGenerations
+	misses       *missCounter // nil unless MissRetries is set
+	hotKeys      *hotKeys     // nil unless HotKeysCapacity is set
+	// objects of Decorator by lru key, allocated by decoratedCache
+	decorated     *ccache.Cache
+	decoratedOnce sync.Once
+
+	// current version of RedisCacheOptions.PrefixVersion, and the suffix of prefixes of it
+	versionMu     sync.Mutex
+	version       int64
+	versionSuffix atomic.Value
+	// syncer of the version kept in redis if VersionSyncInterval is set, stopped by Close
+	versionCancel context.CancelFunc
+	versionWG     sync.WaitGroup
+
+	// created on first use, as most caches never see zstd
+	zstdOnce  sync.Once
+	zstd      *zstdCodec
+	zstdError error
+	// background refresh workers, stopped by Close
+	refreshMu     sync.Mutex
+	refreshCtx    context.Context
+	refreshCancel context.CancelFunc
+	refreshWG     sync.WaitGroup
+	closed        bool
+	// keyspace notification subscriber if EnableInvalidation is set, stopped by Close
+	invalidationCancel context.CancelFunc
+	invalidationWG     sync.WaitGroup
 }
 
 func newCacheImpl(name string, options *Options) *cacheImpl {
 	c := &cacheImpl{
 		name:    name,
 		options: options,
+		stats:   newStats(options),
+		clock:   options.Clock,
+	}
+	if c.clock == nil {
+		c.clock = realClock{}
 	}
 	if options := options.LRUCacheOptions; options != nil {
-		c.lruData = ccache.New(ccache.Configure().MaxSize(options.Size))
+		// shards are routed by keys as loader lock stripes are, whatever they are qualified by
+		hash := c.options.hasher()
+		c.lruData = newLRUCache(options, func(key string) uint64 {
+			return hash(unqualifyLRUKey(key))
+		})
+		if !options.LazyInit {
+			c.decoratedCache()
+		}
+		if options.HotKeysCapacity > 0 {
+			c.hotKeys = newHotKeys(options.HotKeysCapacity)
+		}
+	}
+	if options.MaxConcurrentMGet > 0 {
+		c.mGetSlots = make(chan struct{}, options.MaxConcurrentMGet)
+	}
+	if options.LoaderLockStripes > 0 {
+		c.loadLocks = newKeyLocks(options.LoaderLockStripes, options.hasher())
+	}
+	if options.MissRetries > 0 {
+		c.misses = newMissCounter()
+	}
+	if options := options.LoaderRateLimiter; options != nil {
+		c.limiter = newRateLimiter(options)
+	}
+	if options := options.RedisCacheOptions; options != nil {
+		c.redis = options.ContextClient
+		if c.redis == nil {
+			c.redis = &redisV6Client{client: options.Client}
+		}
+		c.setVersion(options.PrefixVersion)
+		if options.VersionSyncInterval > 0 {
+			c.startVersionSync(options.VersionSyncInterval)
+		}
+		if options.AsyncWrite {
+			n := options.MaxAsyncWrites
+			if n == 0 {
+				n = 64
+			}
+			c.asyncWrites = make(chan struct{}, n)
+			c.setGens = newSetGenerations()
+		}
+		if options.EnableInvalidation {
+			c.startInvalidation()
+		}
 	}
 	return c
 }
 
 // MGet .
 func (cache *cacheImpl) MGet(ctx context.Context, keys []string) (map[string][]byte, map[string]bool, error) {
-	if len(keys) == 0 {
-		return nil, nil, nil
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, nil, err
+	}
+
+	if err := cache.acquireMGet(ctx); err != nil {
+		return nil, nil, errs.Trace(err)
+	}
+	defer cache.releaseMGet()
+
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err = cache.mGet(ctx, keys, valuesMap, validsMap, cache.reportNegative(validsMap))
+	return valuesMap, validsMap, err
+}
+
+// MGetInto .
+func (cache *cacheImpl) MGetInto(ctx context.Context, keys []string, valuesOut map[string][]byte,
+	validsOut map[string]bool, reset bool) error {
+	if reset {
+		for k := range valuesOut {
+			delete(valuesOut, k)
+		}
+		for k := range validsOut {
+			delete(validsOut, k)
+		}
+	}
+
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	if err := cache.acquireMGet(ctx); err != nil {
+		return errs.Trace(err)
+	}
+	defer cache.releaseMGet()
+
+	if !reset {
+		// previous results of the same keys would be taken as expired values
+		for _, key := range keys {
+			delete(valuesOut, key)
+			delete(validsOut, key)
+		}
+	}
+	return cache.mGet(ctx, keys, valuesOut, validsOut, cache.reportNegative(validsOut))
+}
+
+// reportNegative returns emit of mGet setting keys resolved without a valid value false in validsMap if
+// ReportNegative is set, nil otherwise
+func (cache *cacheImpl) reportNegative(validsMap map[string]bool) func(keys []string) error {
+	if !cache.options.ReportNegative {
+		return nil
+	}
+	return func(keys []string) error {
+		for _, key := range keys {
+			if !validsMap[key] {
+				validsMap[key] = false
+			}
+		}
+		return nil
+	}
+}
+
+// MGetStream .
+func (cache *cacheImpl) MGetStream(ctx context.Context, keys []string,
+	fn func(key string, value []byte, valid bool) error) error {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	if err := cache.acquireMGet(ctx); err != nil {
+		return errs.Trace(err)
+	}
+	defer cache.releaseMGet()
+
+	// valid values are handed to fn and dropped level by level, expired ones are kept until no level resolves them
+	valuesMap := make(map[string][]byte)
+	validsMap := make(map[string]bool)
+	var fnErr error
+	emit := func(keys []string) error {
+		for _, key := range keys {
+			if !validsMap[key] {
+				continue
+			}
+			value := valuesMap[key]
+			delete(valuesMap, key)
+			delete(validsMap, key)
+			if fnErr = fn(key, value, true); fnErr != nil {
+				return fnErr
+			}
+		}
+		return nil
+	}
+
+	err = cache.mGet(ctx, keys, valuesMap, validsMap, emit)
+	if fnErr != nil {
+		return err
+	}
+
+	for key, value := range valuesMap {
+		if err := fn(key, value, validsMap[key]); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	return err
+}
+
+// MGetDetailed .
+func (cache *cacheImpl) MGetDetailed(ctx context.Context, keys []string) (map[string][]byte, map[string]bool,
+	map[string]bool, error) {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, nil, nil, err
+	}
+
+	if err := cache.acquireMGet(ctx); err != nil {
+		return nil, nil, nil, errs.Trace(err)
 	}
+	defer cache.releaseMGet()
 
+	// keys resolved by a level without a valid value are negative
 	valuesMap := make(map[string][]byte, len(keys))
 	validsMap := make(map[string]bool, len(keys))
+	negative := make(map[string]bool)
+	emit := func(keys []string) error {
+		for _, key := range keys {
+			if !validsMap[key] {
+				negative[key] = true
+				delete(valuesMap, key)
+			}
+		}
+		return nil
+	}
+	err = cache.mGet(ctx, keys, valuesMap, validsMap, emit)
+	return valuesMap, validsMap, negative, err
+}
+
+// mGet fills valuesMap and validsMap with keys, which contain no empty key.
+// if emit is not nil, it is called with keys resolved by each level, negative ones included, and its error stops
+// mGet.
+func (cache *cacheImpl) mGet(ctx context.Context, keys []string, valuesMap map[string][]byte,
+	validsMap map[string]bool, emit func(keys []string) error) error {
+	if GetCacheControl(ctx).NoCache && cache.hasLoader() {
+		return cache.mLoad(ctx, keys, valuesMap, validsMap, emit)
+	}
+
+	missKeys, err := cache.mGetCached(ctx, keys, valuesMap, validsMap, emit)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	if options := cache.options.LRUCacheOptions; options != nil && options.LRUServeStaleWithoutRefresh {
+		missKeys = skipStaleKeys(missKeys, valuesMap)
+	}
+	if len(missKeys) == 0 || !cache.hasLoader() {
+		return nil
+	}
+	return cache.mLoad(ctx, missKeys, valuesMap, validsMap, emit)
+}
+
+// skipStaleKeys returns keys without a stale value in valuesMap
+func skipStaleKeys(keys []string, valuesMap map[string][]byte) []string {
+	missKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := valuesMap[key]; !ok {
+			missKeys = append(missKeys, key)
+		}
+	}
+	return missKeys
+}
 
+// mGetCached looks keys up in lru cache and then redis cache, returns keys to load
+func (cache *cacheImpl) mGetCached(ctx context.Context, keys []string, valuesMap map[string][]byte,
+	validsMap map[string]bool, emit func(keys []string) error) ([]string, error) {
 	lruMissKeys := cache.mGetFromLRUCache(ctx, keys, valuesMap, validsMap)
+	if emit != nil && len(lruMissKeys) < len(keys) {
+		if err := emit(substract(keys, lruMissKeys)); err != nil {
+			return nil, errs.Trace(err)
+		}
+	}
 	if len(lruMissKeys) == 0 {
-		return valuesMap, validsMap, nil
+		return nil, nil
 	}
 
-	redisMissKeys := cache.mGetFromRedisCache(ctx, lruMissKeys, valuesMap, validsMap)
+	modifyTimes := make(map[string]int64, len(lruMissKeys))
+	redisMissKeys, staleKeys, redisErr := cache.mGetFromRedisCache(ctx, lruMissKeys, valuesMap, validsMap,
+		modifyTimes)
+	if len(staleKeys) > 0 && emit != nil {
+		if err := emit(staleKeys); err != nil {
+			return nil, errs.Trace(err)
+		}
+	}
 
 	// set redis to lru
 	// if key is found in redis and value = missBytes, then key will not be added to missKeys, so key will appear in
 	// hitRedisKeys, and key may(still in lru but expired) or may not be in valuesMap. if key already in valuesMap,
 	// its lifetime will be extended, and if key not in, then it will be treated as miss key
-	redisHitKeys := substract(lruMissKeys, redisMissKeys)
+	redisHitKeys := substract(substract(lruMissKeys, redisMissKeys), staleKeys)
 	if len(redisHitKeys) > 0 {
 		redisValues := make(map[string][]byte, len(redisHitKeys))
 		var emptyKeys []string
@@ -67,39 +350,94 @@ func (cache *cacheImpl) MGet(ctx context.Context, keys []string) (map[string][]b
 				emptyKeys = append(emptyKeys, key)
 			}
 		}
-		cache.mSetLRUCache(ctx, redisValues, emptyKeys)
+		if !GetCacheControl(ctx).NoStore {
+			cache.mSetLRUCacheModified(ctx, redisValues, emptyKeys, modifyTimes)
+		}
+
+		if emit != nil {
+			if err := emit(redisHitKeys); err != nil {
+				return nil, errs.Trace(err)
+			}
+		}
+	}
+
+	if redisErr != nil {
+		return nil, errs.Trace(redisErr)
+	}
+	return redisMissKeys, nil
+}
+
+// mLoad loads keys missed by all levels into valuesMap and validsMap, and caches them
+func (cache *cacheImpl) mLoad(ctx context.Context, keys []string, valuesMap map[string][]byte,
+	validsMap map[string]bool, emit func(keys []string) error) error {
+	// keys over the limits are neither loaded nor cached as misses
+	loadKeys, limitErr := cache.limitLoaderCost(keys)
+	if limited, err := cache.limitLoaderKeys(ctx, loadKeys); err != nil {
+		loadKeys, limitErr = limited, err
+	}
+	if len(loadKeys) == 0 {
+		return errs.Trace(limitErr)
 	}
 
-	// hit redis all
-	if len(redisMissKeys) == 0 {
-		return valuesMap, validsMap, nil
+	if options := cache.options.RedisCacheOptions; options != nil && options.FillIfNewer {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx = context.WithValue(ctx, fillStartKey{}, cache.clock.Now())
 	}
 
-	if cache.options.Loader == nil {
-		return valuesMap, validsMap, nil
+	control := GetCacheControl(ctx)
+	if cache.loadLocks != nil {
+		unlock := cache.loadLocks.lock(loadKeys)
+		defer unlock()
+
+		// keys loaded by another call while waiting are read from cache
+		if !control.NoCache {
+			var err error
+			if loadKeys, err = cache.mGetCached(ctx, loadKeys, valuesMap, validsMap, emit); err != nil {
+				return errs.Trace(err)
+			}
+			if len(loadKeys) == 0 {
+				return errs.Trace(limitErr)
+			}
+		}
 	}
 
-	values, err := cache.options.Loader(ctx, redisMissKeys)
+	values, ttls, loaderErr := cache.coalescedLoad(ctx, loadKeys)
+	trace, now := traceOf(ctx), cache.clock.Now().Unix()
 	for k, v := range values {
 		valuesMap[k] = v
 		validsMap[k] = true
+		trace.value(k, SourceLoader, now)
 	}
-	if err != nil {
-		return valuesMap, validsMap, errs.Trace(err)
+	if loaderErr != nil {
+		// results are not trusted, except those of keys a LoaderKeysError does not report failed
+		var ok bool
+		if loadKeys, values, ok = succeededKeys(loaderErr, loadKeys, values); !ok {
+			return errs.Trace(loaderErr)
+		}
 	}
 
-	var loaderMissKeys []string
-	for _, key := range redisMissKeys {
-		_, ok := values[key]
-		if !ok {
-			loaderMissKeys = append(loaderMissKeys, key)
+	if !control.NoStore {
+		loaderMissKeys := cache.loaderMissKeys(ctx, loadKeys, values)
+		if err := cache.mSetLoaded(ctx, values, ttls, loaderMissKeys); err != nil {
+			return errs.Trace(err)
 		}
 	}
-	if err := cache.mSet(ctx, values, loaderMissKeys); err != nil {
-		return valuesMap, validsMap, errs.Trace(err)
+
+	if emit != nil {
+		if err := emit(loadKeys); err != nil {
+			return errs.Trace(err)
+		}
 	}
 
-	return valuesMap, validsMap, nil
+	if loaderErr != nil {
+		return errs.Trace(loaderErr)
+	}
+	if limitErr != nil {
+		return errs.Trace(limitErr)
+	}
+	return nil
 }
 
 func (cache *cacheImpl) mGetFromLRUCache(ctx context.Context, keys []string, valuesMap map[string][]byte,
@@ -108,207 +446,933 @@ func (cache *cacheImpl) mGetFromLRUCache(ctx context.Context, keys []string, val
 		return keys
 	}
 
+	// missKeys is not allocated if all keys hit
 	var missKeys []string
+	ignoreNegative := ignoreNegativeCache(ctx)
+	trace := traceOf(ctx)
 	for _, key := range keys {
-		item := cache.lruData.Get(key)
-		if item != nil {
-			bs, ok := item.Value().([]byte)
-			if !ok {
-				missKeys = append(missKeys, key)
-				glog.Errorln("wrong data type")
-				continue
-			}
+		if cache.getFromLRUCache(ctx, key, valuesMap, validsMap, ignoreNegative, trace) {
+			continue
+		}
+		if missKeys == nil {
+			missKeys = make([]string, 0, len(keys))
+		}
+		missKeys = append(missKeys, key)
+	}
+	return missKeys
+}
 
-			// loader once missed, so we return like it missed, but if already expired, we need to try next level
-			if bytes.Equal(bs, missBytes) {
-				if item.Expired() {
-					missKeys = append(missKeys, key)
-				}
-				continue
-			}
+// getFromLRUCache returns false if key needs to be looked up in next level
+func (cache *cacheImpl) getFromLRUCache(ctx context.Context, key string, valuesMap map[string][]byte,
+	validsMap map[string]bool, ignoreNegative bool, trace *sourceTrace) bool {
+	item := cache.lruData.Get(cache.lruKey(ctx, key))
+	if item == nil {
+		return false
+	}
 
-			var data Data
-			err := proto.Unmarshal(bs, &data)
-			if err != nil {
-				missKeys = append(missKeys, key)
-				glog.Errorln("wrong data content")
-				continue
-			}
+	// loader once missed, so we return like it missed, but if already expired, we need to try next level
+	data, ok := lruValue(item).(*Data)
+	if !ok {
+		glog.Errorln("wrong data type")
+		return false
+	}
+	if data.Miss {
+		if item.Expired() || ignoreNegative {
+			return false
+		}
+		cache.stats.recordNegativeHit()
+		return true
+	}
 
-			valuesMap[key] = data.Raw
-			if !item.Expired() {
-				validsMap[key] = true
-				continue
-			}
+	if data.CompressionType != CompressionType_None {
+		raw, err := cache.decompress(data)
+		if err != nil {
+			glog.Errorf("%s lru %s decompress error %+v", cache.name, key, err)
+			cache.levelError(LevelLRU, err)
+			return false
 		}
-		missKeys = append(missKeys, key)
+		valuesMap[key] = raw
+	} else if cache.options.CopyOnRead {
+		// without CopyOnRead the returned slice is the cached one
+		valuesMap[key] = append([]byte(nil), data.Raw...)
+	} else {
+		valuesMap[key] = data.Raw
 	}
-	return missKeys
+	trace.value(key, SourceLRU, data.ModifyTime)
+	if item.Expired() {
+		// expired within CacheControl.MaxStale is served, unless redis cache may have it fresh
+		control := GetCacheControl(ctx)
+		if control.MaxStale > 0 && cache.options.RedisCacheOptions == nil &&
+			time.Since(item.Expires()) <= control.MaxStale {
+			return true
+		}
+		return cache.withinStaleness(control, data)
+	}
+	validsMap[key] = true
+	cache.stats.recordHit()
+	if cache.hotKeys != nil {
+		cache.hotKeys.hit(key)
+	}
+	return true
 }
 
+// mGetFromRedisCache returns keys to load and keys served soft expired by CacheControl, error is of entries failed to
+// decompress with DecompressErrorReturn. modify times of values put in valuesMap are put in modifyTimes.
 func (cache *cacheImpl) mGetFromRedisCache(ctx context.Context, keys []string, valuesMap map[string][]byte,
-	validsMap map[string]bool) []string {
+	validsMap map[string]bool, modifyTimes map[string]int64) ([]string, []string, error) {
 	options := cache.options.RedisCacheOptions
 
 	if options == nil || len(keys) == 0 {
-		return keys
+		return keys, nil, nil
 	}
 
-	var missKeys []string
-
-	pipe := options.Client.Pipeline()
-	defer pipe.Close()
+	var missKeys, staleKeys, corruptKeys []string
+	var decompressErr error
 
-	cmds := make([]*redis.StringCmd, 0, len(keys))
-	for _, key := range keys {
-		cmds = append(cmds, pipe.Get(cache.mkRedisKey(key)))
+	// keys failed fall through to the next level, the resolved ones are still used
+	results, err := cache.redisGet(ctx, keys)
+	if err != nil {
+		glog.Errorf("%s redis get error %+v", cache.name, err)
+		cache.levelError(LevelRedis, err)
+	}
+	if options.LegacyKeyFunc != nil {
+		cache.redisGetLegacy(ctx, keys, results)
 	}
-	pipe.Exec()
 
-	now := time.Now()
+	now := cache.clock.Now()
+	ignoreNegative := ignoreNegativeCache(ctx)
+	trace := traceOf(ctx)
 	for i, key := range keys {
-		v, err := cmds[i].Bytes()
-		if err != nil {
+		if !results[i].Found {
 			missKeys = append(missKeys, key)
 			continue
 		}
+		v := results[i].Value
 
 		// loader miss
 		if bytes.Equal(v, missBytes) {
+			if ignoreNegative {
+				missKeys = append(missKeys, key)
+			} else {
+				cache.stats.recordNegativeHit()
+			}
 			continue
 		}
 
 		var data Data
-		err = proto.Unmarshal(v, &data)
-		if err != nil {
+		if err := proto.Unmarshal(v, &data); err != nil {
 			missKeys = append(missKeys, key)
 			glog.Errorf("[%v] redis data format error", key)
+			cache.levelError(LevelRedis, errs.Trace(err))
+			continue
+		}
+
+		// loader miss with soft miss timeout, re-evaluate after it while the entry lives until its hard timeout
+		if data.Miss {
+			if ignoreNegative || now.Sub(time.Unix(data.ModifyTime, 0)) > options.MissSoftTimeout {
+				missKeys = append(missKeys, key)
+			} else {
+				cache.stats.recordNegativeHit()
+			}
 			continue
 		}
 
-		raw, err := decompress(data.CompressionType, data.Raw)
+		raw, err := cache.decompress(&data)
 		if err != nil {
-			glog.Errorf("%s redis %s decompress error +%v", cache.name, key, err)
+			glog.Errorf("%s redis %s decompress error %+v", cache.name, key, err)
+			cache.levelError(LevelRedis, err)
+			// a miss for lru promotion even if the error is returned
+			switch cache.options.OnDecompressError {
+			case DecompressErrorReturn:
+				if decompressErr == nil {
+					decompressErr = errs.Trace(err)
+				}
+			case DecompressErrorDelete:
+				corruptKeys = append(corruptKeys, cache.mkRedisKey(ctx, key))
+			}
+			missKeys = append(missKeys, key)
+			continue
 		}
 
-		if now.Sub(time.Unix(data.ModifyTime, 0)) <= options.SoftTimeout {
+		if cache.isFresh(key, &data, now) {
 			valuesMap[key] = raw
+			modifyTimes[key] = data.ModifyTime
 			validsMap[key] = true
+			trace.value(key, SourceRedis, data.ModifyTime)
+			cache.stats.recordHit()
 			continue
 		}
 
-		// lrucache expired has higher priority over redis cache soft expired
-		if _, ok := valuesMap[key]; !ok {
+		// soft expired within CacheControl.MaxStale or MaxStaleness is served
+		if control := GetCacheControl(ctx); (control.MaxStale > 0 &&
+			now.Sub(time.Unix(data.ModifyTime, 0)) <= cache.softTimeout(&data)+control.MaxStale) ||
+			cache.withinStaleness(control, &data) {
+			valuesMap[key] = raw
+			modifyTimes[key] = data.ModifyTime
+			trace.value(key, SourceRedis, data.ModifyTime)
+			staleKeys = append(staleKeys, key)
+			continue
+		}
+
+		// both stale, lrucache expired is kept unless StaleResolution says otherwise
+		if _, ok := valuesMap[key]; !ok || cache.preferRedisStale(ctx, key, &data) {
 			valuesMap[key] = raw
+			modifyTimes[key] = data.ModifyTime
+			trace.value(key, SourceRedis, data.ModifyTime)
 		}
 		missKeys = append(missKeys, key)
 	}
-	return missKeys
-}
 
-// MSet .
-func (cache *cacheImpl) MSet(ctx context.Context, kvs map[string][]byte) error {
-	return cache.mSet(ctx, kvs, nil)
+	if len(corruptKeys) > 0 {
+		if err := cache.redis.Del(ctx, corruptKeys); err != nil {
+			glog.Errorf("%s redis del corrupt keys error %+v", cache.name, err)
+		}
+	}
+	return missKeys, staleKeys, decompressErr
 }
 
-func (cache *cacheImpl) mSet(ctx context.Context, kvs map[string][]byte, missKeys []string) error {
-	if len(kvs) == 0 && len(missKeys) == 0 {
-		return nil
+// preferRedisStale reports whether soft expired redis data replaces the expired lru value of key
+func (cache *cacheImpl) preferRedisStale(ctx context.Context, key string, data *Data) bool {
+	switch cache.options.StaleResolution {
+	case StalePreferRedis:
+		return true
+	case StalePreferFreshest:
+		if cache.lruData == nil {
+			return true
+		}
+		item := cache.lruData.Get(cache.lruKey(ctx, key))
+		if item == nil {
+			return true
+		}
+		lruData, ok := lruValue(item).(*Data)
+		return !ok || data.ModifyTime >= lruData.ModifyTime
+	default:
+		return false
 	}
+}
 
-	cache.mSetLRUCache(ctx, kvs, missKeys)
+// withinStaleness reports whether data is modified within CacheControl.MaxStaleness
+func (cache *cacheImpl) withinStaleness(control CacheControl, data *Data) bool {
+	return control.MaxStaleness > 0 && cache.clock.Now().Sub(time.Unix(data.ModifyTime, 0)) <= control.MaxStaleness
+}
 
-	if err := cache.mSetRedisCache(ctx, kvs, missKeys); err != nil {
-		return errs.Trace(err)
+// isFresh reports whether redis data of key is not soft expired at now
+func (cache *cacheImpl) isFresh(key string, data *Data, now time.Time) bool {
+	if isFresh := cache.options.RedisCacheOptions.IsFresh; isFresh != nil {
+		return isFresh(key, data, now)
 	}
+	return now.Sub(time.Unix(data.ModifyTime, 0)) <= cache.softTimeout(data)
+}
 
-	return nil
+// softTimeout returns soft timeout of redis data, which may override the cache's
+func (cache *cacheImpl) softTimeout(data *Data) time.Duration {
+	if data.SoftTimeout > 0 {
+		return time.Duration(data.SoftTimeout) * time.Millisecond
+	}
+	return cache.options.RedisCacheOptions.SoftTimeout
 }
 
-func (cache *cacheImpl) mSetLRUCache(ctx context.Context, kvs map[string][]byte, missKeys []string) {
-	options := cache.options.LRUCacheOptions
-	if options == nil {
-		return
+// redisGet gets keys from redis in one round trip, results[i] is of keys[i]
+func (cache *cacheImpl) redisGet(ctx context.Context, keys []string) ([]RedisResult, error) {
+	redisKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		redisKeys = append(redisKeys, cache.mkRedisKey(ctx, key))
 	}
 
-	now := time.Now().Unix()
-	for k, v := range kvs {
-		data := Data{
-			Raw:             v,
-			ModifyTime:      now,
-			CompressionType: CompressionType_None,
+	start := time.Now()
+	results, err := cache.redis.Get(ctx, redisKeys)
+	cache.logSlowRedis("get", len(keys), start)
+	if len(results) != len(keys) {
+		// broken client, treat all as misses
+		results = make([]RedisResult, len(keys))
+	}
+	return results, err
+}
+
+// redisGetLegacy fills results of keys missed with their legacy entries, which are copied to the real keys
+func (cache *cacheImpl) redisGetLegacy(ctx context.Context, keys []string, results []RedisResult) {
+	options := cache.options.RedisCacheOptions
+
+	var indexes []int
+	var legacyKeys []string
+	for i, key := range keys {
+		if results[i].Found || results[i].Err != nil {
+			continue
 		}
-		bs, _ := proto.Marshal(&data)
-		cache.lruData.Set(k, bs, options.Timeout)
+		if legacyKey := options.LegacyKeyFunc(key); legacyKey != "" {
+			indexes = append(indexes, i)
+			legacyKeys = append(legacyKeys, legacyKey)
+		}
+	}
+	if len(legacyKeys) == 0 {
+		return
 	}
 
-	if options.MissTimeout == 0 {
+	legacyResults, err := cache.redis.Get(ctx, legacyKeys)
+	if err != nil {
+		glog.Errorf("%s redis get legacy error %+v", cache.name, err)
+		cache.levelError(LevelRedis, err)
+	}
+	if len(legacyResults) != len(legacyKeys) {
 		return
 	}
 
-	for _, key := range missKeys {
-		cache.lruData.Set(key, missBytes, options.MissTimeout)
+	var entries []RedisEntry
+	for j, i := range indexes {
+		if !legacyResults[j].Found {
+			continue
+		}
+		results[i] = legacyResults[j]
+		entries = append(entries, RedisEntry{
+			Key:   cache.mkRedisKey(ctx, keys[i]),
+			Value: legacyResults[j].Value,
+			TTL:   cache.capRedisTTL(options.HardTimeout),
+		})
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := cache.redisSet(ctx, entries); err != nil {
+		glog.Errorf("%s redis set legacy error %+v", cache.name, err)
 	}
 }
 
-func (cache *cacheImpl) mSetRedisCache(ctx context.Context, kvs map[string][]byte, missKeys []string) error {
+// MGetRaw .
+func (cache *cacheImpl) MGetRaw(ctx context.Context, keys []string) (map[string]RawEntry, map[string]bool, error) {
 	options := cache.options.RedisCacheOptions
 	if options == nil {
-		return nil
+		return nil, nil, errs.New("rediscache not configured")
 	}
 
-	now := time.Now().Unix()
-	pipe := options.Client.Pipeline()
-	defer pipe.Close()
-	for k, v := range kvs {
-		data := Data{
-			Raw:             compress(cache.options.CompressionType, v),
-			ModifyTime:      now,
-			CompressionType: cache.options.CompressionType,
-		}
-		bs, _ := proto.Marshal(&data)
-		pipe.Set(cache.mkRedisKey(k), bs, options.HardTimeout)
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, nil, err
 	}
 
-	if options.MissTimeout >= time.Millisecond {
-		for _, key := range missKeys {
-			pipe.Set(cache.mkRedisKey(key), missBytes, options.MissTimeout)
-		}
-	}
+	entriesMap := make(map[string]RawEntry, len(keys))
+	validsMap := make(map[string]bool, len(keys))
 
-	_, err := pipe.Exec()
-	if err != nil {
-		return errs.Trace(err)
+	// keys failed are absent, the resolved ones are still returned with the error
+	results, redisErr := cache.redisGet(ctx, keys)
+	if redisErr != nil {
+		cache.levelError(LevelRedis, redisErr)
 	}
-	return nil
+	now := cache.clock.Now()
+	for i, key := range keys {
+		v := results[i].Value
+		if !results[i].Found || bytes.Equal(v, missBytes) {
+			continue
+		}
 
-}
+		var data Data
+		if err := proto.Unmarshal(v, &data); err != nil {
+			glog.Errorf("[%v] redis data format error", key)
+			continue
+		}
+		if data.Miss {
+			continue
+		}
 
-func (cache *cacheImpl) mkRedisKey(key string) string {
-	if options := cache.options.RedisCacheOptions; options != nil {
-		return options.Prefix + "_" + key
+		entriesMap[key] = RawEntry{
+			Raw:             data.Raw,
+			CompressionType: data.CompressionType,
+		}
+		if cache.isFresh(key, &data, now) {
+			validsMap[key] = true
+		}
 	}
-	return key
+	return entriesMap, validsMap, errs.Trace(redisErr)
 }
 
-// MDel .
-func (cache *cacheImpl) MDel(ctx context.Context, keys []string) error {
-	if len(keys) == 0 {
-		return nil
+// InspectRedis .
+func (cache *cacheImpl) InspectRedis(ctx context.Context, key string) (*Data, error) {
+	if cache.options.RedisCacheOptions == nil {
+		return nil, errs.New("rediscache not configured")
+	}
+	if key == "" {
+		return nil, errs.New("key empty")
+	}
+
+	results, err := cache.redisGet(ctx, []string{key})
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	v := results[0].Value
+	if !results[0].Found {
+		return nil, errs.New("key %s not found in redis", key)
+	}
+	if bytes.Equal(v, missBytes) {
+		return nil, errs.New("key %s negatively cached in redis", key)
+	}
+
+	var data Data
+	if err := proto.Unmarshal(v, &data); err != nil {
+		return nil, errs.Tracef(err, "key %s redis data format error", key)
+	}
+	if data.Miss {
+		return nil, errs.New("key %s negatively cached in redis", key)
+	}
+	return &data, nil
+}
+
+// MExists .
+func (cache *cacheImpl) MExists(ctx context.Context, keys []string) (map[string]bool, error) {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	existsMap := make(map[string]bool, len(keys))
+	lruMissKeys := keys
+	if cache.options.LRUCacheOptions != nil {
+		lruMissKeys = nil
+		for _, key := range keys {
+			if item := cache.lruData.Get(cache.lruKey(ctx, key)); item != nil && !item.Expired() {
+				existsMap[key] = true
+				continue
+			}
+			existsMap[key] = false
+			lruMissKeys = append(lruMissKeys, key)
+		}
+	}
+
+	if cache.options.RedisCacheOptions == nil || len(lruMissKeys) == 0 {
+		return existsMap, nil
+	}
+
+	redisKeys := make([]string, 0, len(lruMissKeys))
+	for _, key := range lruMissKeys {
+		redisKeys = append(redisKeys, cache.mkRedisKey(ctx, key))
+	}
+	exists, err := cache.redis.Exists(ctx, redisKeys)
+	if err != nil {
+		return existsMap, errs.Trace(err)
+	}
+	if len(exists) != len(lruMissKeys) {
+		return existsMap, errs.New("redis exists got %d results of %d keys", len(exists), len(lruMissKeys))
+	}
+	for i, key := range lruMissKeys {
+		existsMap[key] = exists[i]
+	}
+	return existsMap, nil
+}
+
+// MSet .
+func (cache *cacheImpl) MSet(ctx context.Context, kvs map[string][]byte) error {
+	kvs, err := cache.validKVs(kvs)
+	if err != nil {
+		return err
+	}
+	return cache.mSet(ctx, kvs, nil)
+}
+
+// validKVs returns kvs without empty keys and keys rejected by KeyValidator, or the error of the first rejected key
+// if FailOnInvalidKey is set
+func (cache *cacheImpl) validKVs(kvs map[string][]byte) (map[string][]byte, error) {
+	if _, ok := kvs[""]; !ok && cache.options.KeyValidator == nil {
+		return kvs, nil
+	}
+
+	valid := make(map[string][]byte, len(kvs))
+	for k, v := range kvs {
+		if k == "" {
+			continue
+		}
+		if err := cache.validateKey(k); err != nil {
+			if cache.options.FailOnInvalidKey {
+				return nil, err
+			}
+			continue
+		}
+		valid[k] = v
+	}
+	return valid, nil
+}
+
+// validEntries returns entries of valid keys, as validKVs
+func (cache *cacheImpl) validEntries(entries map[string]MetaEntry) (map[string]MetaEntry, error) {
+	if _, ok := entries[""]; !ok && cache.options.KeyValidator == nil {
+		return entries, nil
+	}
+
+	valid := make(map[string]MetaEntry, len(entries))
+	for k, v := range entries {
+		if k == "" {
+			continue
+		}
+		if err := cache.validateKey(k); err != nil {
+			if cache.options.FailOnInvalidKey {
+				return nil, err
+			}
+			continue
+		}
+		valid[k] = v
+	}
+	return valid, nil
+}
+
+// MSetAliases .
+func (cache *cacheImpl) MSetAliases(ctx context.Context, canonicalKVs map[string][]byte,
+	aliases map[string]string) error {
+	kvs := make(map[string][]byte, len(canonicalKVs)+len(aliases))
+	for k, v := range canonicalKVs {
+		kvs[k] = v
+	}
+	for alias, key := range aliases {
+		v, ok := canonicalKVs[key]
+		if !ok {
+			return errs.New("alias %s of unknown key %s", alias, key)
+		}
+		kvs[alias] = v
+	}
+	return cache.MSet(ctx, kvs)
+}
+
+func (cache *cacheImpl) mSet(ctx context.Context, kvs map[string][]byte, missKeys []string) error {
+	if len(kvs) == 0 && len(missKeys) == 0 {
+		return nil
+	}
+
+	cache.stats.recordValueSizes(kvs)
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	cache.recordSets(ctx, keys)
+	cache.mSetLRUCache(ctx, kvs, missKeys)
+
+	if cache.asyncMSetRedisCache(ctx, kvs, missKeys) {
+		return nil
+	}
+	if err := cache.mSetRedisCache(ctx, kvs, missKeys); err != nil {
+		return errs.Trace(err)
+	}
+
+	return nil
+}
+
+// recordSets is called before values of keys are written or deleted, so async writes of them are not written after
+func (cache *cacheImpl) recordSets(ctx context.Context, keys []string) {
+	if cache.misses != nil {
+		for _, key := range keys {
+			cache.misses.reset(cache.lruKey(ctx, key))
+		}
+	}
+	if cache.setGens != nil && len(keys) > 0 {
+		cache.setGens.set(keys)
+	}
+}
+
+// asyncMSetRedisCache writes redis cache in background if AsyncWrite is set and a slot is free, reports whether it
+// does. kvs are copied, as the caller may modify them after return.
+func (cache *cacheImpl) asyncMSetRedisCache(ctx context.Context, kvs map[string][]byte, missKeys []string) bool {
+	if !cache.asyncWriteSlot() {
+		return false
+	}
+
+	copied := make(map[string][]byte, len(kvs))
+	for k, v := range kvs {
+		copied[k] = append([]byte(nil), v...)
+	}
+	missKeys = append([]string(nil), missKeys...)
+	keys := make([]string, 0, len(copied)+len(missKeys))
+	for k := range copied {
+		keys = append(keys, k)
+	}
+	keys = append(keys, missKeys...)
+	cache.asyncRedisWrite(ctx, keys, func(ctx context.Context, unset []string) error {
+		if len(unset) < len(keys) {
+			copied, missKeys = onlyKeys(copied, missKeys, unset)
+		}
+		return cache.mSetRedisCache(ctx, copied, missKeys)
+	})
+	return true
+}
+
+// asyncWriteSlot takes a slot of async writes if AsyncWrite is set and one is free, which asyncRedisWrite frees
+func (cache *cacheImpl) asyncWriteSlot() bool {
+	if cache.asyncWrites == nil {
+		return false
+	}
+	select {
+	case cache.asyncWrites <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// asyncRedisWrite calls write in background with keys not set or deleted since, as those must not be overwritten
+func (cache *cacheImpl) asyncRedisWrite(ctx context.Context, keys []string,
+	write func(ctx context.Context, unset []string) error) {
+	gens := cache.setGens.schedule(keys)
+	ctx = detach(ctx)
+
+	cache.asyncWriteWG.Add(1)
+	go func() {
+		defer func() {
+			<-cache.asyncWrites
+			cache.asyncWriteWG.Done()
+		}()
+		unset, done := cache.setGens.start(keys, gens)
+		defer done()
+		if err := write(ctx, unset); err != nil {
+			glog.Errorf("%s async redis set error %+v", cache.name, err)
+		}
+	}()
+}
+
+// onlyKeys returns kvs and missKeys of keys only
+func onlyKeys(kvs map[string][]byte, missKeys []string, keys []string) (map[string][]byte, []string) {
+	in := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		in[key] = true
+	}
+	only := make(map[string][]byte, len(kvs))
+	for k, v := range kvs {
+		if in[k] {
+			only[k] = v
+		}
+	}
+	var onlyMissKeys []string
+	for _, key := range missKeys {
+		if in[key] {
+			onlyMissKeys = append(onlyMissKeys, key)
+		}
+	}
+	return only, onlyMissKeys
+}
+
+func (cache *cacheImpl) mSetLRUCache(ctx context.Context, kvs map[string][]byte, missKeys []string) {
+	cache.mSetLRUCacheModified(ctx, kvs, missKeys, nil)
+}
+
+// mSetLRUCacheModified is mSetLRUCache of values modified at modifyTimes, e.g. read from redis, so
+// CacheControl.MaxStaleness still counts from the modification. values without one are modified now.
+func (cache *cacheImpl) mSetLRUCacheModified(ctx context.Context, kvs map[string][]byte, missKeys []string,
+	modifyTimes map[string]int64) {
+	options := cache.options.LRUCacheOptions
+	if options == nil {
+		return
 	}
 
+	if options.MissTimeout == 0 || ignoreNegativeCache(ctx) {
+		missKeys = nil
+	}
+	if batch := int64(len(kvs) + len(missKeys)); options.Size > 0 && batch > options.Size {
+		glog.Warningf("%s lru write of %d keys exceeds size %d", cache.name, batch, options.Size)
+		if options.SkipOversizedBatch {
+			// older values of the batch must not be served instead
+			for k := range kvs {
+				cache.lruData.Delete(cache.lruKey(ctx, k))
+			}
+			for _, key := range missKeys {
+				cache.lruData.Delete(cache.lruKey(ctx, key))
+			}
+			return
+		}
+	}
+
+	now := cache.clock.Now().Unix()
+	timeout := cache.capTTL(options.Timeout)
+	for k, v := range kvs {
+		modifyTime, ok := modifyTimes[k]
+		if !ok {
+			modifyTime = now
+		}
+		cache.lruData.Set(cache.lruKey(ctx, k), cache.newLRUData(k, v, modifyTime), timeout)
+		cache.onSet(k, LevelLRU, timeout)
+	}
+	for _, key := range missKeys {
+		ttl := cache.capTTL(jitter(options.MissTimeout, options.MissTimeoutJitter))
+		cache.lruData.Set(cache.lruKey(ctx, key), lruMiss, ttl)
+		cache.onSet(key, LevelLRU, ttl)
+	}
+}
+
+// newLRUData returns data of v kept in lru cache, decoded so reads need no unmarshal, and compressed only if
+// Options.LRUCompress is set. v is copied to not alias the caller's slice.
+func (cache *cacheImpl) newLRUData(key string, v []byte, modifyTime int64) *Data {
+	data := &Data{ModifyTime: modifyTime}
+	if cache.options.LRUCompress {
+		cache.compress(data, key, append([]byte(nil), v...))
+		return data
+	}
+	data.Raw = append([]byte(nil), v...)
+	data.CompressionType = CompressionType_None
+	return data
+}
+
+func (cache *cacheImpl) mSetRedisCache(ctx context.Context, kvs map[string][]byte, missKeys []string) error {
+	options := cache.options.RedisCacheOptions
+	if options == nil {
+		return nil
+	}
+	if ignoreNegativeCache(ctx) {
+		missKeys = nil
+	}
+	if filter := options.RedisWriteFilter; filter != nil {
+		kvs, missKeys = filterRedisWrites(filter, kvs, missKeys)
+	}
+
+	// keys failed to marshal are skipped rather than stored as garbage, the first error is returned after the rest
+	// are written
+	var marshalErr error
+	now := cache.clock.Now().Unix()
+	hardTimeout := cache.capRedisTTL(options.HardTimeout)
+	entries := make([]RedisEntry, 0, len(kvs)+len(missKeys))
+	keys := make([]string, 0, len(kvs)+len(missKeys)) // of entries
+	for k, v := range kvs {
+		data := Data{ModifyTime: now}
+		cache.compress(&data, k, v)
+		bs, err := marshalData(&data)
+		if err != nil {
+			glog.Errorf("%s redis %s marshal error %+v", cache.name, k, err)
+			if marshalErr == nil {
+				marshalErr = errs.Trace(err)
+			}
+			continue
+		}
+		entries = append(entries, RedisEntry{Key: cache.mkRedisKey(ctx, k), Value: bs, TTL: hardTimeout})
+		keys = append(keys, k)
+	}
+
+	if options.MissHardTimeout > 0 && len(missKeys) > 0 {
+		data := Data{
+			ModifyTime: now,
+			Miss:       true,
+		}
+		bs, err := marshalData(&data)
+		if err != nil {
+			glog.Errorf("%s redis miss marshal error %+v", cache.name, err)
+			if marshalErr == nil {
+				marshalErr = errs.Trace(err)
+			}
+			missKeys = nil
+		}
+		missHardTimeout := cache.capRedisTTL(options.MissHardTimeout)
+		for _, key := range missKeys {
+			entries = append(entries, RedisEntry{Key: cache.mkRedisKey(ctx, key), Value: bs, TTL: missHardTimeout})
+			keys = append(keys, key)
+		}
+	} else if options.MissTimeout >= time.Millisecond {
+		for _, key := range missKeys {
+			entries = append(entries, RedisEntry{
+				Key:   cache.mkRedisKey(ctx, key),
+				Value: missBytes,
+				TTL:   cache.capTTL(jitter(options.MissTimeout, options.MissTimeoutJitter)),
+			})
+			keys = append(keys, key)
+		}
+	}
+
+	if err := cache.writeRedis(ctx, keys, entries); err != nil {
+		return errs.Trace(err)
+	}
+	return marshalErr
+}
+
+// writeRedis writes entries of keys to redis, by fillIfNewer for loads if FillIfNewer is set
+func (cache *cacheImpl) writeRedis(ctx context.Context, keys []string, entries []RedisEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if fillStart, ok := fillStartOf(ctx); ok && cache.options.RedisCacheOptions.FillIfNewer {
+		return cache.fillIfNewer(ctx, keys, entries, fillStart)
+	}
+
+	start := time.Now()
+	err := cache.redisSet(ctx, entries)
+	cache.logSlowRedis("set", len(entries), start)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	for i, e := range entries {
+		cache.onSet(keys[i], LevelRedis, e.TTL)
+	}
+	return nil
+}
+
+// onSet reports ttl key is written to level with
+func (cache *cacheImpl) onSet(key string, level string, ttl time.Duration) {
+	if onSet := cache.options.OnSet; onSet != nil {
+		onSet(key, level, ttl)
+	}
+}
+
+// levelError reports err of level met by a read falling through to the next level
+func (cache *cacheImpl) levelError(level string, err error) {
+	if onLevelError := cache.options.OnLevelError; onLevelError != nil {
+		onLevelError(level, err)
+	}
+}
+
+// filterRedisWrites returns kvs and missKeys of keys filter accepts
+func filterRedisWrites(filter func(key string) bool, kvs map[string][]byte, missKeys []string) (map[string][]byte,
+	[]string) {
+	filtered := make(map[string][]byte, len(kvs))
+	for k, v := range kvs {
+		if filter(k) {
+			filtered[k] = v
+		}
+	}
+	var filteredMissKeys []string
+	for _, key := range missKeys {
+		if filter(key) {
+			filteredMissKeys = append(filteredMissKeys, key)
+		}
+	}
+	return filtered, filteredMissKeys
+}
+
+// capRedisTTL is capTTL of a redis ttl, which never expires if not positive, so is capped too
+func (cache *cacheImpl) capRedisTTL(ttl time.Duration) time.Duration {
+	if maxTTL := cache.options.MaxTTL; ttl <= 0 && maxTTL > 0 {
+		glog.Warningf("%s ttl %v clamped to max ttl %v", cache.name, ttl, maxTTL)
+		return maxTTL
+	}
+	return cache.capTTL(ttl)
+}
+
+// capTTL returns ttl capped to Options.MaxTTL
+func (cache *cacheImpl) capTTL(ttl time.Duration) time.Duration {
+	maxTTL := cache.options.MaxTTL
+	if maxTTL <= 0 || ttl <= maxTTL {
+		return ttl
+	}
+	glog.Warningf("%s ttl %v clamped to max ttl %v", cache.name, ttl, maxTTL)
+	return maxTTL
+}
+
+// redisSetOverhead rough bytes of a SET in a pipeline besides key and value
+const redisSetOverhead = 64
+
+// redisSet sets entries, by pipelines of at most MaxPipelineBytes if set. a failed pipeline stops the rest.
+func (cache *cacheImpl) redisSet(ctx context.Context, entries []RedisEntry) error {
+	for len(entries) > 0 {
+		n := cache.pipelineLen(entries)
+		if err := cache.redis.Set(ctx, entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// pipelineLen returns how many of entries go in the next pipeline of at most MaxPipelineBytes, all if not set. an
+// entry over the limit alone still goes in a pipeline of its own.
+func (cache *cacheImpl) pipelineLen(entries []RedisEntry) int {
+	maxBytes := cache.options.RedisCacheOptions.MaxPipelineBytes
+	if maxBytes <= 0 {
+		return len(entries)
+	}
+
+	n, size := 0, 0
+	for ; n < len(entries); n++ {
+		entrySize := len(entries[n].Key) + len(entries[n].Value) + redisSetOverhead
+		if n > 0 && size+entrySize > maxBytes {
+			break
+		}
+		size += entrySize
+	}
+	return n
+}
+
+// logSlowRedis logs a redis op of keys started at start if it exceeds SlowRedisThreshold, by the real clock
+func (cache *cacheImpl) logSlowRedis(op string, keys int, start time.Time) {
+	threshold := cache.options.RedisCacheOptions.SlowRedisThreshold
+	if threshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > threshold {
+		cache.stats.recordSlowRedisOp()
+		glog.Warningf("%s slow redis %s keys %d elapsed %v", cache.name, op, keys, elapsed)
+	}
+}
+
+func (cache *cacheImpl) mkRedisKey(ctx context.Context, key string) string {
+	prefix := cache.tenantPrefix(ctx, key)
+	if prefix == "" {
+		prefix = cache.options.RedisCacheOptions.Prefix
+	}
+	suffix, _ := cache.versionSuffix.Load().(string)
+	if builder := cache.options.RedisCacheOptions.RedisKeyBuilder; builder != nil {
+		return builder(prefix+suffix, key)
+	}
+	return prefix + suffix + "_" + key
+}
+
+// tenantPrefix returns prefix of key by RedisCacheOptions.PrefixFunc, empty for the default
+func (cache *cacheImpl) tenantPrefix(ctx context.Context, key string) string {
+	options := cache.options.RedisCacheOptions
+	if options == nil || options.PrefixFunc == nil {
+		return ""
+	}
+	return options.PrefixFunc(ctx, key)
+}
+
+// lruKey qualifies key by its tenant prefix and the prefix version, so tenants sharing the lru cache never read
+// each other's entries, and entries of older versions are never read. the qualifier is length prefixed, as tenant
+// prefixes and keys may contain any separator. keys of no qualifier are kept as they are to not allocate, unless
+// they look qualified.
+func (cache *cacheImpl) lruKey(ctx context.Context, key string) string {
+	suffix, _ := cache.versionSuffix.Load().(string)
+	qualifier := cache.tenantPrefix(ctx, key) + suffix
+	if qualifier == "" && unqualifyLRUKey(key) == key {
+		return key
+	}
+	return strconv.Itoa(len(qualifier)) + ":" + qualifier + key
+}
+
+// unqualifyLRUKey returns the key lruKey qualified
+func unqualifyLRUKey(lruKey string) string {
+	i := strings.IndexByte(lruKey, ':')
+	if i < 0 {
+		return lruKey
+	}
+	n, err := strconv.Atoi(lruKey[:i])
+	if err != nil || n < 0 || i+1+n > len(lruKey) {
+		return lruKey
+	}
+	return lruKey[i+1+n:]
+}
+
+// TrimLRU .
+func (cache *cacheImpl) TrimLRU(targetSize int64) error {
+	if err := cache.checkTrimmable(); err != nil {
+		return err
+	}
+	if targetSize < 0 {
+		return errs.New("target size invalid")
+	}
+
+	cache.lruData.Trim(targetSize)
+	return nil
+}
+
+// MDel .
+func (cache *cacheImpl) MDel(ctx context.Context, keys []string) error {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	cache.recordSets(ctx, keys)
 	if options := cache.options.LRUCacheOptions; options != nil {
 		for _, key := range keys {
-			cache.lruData.Delete(key)
+			cache.lruData.Delete(cache.lruKey(ctx, key))
 		}
 	}
 
 	if options := cache.options.RedisCacheOptions; options != nil {
 		var redisKeys []string
 		for _, key := range keys {
-			redisKeys = append(redisKeys, cache.mkRedisKey(key))
+			redisKeys = append(redisKeys, cache.mkRedisKey(ctx, key))
+		}
+		if options.TombstoneOnDel {
+			return cache.setTombstones(ctx, redisKeys)
 		}
-		err := options.Client.Del(redisKeys...).Err()
+		err := cache.redis.Del(ctx, redisKeys)
 		if err != nil {
 			return errs.Trace(err)
 		}
@@ -316,6 +1380,247 @@ func (cache *cacheImpl) MDel(ctx context.Context, keys []string) error {
 	return nil
 }
 
+// setTombstones replaces redis keys with misses, read as negative cache hits until they expire
+func (cache *cacheImpl) setTombstones(ctx context.Context, redisKeys []string) error {
+	ttl := cache.capTTL(cache.options.RedisCacheOptions.MissTimeout)
+	entries := make([]RedisEntry, 0, len(redisKeys))
+	for _, key := range redisKeys {
+		entries = append(entries, RedisEntry{Key: key, Value: missBytes, TTL: ttl})
+	}
+	if err := cache.redisSet(ctx, entries); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// Touch .
+func (cache *cacheImpl) Touch(ctx context.Context, keys []string, ttl time.Duration) error {
+	// PEXPIRE of a ttl not positive deletes keys
+	if ttl <= 0 {
+		return errs.New("ttl must be positive")
+	}
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	ttl = cache.capTTL(ttl)
+
+	if cache.options.LRUCacheOptions != nil {
+		for _, key := range keys {
+			if item := cache.lruData.Get(cache.lruKey(ctx, key)); item != nil && !item.Expired() {
+				item.Extend(ttl)
+			}
+		}
+	}
+
+	if cache.options.RedisCacheOptions != nil {
+		redisKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			redisKeys = append(redisKeys, cache.mkRedisKey(ctx, key))
+		}
+		if err := cache.redis.PExpire(ctx, redisKeys, ttl); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	return nil
+}
+
+// recompressScript sets KEYS[i] to ARGV[2i] keeping its ttl, if it still holds ARGV[2i-1] as read, so a write since
+// is not overwritten
+const recompressScript = `
+for k = 1, #KEYS do
+	if redis.call('GET', KEYS[k]) == ARGV[2 * k - 1] then
+		local ttl = redis.call('PTTL', KEYS[k])
+		if ttl > 0 then
+			redis.call('SET', KEYS[k], ARGV[2 * k], 'PX', ttl)
+		else
+			redis.call('SET', KEYS[k], ARGV[2 * k])
+		end
+	end
+end
+return 0
+`
+
+// Recompress .
+func (cache *cacheImpl) Recompress(ctx context.Context, keys []string) error {
+	if cache.options.RedisCacheOptions == nil {
+		return errs.New("rediscache not configured")
+	}
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	results, err := cache.redisGet(ctx, keys)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	redisKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		redisKeys = append(redisKeys, cache.mkRedisKey(ctx, key))
+	}
+
+	// dictionary id zstd entries written now have
+	var dictID uint32
+	if dicts := cache.options.ZstdDictionaries; len(dicts) > 0 {
+		dictID, _ = zstdDictID(dicts[0])
+	}
+
+	// entries to write and the values read they replace
+	var entries []RedisEntry
+	var olds [][]byte
+	for i, key := range keys {
+		v := results[i].Value
+		if !results[i].Found || bytes.Equal(v, missBytes) {
+			continue
+		}
+
+		var data Data
+		if err := proto.Unmarshal(v, &data); err != nil {
+			glog.Errorf("[%v] redis data format error", key)
+			continue
+		}
+		if data.Miss {
+			continue
+		}
+
+		// decompressed first, as CompressionFor may pick by value
+		raw, err := cache.decompress(&data)
+		if err != nil {
+			glog.Errorf("%s redis %s decompress error %+v", cache.name, key, err)
+			continue
+		}
+		compressionType := cache.compressionType(key, raw)
+		if data.CompressionType == compressionType &&
+			(compressionType != CompressionType_Zstd || data.DictionaryId == dictID) {
+			continue
+		}
+		cache.compress(&data, key, raw)
+		bs, err := marshalData(&data)
+		if err != nil {
+			// keep the old entry
+			glog.Errorf("%s redis %s marshal error %+v", cache.name, key, err)
+			continue
+		}
+		entries = append(entries, RedisEntry{Key: redisKeys[i], Value: bs})
+		olds = append(olds, v)
+	}
+
+	for len(entries) > 0 {
+		n := cache.pipelineLen(entries)
+		args := make([]interface{}, 0, 2*n)
+		chunkKeys := make([]string, 0, n)
+		for i, e := range entries[:n] {
+			chunkKeys = append(chunkKeys, e.Key)
+			args = append(args, olds[i], e.Value)
+		}
+		if _, err := cache.redis.Eval(ctx, recompressScript, chunkKeys, args...); err != nil {
+			return errs.Trace(err)
+		}
+		entries, olds = entries[n:], olds[n:]
+	}
+	return nil
+}
+
+// Ping .
+func (cache *cacheImpl) Ping(ctx context.Context) error {
+	if err := cache.options.isValid(); err != nil {
+		return errs.Trace(err)
+	}
+
+	if cache.options.RedisCacheOptions == nil {
+		return nil
+	}
+	if err := cache.redis.Ping(ctx); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// Stats .
+func (cache *cacheImpl) Stats() Stats {
+	return cache.stats.snapshot()
+}
+
+// Name .
+func (cache *cacheImpl) Name() string {
+	return cache.name
+}
+
+// Options .
+func (cache *cacheImpl) Options() Options {
+	options := *cache.options
+	if options.LRUCacheOptions != nil {
+		lruOptions := *options.LRUCacheOptions
+		options.LRUCacheOptions = &lruOptions
+	}
+	if options.RedisCacheOptions != nil {
+		redisOptions := *options.RedisCacheOptions
+		redisOptions.Client = nil
+		redisOptions.ContextClient = nil
+		cache.versionMu.Lock()
+		redisOptions.PrefixVersion = cache.version
+		cache.versionMu.Unlock()
+		options.RedisCacheOptions = &redisOptions
+	}
+	if options.LoaderRateLimiter != nil {
+		limiterOptions := *options.LoaderRateLimiter
+		options.LoaderRateLimiter = &limiterOptions
+	}
+	return options
+}
+
+// validKeys returns keys without empty and invalid ones, or ErrInvalidKey if FailOnInvalidKey is set
+func (cache *cacheImpl) validKeys(keys []string) ([]string, error) {
+	keys = skipEmptyKeys(keys)
+	if cache.options.KeyValidator == nil {
+		return keys, nil
+	}
+
+	valid := keys[:0:0]
+	for _, key := range keys {
+		if err := cache.validateKey(key); err != nil {
+			if cache.options.FailOnInvalidKey {
+				return nil, err
+			}
+			continue
+		}
+		valid = append(valid, key)
+	}
+	return valid, nil
+}
+
+// validateKey checks a non empty key with KeyValidator
+func (cache *cacheImpl) validateKey(key string) error {
+	if cache.options.KeyValidator == nil {
+		return nil
+	}
+	if err := cache.options.KeyValidator(key); err != nil {
+		glog.Errorf("%s invalid key %q %v", cache.name, key, err)
+		return errs.Tracef(ErrInvalidKey, "key %q: %v", key, err)
+	}
+	return nil
+}
+
+// skipEmptyKeys returns keys without empty strings, keys itself is returned if there is none
+func skipEmptyKeys(keys []string) []string {
+	for i, key := range keys {
+		if key != "" {
+			continue
+		}
+
+		valid := make([]string, i, len(keys))
+		copy(valid, keys[:i])
+		for _, key := range keys[i+1:] {
+			if key != "" {
+				valid = append(valid, key)
+			}
+		}
+		return valid
+	}
+	return keys
+}
+
 func substract(x, y []string) []string {
 	c := make(map[string]bool, len(y))
 	for _, e := range y {
@@ -331,28 +1636,123 @@ func substract(x, y []string) []string {
 	return diff
 }
 
-func compress(compressionType CompressionType, bs []byte) []byte {
-	switch compressionType {
+// jitter returns timeout plus a random offset in [0, window)
+func jitter(timeout, window time.Duration) time.Duration {
+	if window <= 0 {
+		return timeout
+	}
+	return timeout + time.Duration(rand.Int63n(int64(window)))
+}
+
+// compressionType returns the compression type value of key is written with
+func (cache *cacheImpl) compressionType(key string, value []byte) CompressionType {
+	if compressionFor := cache.options.CompressionFor; compressionFor != nil {
+		return compressionFor(key, value)
+	}
+	return cache.options.CompressionType
+}
+
+// compress sets bs of key compressed with its compression type to data, or as is if that does not make it smaller
+func (cache *cacheImpl) compress(data *Data, key string, bs []byte) {
+	data.CompressionType = cache.compressionType(key, bs)
+	data.DictionaryId = 0
+	switch data.CompressionType {
 	case CompressionType_None:
-		return bs
+		data.Raw = bs
 	case CompressionType_Snappy:
-		return snappy.Encode(nil, bs)
+		data.Raw = snappy.Encode(nil, bs)
+	case CompressionType_Zstd:
+		codec, err := cache.zstdCodec()
+		if err != nil {
+			glog.Errorf("%s zstd error, write uncompressed %+v", cache.name, err)
+			data.Raw = bs
+			data.CompressionType = CompressionType_None
+			return
+		}
+		data.Raw = codec.compress(bs)
+		data.DictionaryId = codec.dictID
 	default:
-		return bs
+		data.Raw = bs
+		data.CompressionType = CompressionType_None
+	}
+	// incompressible data grows, reads go by the type stored
+	if data.CompressionType != CompressionType_None && len(data.Raw) >= len(bs) {
+		data.Raw = bs
+		data.CompressionType = CompressionType_None
+		data.DictionaryId = 0
+	}
+
+	data.Checksum = 0
+	if cache.options.VerifyChecksum {
+		data.Checksum = crc32.ChecksumIEEE(data.Raw)
 	}
+	data.UncompressedLen = 0
+	if cache.options.VerifyLength {
+		data.UncompressedLen = uint32(len(bs))
+	}
+}
+
+// decompress returns the raw value of data, which may be any bytes found in redis. a panic of a decoder on them is
+// returned as an error.
+func (cache *cacheImpl) decompress(data *Data) (raw []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			raw = nil
+			err = errs.New("decompress panic: %v", r)
+		}
+	}()
+
+	if cache.options.VerifyChecksum && data.Checksum != 0 && crc32.ChecksumIEEE(data.Raw) != data.Checksum {
+		return nil, errs.New("checksum mismatch")
+	}
+
+	raw, err = cache.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if cache.options.VerifyLength && data.UncompressedLen != 0 && uint32(len(raw)) != data.UncompressedLen {
+		return nil, errs.New("uncompressed length %d mismatch %d", len(raw), data.UncompressedLen)
+	}
+	return raw, nil
 }
 
-func decompress(compressionType CompressionType, bs []byte) ([]byte, error) {
-	switch compressionType {
+// decode decompresses raw of data by its compression type
+func (cache *cacheImpl) decode(data *Data) ([]byte, error) {
+	switch data.CompressionType {
 	case CompressionType_None:
-		return bs, nil
+		return data.Raw, nil
 	case CompressionType_Snappy:
-		decompressed, err := snappy.Decode(nil, bs)
+		// snappy allocates the length in the header, checked first so a corrupt one does not allocate up to 4GB
+		n, err := snappy.DecodedLen(data.Raw)
+		if err != nil {
+			return nil, errs.Trace(err)
+		}
+		if cache.options.VerifyLength && data.UncompressedLen != 0 && uint32(n) != data.UncompressedLen {
+			return nil, errs.New("uncompressed length %d mismatch %d", n, data.UncompressedLen)
+		}
+		decompressed, err := snappy.Decode(nil, data.Raw)
+		if err != nil {
+			return nil, errs.Trace(err)
+		}
+		return decompressed, nil
+	case CompressionType_Zstd:
+		codec, err := cache.zstdCodec()
+		if err != nil {
+			return nil, errs.Trace(err)
+		}
+		decompressed, err := codec.decompress(data.DictionaryId, data.Raw)
 		if err != nil {
 			return nil, errs.Trace(err)
 		}
 		return decompressed, nil
 	default:
-		return nil, errs.New("unknown compress type %v", compressionType)
+		return nil, errs.New("unknown compress type %v", data.CompressionType)
 	}
 }
+
+func (cache *cacheImpl) zstdCodec() (*zstdCodec, error) {
+	cache.zstdOnce.Do(func() {
+		cache.zstd, cache.zstdError = newZstdCodec(cache.options.ZstdDictionaries)
+	})
+	return cache.zstd, cache.zstdError
+}
@@ -0,0 +1,15 @@
+package levelcache
+
+import "time"
+
+// Clock time source, Options.Clock can be overridden in tests to control soft timeouts without sleeping.
+// lru and redis ttls are still enforced by ccache and redis with the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,78 @@
+package levelcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/ericuni/errs"
+)
+
+// loadBatch keys of load calls within LoaderCoalesceWindow, loaded by one loader call
+type loadBatch struct {
+	keys   map[string]bool
+	done   chan struct{} // closed after values and err are set
+	values map[string][]byte
+	ttls   map[string]time.Duration
+	err    error
+}
+
+// coalescedLoad loads keys together with keys of other calls arriving within LoaderCoalesceWindow.
+// the first call of a batch waits the window and then loads the union with its ctx, the others wait for it.
+func (cache *cacheImpl) coalescedLoad(ctx context.Context, keys []string) (map[string][]byte,
+	map[string]time.Duration, error) {
+	window := cache.options.LoaderCoalesceWindow
+	if window <= 0 {
+		return cache.load(ctx, keys)
+	}
+
+	cache.coalesceMu.Lock()
+	batch := cache.loadBatch
+	first := batch == nil
+	if first {
+		batch = &loadBatch{keys: make(map[string]bool), done: make(chan struct{})}
+		cache.loadBatch = batch
+	}
+	for _, key := range keys {
+		batch.keys[key] = true
+	}
+	cache.coalesceMu.Unlock()
+
+	if first {
+		time.Sleep(window)
+		cache.coalesceMu.Lock()
+		cache.loadBatch = nil
+		cache.coalesceMu.Unlock()
+
+		union := make([]string, 0, len(batch.keys))
+		for key := range batch.keys {
+			union = append(union, key)
+		}
+		batch.values, batch.ttls, batch.err = cache.load(ctx, union)
+		close(batch.done)
+	} else {
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		select {
+		case <-batch.done:
+		case <-done:
+			return nil, nil, errs.Trace(ctx.Err())
+		}
+	}
+
+	values := make(map[string][]byte, len(keys))
+	var ttls map[string]time.Duration
+	for _, key := range keys {
+		if v, ok := batch.values[key]; ok {
+			values[key] = v
+		}
+		if ttl, ok := batch.ttls[key]; ok {
+			if ttls == nil {
+				ttls = make(map[string]time.Duration)
+			}
+			ttls[key] = ttl
+		}
+	}
+	return values, ttls, errs.Trace(batch.err)
+}
@@ -0,0 +1,439 @@
+package levelcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+)
+
+// MetaEntry a value with the time it was modified at the source
+type MetaEntry struct {
+	Value      []byte
+	ModifyTime time.Time // zero for now
+	// overrides RedisCacheOptions.SoftTimeout of this entry if positive, lru cache keeps it at most that long too
+	SoftTimeout time.Duration
+}
+
+// setIfNewerScript sets KEYS[i] to ARGV[3i-2] with ttl ARGV[3i] in milliseconds, if modify time ARGV[3i-1] is
+// greater than that of the existing Data. replies 1 for written keys and 0 for others.
+// Data is decoded by hand, ModifyTime is field 2. entries which are not Data(e.g. missBytes) count as modify time 0.
+const setIfNewerScript = `
+local function varint(s, i)
+	local v, shift = 0, 1
+	repeat
+		local b = string.byte(s, i)
+		if b == nil then return nil, i end
+		i = i + 1
+		v = v + (b % 128) * shift
+		shift = shift * 128
+	until b < 128
+	return v, i
+end
+
+local function modify_time(s)
+	local i = 1
+	while s and i <= #s do
+		local tag
+		tag, i = varint(s, i)
+		if tag == nil then return 0 end
+		local field, wire = math.floor(tag / 8), tag % 8
+		if wire == 0 then
+			local v
+			v, i = varint(s, i)
+			if v == nil then return 0 end
+			if field == 2 then return v end
+		elseif wire == 2 then
+			local n
+			n, i = varint(s, i)
+			if n == nil then return 0 end
+			i = i + n
+		elseif wire == 5 then
+			i = i + 4
+		elseif wire == 1 then
+			i = i + 8
+		else
+			return 0
+		end
+	end
+	return 0
+end
+
+local written = {}
+for k = 1, #KEYS do
+	local value, mtime, ttl = ARGV[3 * k - 2], tonumber(ARGV[3 * k - 1]), ARGV[3 * k]
+	local old = redis.call('GET', KEYS[k])
+	if old == false or modify_time(old) < mtime then
+		if tonumber(ttl) > 0 then
+			redis.call('SET', KEYS[k], value, 'PX', ttl)
+		else
+			redis.call('SET', KEYS[k], value)
+		end
+		written[k] = 1
+	else
+		written[k] = 0
+	end
+end
+return written
+`
+
+// MSetIfNewer .
+func (cache *cacheImpl) MSetIfNewer(ctx context.Context, entries map[string]MetaEntry) error {
+	entries, err := cache.validEntries(entries)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	cache.recordSets(ctx, keys)
+
+	// keys failed to marshal or rejected by redis are not written to lru either
+	written, err := cache.mSetRedisCacheIfNewer(ctx, entries)
+	kvs := make(map[string][]byte, len(written))
+	for _, key := range written {
+		kvs[key] = entries[key].Value
+	}
+	cache.stats.recordValueSizes(kvs)
+	cache.mSetLRUCacheIfNewer(ctx, written, entries)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// mSetRedisCacheIfNewer returns keys written, which are all keys if redis cache is not configured. entries are
+// written by scripts of at most MaxPipelineBytes like redisSet, keys of scripts done are returned with an error.
+func (cache *cacheImpl) mSetRedisCacheIfNewer(ctx context.Context, entries map[string]MetaEntry) ([]string, error) {
+	keys := make([]string, 0, len(entries))
+	options := cache.options.RedisCacheOptions
+	if options == nil {
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+
+	var marshalErr error
+	hardTimeout := cache.capRedisTTL(options.HardTimeout)
+	redisEntries := make([]RedisEntry, 0, len(entries))
+	mtimes := make([]int64, 0, len(entries))
+	for key, entry := range entries {
+		data := cache.metaData(key, entry)
+		bs, err := marshalData(&data)
+		if err != nil {
+			glog.Errorf("%s redis %s marshal error %+v", cache.name, key, err)
+			if marshalErr == nil {
+				marshalErr = errs.Trace(err)
+			}
+			continue
+		}
+		keys = append(keys, key)
+		redisEntries = append(redisEntries, RedisEntry{Key: cache.mkRedisKey(ctx, key), Value: bs, TTL: hardTimeout})
+		mtimes = append(mtimes, data.ModifyTime)
+	}
+
+	written := make([]string, 0, len(keys))
+	for len(redisEntries) > 0 {
+		n := cache.pipelineLen(redisEntries)
+		flags, err := cache.evalSetIfNewer(ctx, "set if newer", redisEntries[:n], mtimes[:n])
+		if err != nil {
+			return written, err
+		}
+		for i, key := range keys[:n] {
+			if flags[i] {
+				written = append(written, key)
+			}
+		}
+		keys, redisEntries, mtimes = keys[n:], redisEntries[n:], mtimes[n:]
+	}
+	return written, marshalErr
+}
+
+// evalSetIfNewer sets entries by setIfNewerScript with modify times mtimes, returning whether each is written
+func (cache *cacheImpl) evalSetIfNewer(ctx context.Context, op string, entries []RedisEntry, mtimes []int64) (
+	[]bool, error) {
+	redisKeys := make([]string, 0, len(entries))
+	args := make([]interface{}, 0, 3*len(entries))
+	for i, e := range entries {
+		redisKeys = append(redisKeys, e.Key)
+		args = append(args, e.Value, mtimes[i], e.TTL.Milliseconds())
+	}
+
+	start := time.Now()
+	reply, err := cache.redis.Eval(ctx, setIfNewerScript, redisKeys, args...)
+	cache.logSlowRedis(op, len(entries), start)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	flags, ok := reply.([]interface{})
+	if !ok || len(flags) != len(entries) {
+		return nil, errs.New("unexpected set if newer reply %v", reply)
+	}
+	written := make([]bool, len(flags))
+	for i, flag := range flags {
+		n, ok := flag.(int64)
+		written[i] = ok && n == 1
+	}
+	return written, nil
+}
+
+// mSetLRUCacheIfNewer sets keys of entries unless lru cache already holds data modified at or after
+func (cache *cacheImpl) mSetLRUCacheIfNewer(ctx context.Context, keys []string, entries map[string]MetaEntry) {
+	if cache.options.LRUCacheOptions == nil {
+		return
+	}
+
+	for _, key := range keys {
+		entry := entries[key]
+		if item := cache.lruData.Get(cache.lruKey(ctx, key)); item != nil {
+			if data, ok := lruValue(item).(*Data); ok && data.ModifyTime >= cache.modifyTime(entry).Unix() {
+				continue
+			}
+		}
+		cache.setLRUMeta(ctx, key, entry)
+	}
+}
+
+// fillStartKey carries the time a load started by ctx of its writes, if RedisCacheOptions.FillIfNewer is set
+type fillStartKey struct{}
+
+func fillStartOf(ctx context.Context) (time.Time, bool) {
+	if ctx == nil {
+		return time.Time{}, false
+	}
+	start, ok := ctx.Value(fillStartKey{}).(time.Time)
+	return start, ok
+}
+
+// fillIfNewer writes entries of keys loaded since start to redis by setIfNewerScript, by scripts of at most
+// MaxPipelineBytes like redisSet. keys not written are dropped from lru cache.
+func (cache *cacheImpl) fillIfNewer(ctx context.Context, keys []string, entries []RedisEntry, start time.Time) error {
+	for len(entries) > 0 {
+		n := cache.pipelineLen(entries)
+		if err := cache.fillChunkIfNewer(ctx, keys[:n], entries[:n], start); err != nil {
+			return err
+		}
+		keys, entries = keys[n:], entries[n:]
+	}
+	return nil
+}
+
+func (cache *cacheImpl) fillChunkIfNewer(ctx context.Context, keys []string, entries []RedisEntry,
+	start time.Time) error {
+	mtimes := make([]int64, len(entries))
+	for i := range mtimes {
+		mtimes[i] = start.Unix()
+	}
+	flags, err := cache.evalSetIfNewer(ctx, "fill if newer", entries, mtimes)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if flags[i] {
+			cache.onSet(key, LevelRedis, entries[i].TTL)
+		} else if cache.options.LRUCacheOptions != nil {
+			cache.lruData.Delete(cache.lruKey(ctx, key))
+		}
+	}
+	return nil
+}
+
+// MSetNX .
+func (cache *cacheImpl) MSetNX(ctx context.Context, kvs map[string][]byte) error {
+	return cache.mSetConditional(ctx, kvs, false)
+}
+
+// MSetXX .
+func (cache *cacheImpl) MSetXX(ctx context.Context, kvs map[string][]byte) error {
+	return cache.mSetConditional(ctx, kvs, true)
+}
+
+// mSetConditional sets kvs to redis cache only if keys exist when exist is set, only if they do not otherwise. lru
+// cache is set with the keys written. entries are written by pipelines of at most MaxPipelineBytes like redisSet,
+// keys of pipelines done are set to lru cache even if a later one fails. keys RedisWriteFilter rejects are written
+// to neither, as there is no redis condition to check.
+func (cache *cacheImpl) mSetConditional(ctx context.Context, kvs map[string][]byte, exist bool) error {
+	options := cache.options.RedisCacheOptions
+	if options == nil {
+		return errs.New("rediscache not configured")
+	}
+	setter, ok := cache.redis.(RedisConditionalSetter)
+	if !ok {
+		return errs.New("redis client does not support conditional set")
+	}
+	kvs, err := cache.validKVs(kvs)
+	if err != nil || len(kvs) == 0 {
+		return err
+	}
+
+	var marshalErr error
+	now := cache.clock.Now().Unix()
+	hardTimeout := cache.capRedisTTL(options.HardTimeout)
+	keys := make([]string, 0, len(kvs))
+	entries := make([]RedisEntry, 0, len(kvs))
+	for k, v := range kvs {
+		if filter := options.RedisWriteFilter; filter != nil && !filter(k) {
+			continue
+		}
+		data := Data{ModifyTime: now}
+		cache.compress(&data, k, v)
+		bs, err := marshalData(&data)
+		if err != nil {
+			glog.Errorf("%s redis %s marshal error %+v", cache.name, k, err)
+			if marshalErr == nil {
+				marshalErr = errs.Trace(err)
+			}
+			continue
+		}
+		keys = append(keys, k)
+		entries = append(entries, RedisEntry{Key: cache.mkRedisKey(ctx, k), Value: bs, TTL: hardTimeout})
+	}
+	if len(entries) == 0 {
+		return marshalErr
+	}
+
+	cache.recordSets(ctx, keys)
+	set, op := setter.SetNX, "set nx"
+	if exist {
+		set, op = setter.SetXX, "set xx"
+	}
+	writtenKVs := make(map[string][]byte, len(keys))
+	var setErr error
+	for len(entries) > 0 {
+		n := cache.pipelineLen(entries)
+		start := time.Now()
+		written, err := set(ctx, entries[:n])
+		cache.logSlowRedis(op, n, start)
+		if err != nil {
+			setErr = errs.Trace(err)
+			break
+		}
+		for i, key := range keys[:n] {
+			if written[i] {
+				writtenKVs[key] = kvs[key]
+				cache.onSet(key, LevelRedis, entries[i].TTL)
+			}
+		}
+		keys, entries = keys[n:], entries[n:]
+	}
+
+	cache.stats.recordValueSizes(writtenKVs)
+	cache.mSetLRUCache(ctx, writtenKVs, nil)
+	if setErr != nil {
+		return setErr
+	}
+	return marshalErr
+}
+
+// MSetWithMeta .
+func (cache *cacheImpl) MSetWithMeta(ctx context.Context, entries map[string]MetaEntry) error {
+	entries, err := cache.validEntries(entries)
+	if err != nil {
+		return err
+	}
+	return cache.mSetMeta(ctx, entries)
+}
+
+// mSetMeta is MSetWithMeta of valid keys, writing redis the same way as mSet
+func (cache *cacheImpl) mSetMeta(ctx context.Context, entries map[string]MetaEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	kvs := make(map[string][]byte, len(entries))
+	keys := make([]string, 0, len(entries))
+	for key, entry := range entries {
+		kvs[key] = entry.Value
+		keys = append(keys, key)
+	}
+	cache.stats.recordValueSizes(kvs)
+	cache.recordSets(ctx, keys)
+
+	if cache.options.LRUCacheOptions != nil {
+		for key := range kvs {
+			cache.setLRUMeta(ctx, key, entries[key])
+		}
+	}
+
+	if cache.options.RedisCacheOptions == nil {
+		return nil
+	}
+	if cache.asyncWriteSlot() {
+		// copied, as the caller may modify entries after return
+		copied := make(map[string]MetaEntry, len(entries))
+		for key, entry := range entries {
+			entry.Value = append([]byte(nil), entry.Value...)
+			copied[key] = entry
+		}
+		cache.asyncRedisWrite(ctx, keys, func(ctx context.Context, unset []string) error {
+			only := make(map[string]MetaEntry, len(unset))
+			for _, key := range unset {
+				only[key] = copied[key]
+			}
+			return cache.mSetRedisCacheMeta(ctx, only)
+		})
+		return nil
+	}
+	return cache.mSetRedisCacheMeta(ctx, entries)
+}
+
+// mSetRedisCacheMeta writes entries to redis cache with their meta, filtered by RedisWriteFilter
+func (cache *cacheImpl) mSetRedisCacheMeta(ctx context.Context, entries map[string]MetaEntry) error {
+	options := cache.options.RedisCacheOptions
+	var marshalErr error
+	hardTimeout := cache.capRedisTTL(options.HardTimeout)
+	keys := make([]string, 0, len(entries))
+	redisEntries := make([]RedisEntry, 0, len(entries))
+	for key, entry := range entries {
+		if filter := options.RedisWriteFilter; filter != nil && !filter(key) {
+			continue
+		}
+		data := cache.metaData(key, entry)
+		bs, err := marshalData(&data)
+		if err != nil {
+			glog.Errorf("%s redis %s marshal error %+v", cache.name, key, err)
+			if marshalErr == nil {
+				marshalErr = errs.Trace(err)
+			}
+			continue
+		}
+		keys = append(keys, key)
+		redisEntries = append(redisEntries, RedisEntry{Key: cache.mkRedisKey(ctx, key), Value: bs, TTL: hardTimeout})
+	}
+	if err := cache.writeRedis(ctx, keys, redisEntries); err != nil {
+		return errs.Trace(err)
+	}
+	return marshalErr
+}
+
+// setLRUMeta sets entry to lru cache, for no longer than its soft timeout
+func (cache *cacheImpl) setLRUMeta(ctx context.Context, key string, entry MetaEntry) {
+	timeout := cache.options.LRUCacheOptions.Timeout
+	if entry.SoftTimeout > 0 && entry.SoftTimeout < timeout {
+		timeout = entry.SoftTimeout
+	}
+	timeout = cache.capTTL(timeout)
+	cache.lruData.Set(cache.lruKey(ctx, key), cache.newLRUData(key, entry.Value, cache.modifyTime(entry).Unix()),
+		timeout)
+	cache.onSet(key, LevelLRU, timeout)
+}
+
+// metaData returns redis data of entry of key
+func (cache *cacheImpl) metaData(key string, entry MetaEntry) Data {
+	data := Data{
+		ModifyTime:  cache.modifyTime(entry).Unix(),
+		SoftTimeout: entry.SoftTimeout.Milliseconds(),
+	}
+	cache.compress(&data, key, entry.Value)
+	return data
+}
+
+func (cache *cacheImpl) modifyTime(entry MetaEntry) time.Time {
+	if entry.ModifyTime.IsZero() {
+		return cache.clock.Now()
+	}
+	return entry.ModifyTime
+}
@@ -0,0 +1,78 @@
+package levelcache
+
+import (
+	"context"
+	"time"
+)
+
+type ignoreNegativeCacheKey struct{}
+
+// WithoutNegativeCache returns a ctx making cache calls with it take negative cache entries as misses and write no
+// negative cache entries, e.g. for a forced refresh. entries already cached are left as is.
+func WithoutNegativeCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ignoreNegativeCacheKey{}, true)
+}
+
+func ignoreNegativeCache(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	ignore, _ := ctx.Value(ignoreNegativeCacheKey{}).(bool)
+	return ignore
+}
+
+type cacheControlKey struct{}
+
+// CacheControl directives of cache calls with a ctx of WithCacheControl, like those of http
+type CacheControl struct {
+	NoCache bool // load keys regardless of cache, the loaded values replace the cached ones unless NoStore
+	NoStore bool // write nothing to cache, neither loaded values and misses nor redis hits to lru cache
+	// values soft expired in redis cache, or expired in lru cache without redis cache, no longer than MaxStale ago are
+	// returned as expired values(valid false) without loading them
+	MaxStale time.Duration
+	// values modified no longer than MaxStaleness ago(seconds precision) are returned by the first level having them,
+	// without reading deeper levels or loading them. valid is false if expired.
+	MaxStaleness time.Duration
+}
+
+// WithCacheControl returns a ctx making cache calls with it honor control
+func WithCacheControl(ctx context.Context, control CacheControl) context.Context {
+	return context.WithValue(ctx, cacheControlKey{}, control)
+}
+
+// GetCacheControl returns the directives of ctx, zero if none
+func GetCacheControl(ctx context.Context) CacheControl {
+	if ctx == nil {
+		return CacheControl{}
+	}
+	control, _ := ctx.Value(cacheControlKey{}).(CacheControl)
+	return control
+}
+
+// detachedContext keeps values of a ctx but not its deadline and cancellation, for work outliving the call
+type detachedContext struct {
+	ctx context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return detachedContext{ctx: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.ctx.Value(key)
+}
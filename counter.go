@@ -0,0 +1,118 @@
+package levelcache
+
+import (
+	"context"
+
+	"github.com/ericuni/errs"
+)
+
+// incrScript increases the counter of KEYS[1] by ARGV[1], writing it back as an uncompressed Data of modify time
+// ARGV[2] with ttl ARGV[3] in milliseconds, and replies the counter. Data is decoded and encoded by hand, Raw is
+// field 1 and CompressionType field 3. absent and negatively cached keys count as 0. lua numbers are doubles, so
+// counters are exact up to 2^53.
+const incrScript = `
+local function varint(s, i)
+	local v, shift = 0, 1
+	repeat
+		local b = string.byte(s, i)
+		if b == nil then return nil, i end
+		i = i + 1
+		v = v + (b % 128) * shift
+		shift = shift * 128
+	until b < 128
+	return v, i
+end
+
+local function encode_varint(v)
+	local bytes = {}
+	repeat
+		local b = v % 128
+		v = math.floor(v / 128)
+		if v > 0 then b = b + 128 end
+		bytes[#bytes + 1] = string.char(b)
+	until v == 0
+	return table.concat(bytes)
+end
+
+local function counter(s)
+	local raw, miss, i = '', false, 1
+	while i <= #s do
+		local tag
+		tag, i = varint(s, i)
+		if tag == nil then return nil end
+		local field, wire = math.floor(tag / 8), tag % 8
+		if wire == 0 then
+			local v
+			v, i = varint(s, i)
+			if v == nil then return nil end
+			if field == 3 and v ~= 0 then return nil end
+			if field == 4 and v ~= 0 then miss = true end
+		elseif wire == 2 then
+			local n
+			n, i = varint(s, i)
+			if n == nil then return nil end
+			if field == 1 then raw = string.sub(s, i, i + n - 1) end
+			i = i + n
+		elseif wire == 5 then
+			i = i + 4
+		elseif wire == 1 then
+			i = i + 8
+		else
+			return nil
+		end
+	end
+	if miss or raw == '' then return 0 end
+	return tonumber(raw)
+end
+
+local old = redis.call('GET', KEYS[1])
+local n = 0
+if old then
+	n = counter(old)
+	if n == nil or n ~= math.floor(n) then
+		return redis.error_reply('value of ' .. KEYS[1] .. ' is not a counter')
+	end
+end
+n = n + tonumber(ARGV[1])
+
+local raw = string.format('%d', n)
+local data = string.char(10) .. encode_varint(#raw) .. raw .. string.char(16) .. encode_varint(tonumber(ARGV[2]))
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], data, 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], data)
+end
+return n
+`
+
+// Incr .
+func (cache *cacheImpl) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	options := cache.options.RedisCacheOptions
+	if options == nil {
+		return 0, errs.New("rediscache not configured")
+	}
+	keys, err := cache.validKeys([]string{key})
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, errs.New("key %q invalid", key)
+	}
+
+	cache.recordSets(ctx, keys)
+	reply, err := cache.redis.Eval(ctx, incrScript, []string{cache.mkRedisKey(ctx, key)}, delta,
+		cache.clock.Now().Unix(), cache.capRedisTTL(options.HardTimeout).Milliseconds())
+	if err != nil {
+		return 0, errs.Trace(err)
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errs.New("unexpected incr reply %v", reply)
+	}
+
+	// concurrent increments may finish out of order, so lru cache reads the counter from redis again
+	if cache.options.LRUCacheOptions != nil {
+		cache.lruData.Delete(cache.lruKey(ctx, key))
+	}
+	return n, nil
+}
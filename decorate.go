@@ -0,0 +1,126 @@
+package levelcache
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+	"github.com/karlseguin/ccache"
+)
+
+// decorated objects kept at most if the lru cache is sized by bytes, otherwise as many as its items
+const decoratedSizeOfBytesLRU = 10000
+
+// decoratedEntry a decorated object of raw of the lru value data
+type decoratedEntry struct {
+	data  *Data
+	raw   []byte
+	value interface{}
+}
+
+// decoratedCache returns objects of Decorator by lru key, created on first use if LRUCacheOptions.LazyInit is set.
+// nil unless both Decorator and lru cache are set.
+func (cache *cacheImpl) decoratedCache() *ccache.Cache {
+	options := cache.options.LRUCacheOptions
+	if cache.options.Decorator == nil || options == nil {
+		return nil
+	}
+	cache.decoratedOnce.Do(func() {
+		cache.decorated = newDecoratedCache(options)
+	})
+	return cache.decorated
+}
+
+func newDecoratedCache(options *LRUCacheOptions) *ccache.Cache {
+	size := options.Size
+	if size <= 0 {
+		size = decoratedSizeOfBytesLRU
+	}
+	return ccache.New(ccache.Configure().MaxSize(size).ItemsToPrune(itemsToPrune(size)))
+}
+
+// MGetDecorated .
+func (cache *cacheImpl) MGetDecorated(ctx context.Context, keys []string) (map[string]interface{}, map[string]bool,
+	error) {
+	decorator := cache.options.Decorator
+	if decorator == nil {
+		return nil, nil, errs.New("decorator not configured")
+	}
+
+	values, valids, err := cache.MGet(ctx, keys)
+	decorated := make(map[string]interface{}, len(values))
+	var decorateErr error
+	for key, raw := range values {
+		value, ok := cache.getDecorated(ctx, key, raw)
+		if !ok {
+			var err error
+			if value, err = decorator(key, raw); err != nil {
+				glog.Errorf("%s decorate %s error %+v", cache.name, key, err)
+				if decorateErr == nil {
+					decorateErr = errs.Trace(err)
+				}
+				delete(valids, key)
+				continue
+			}
+			cache.setDecorated(ctx, key, raw, value)
+		}
+		decorated[key] = value
+	}
+	if err != nil {
+		return decorated, valids, err
+	}
+	return decorated, valids, decorateErr
+}
+
+// getDecorated returns the decorated object of the current lru value of key, if decorated from raw returned for
+// key, which may be of another level or an older lru value
+func (cache *cacheImpl) getDecorated(ctx context.Context, key string, raw []byte) (interface{}, bool) {
+	decorated := cache.decoratedCache()
+	if decorated == nil {
+		return nil, false
+	}
+	lruKey := cache.lruKey(ctx, key)
+	item := decorated.Get(lruKey)
+	if item == nil {
+		return nil, false
+	}
+	entry := item.Value().(*decoratedEntry)
+	if lruItem := cache.lruData.Peek(lruKey); lruItem == nil || lruValue(lruItem) != entry.data {
+		decorated.Delete(lruKey)
+		return nil, false
+	}
+	if !bytes.Equal(entry.raw, raw) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// setDecorated keeps value decorated from raw as long as the current lru value of key lives, if that is still raw
+func (cache *cacheImpl) setDecorated(ctx context.Context, key string, raw []byte, value interface{}) {
+	decorated := cache.decoratedCache()
+	if decorated == nil {
+		return
+	}
+	lruKey := cache.lruKey(ctx, key)
+	lruItem := cache.lruData.Peek(lruKey)
+	if lruItem == nil || lruItem.Expired() {
+		return
+	}
+	data, ok := lruValue(lruItem).(*Data)
+	if !ok || data.Miss {
+		return
+	}
+	// the lru value may be set again since raw was read
+	current := data.Raw
+	if data.CompressionType != CompressionType_None {
+		var err error
+		if current, err = cache.decompress(data); err != nil {
+			return
+		}
+	}
+	if !bytes.Equal(current, raw) {
+		return
+	}
+	decorated.Set(lruKey, &decoratedEntry{data: data, raw: current, value: value}, lruItem.TTL())
+}
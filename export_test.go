@@ -0,0 +1,46 @@
+package levelcache
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// SetMarshalData replaces Data marshaling, call the returned func to restore
+func SetMarshalData(marshal func(data *Data) ([]byte, error)) func() {
+	old := marshalData
+	marshalData = marshal
+	return func() {
+		marshalData = old
+	}
+}
+
+// LRUAllocated reports whether the lru cache of cache is created, not safe with concurrent use of cache
+func LRUAllocated(cache Cache) bool {
+	return cache.(*cacheImpl).lruData.shards != nil
+}
+
+// DecoratedAllocated reports whether the cache of decorated objects of cache is created, not safe with concurrent use
+// of cache
+func DecoratedAllocated(cache Cache) bool {
+	return cache.(*cacheImpl).decorated != nil
+}
+
+// ClearLRU clears the lru cache of cache, not safe with concurrent use of cache
+func ClearLRU(cache Cache) {
+	cache.(*cacheImpl).lruData.Clear()
+}
+
+// ShardAndStripe returns the lru shard and loader lock stripe key is routed to
+func ShardAndStripe(cache Cache, key string) (int, int) {
+	impl := cache.(*cacheImpl)
+	return impl.lruData.shardIndex(key), impl.loadLocks.stripe(key)
+}
+
+// NewRedisV6Client returns the RedisClient adapting client, e.g. to wrap as RedisCacheOptions.ContextClient
+func NewRedisV6Client(client *redis.Client) RedisClient {
+	return &redisV6Client{client: client}
+}
+
+// LoaderLockStripe returns the loader lock stripe key is routed to
+func LoaderLockStripe(cache Cache, key string) int {
+	return cache.(*cacheImpl).loadLocks.stripe(key)
+}
@@ -0,0 +1,668 @@
+package levelcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ericuni/errs"
+)
+
+// Federation a Cache routing each key to one of several independent caches, e.g. caches sharding keys by range.
+// calls are split by key and made to the caches concurrently, their results merged and the first error returned.
+// calls without keys are made to every cache.
+type Federation struct {
+	name   string
+	caches []Cache
+	route  func(key string) int
+}
+
+var _ Cache = (*Federation)(nil)
+
+// NewFederation create a federation of caches, route returns the index in caches of the one serving key
+// panic if name is empty, caches empty or route nil
+func NewFederation(name string, caches []Cache, route func(key string) int) *Federation {
+	if name == "" {
+		panic(errors.New("name empty"))
+	}
+	if len(caches) == 0 {
+		panic(errors.New("caches empty"))
+	}
+	if route == nil {
+		panic(errors.New("route nil"))
+	}
+
+	return &Federation{
+		name:   name,
+		caches: caches,
+		route:  route,
+	}
+}
+
+// index returns index of the cache of key
+func (f *Federation) index(key string) (int, error) {
+	i := f.route(key)
+	if i < 0 || i >= len(f.caches) {
+		return 0, errs.New("route of key %s %d out of range", key, i)
+	}
+	return i, nil
+}
+
+// group returns keys of each cache, empty keys are skipped
+func (f *Federation) group(keys []string) ([][]string, error) {
+	groups := make([][]string, len(f.caches))
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		i, err := f.index(key)
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups, nil
+}
+
+func (f *Federation) groupKVs(kvs map[string][]byte) ([]map[string][]byte, error) {
+	groups := make([]map[string][]byte, len(f.caches))
+	for k, v := range kvs {
+		if k == "" {
+			continue
+		}
+		i, err := f.index(k)
+		if err != nil {
+			return nil, err
+		}
+		if groups[i] == nil {
+			groups[i] = make(map[string][]byte)
+		}
+		groups[i][k] = v
+	}
+	return groups, nil
+}
+
+func (f *Federation) groupEntries(entries map[string]MetaEntry) ([]map[string]MetaEntry, error) {
+	groups := make([]map[string]MetaEntry, len(f.caches))
+	for k, v := range entries {
+		if k == "" {
+			continue
+		}
+		i, err := f.index(k)
+		if err != nil {
+			return nil, err
+		}
+		if groups[i] == nil {
+			groups[i] = make(map[string]MetaEntry)
+		}
+		groups[i][k] = v
+	}
+	return groups, nil
+}
+
+// each calls fn concurrently with index of every cache for which has is true, returns the first error
+func (f *Federation) each(has func(i int) bool, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(f.caches))
+	for i := range f.caches {
+		if !has(i) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errCh <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	return <-errCh
+}
+
+func allCaches(i int) bool {
+	return true
+}
+
+// eachKeys calls fn concurrently with each cache having keys and its keys
+func (f *Federation) eachKeys(keys []string, fn func(cache Cache, keys []string) error) error {
+	groups, err := f.group(keys)
+	if err != nil {
+		return err
+	}
+	return f.each(func(i int) bool {
+		return len(groups[i]) > 0
+	}, func(i int) error {
+		return fn(f.caches[i], groups[i])
+	})
+}
+
+// eachKVs calls fn concurrently with each cache having keys of kvs and its kvs
+func (f *Federation) eachKVs(kvs map[string][]byte, fn func(cache Cache, kvs map[string][]byte) error) error {
+	groups, err := f.groupKVs(kvs)
+	if err != nil {
+		return err
+	}
+	return f.each(func(i int) bool {
+		return len(groups[i]) > 0
+	}, func(i int) error {
+		return fn(f.caches[i], groups[i])
+	})
+}
+
+func (f *Federation) eachEntries(entries map[string]MetaEntry,
+	fn func(cache Cache, entries map[string]MetaEntry) error) error {
+	groups, err := f.groupEntries(entries)
+	if err != nil {
+		return err
+	}
+	return f.each(func(i int) bool {
+		return len(groups[i]) > 0
+	}, func(i int) error {
+		return fn(f.caches[i], groups[i])
+	})
+}
+
+// MGet .
+func (f *Federation) MGet(ctx context.Context, keys []string) (map[string][]byte, map[string]bool, error) {
+	var mu sync.Mutex
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, valids, err := cache.MGet(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		return err
+	})
+	return valuesMap, validsMap, err
+}
+
+// MGetInto .
+func (f *Federation) MGetInto(ctx context.Context, keys []string, valuesOut map[string][]byte,
+	validsOut map[string]bool, reset bool) error {
+	if reset {
+		for k := range valuesOut {
+			delete(valuesOut, k)
+		}
+		for k := range validsOut {
+			delete(validsOut, k)
+		}
+	}
+
+	if _, err := f.group(keys); err != nil {
+		return err
+	}
+	if !reset {
+		// previous results of the same keys would be taken as expired values, as of cacheImpl
+		for _, key := range keys {
+			delete(valuesOut, key)
+			delete(validsOut, key)
+		}
+	}
+
+	values, valids, err := f.MGet(ctx, keys)
+	for k, v := range values {
+		valuesOut[k] = v
+	}
+	for k, v := range valids {
+		validsOut[k] = v
+	}
+	return err
+}
+
+// MGetStream calls fn from one cache at a time
+func (f *Federation) MGetStream(ctx context.Context, keys []string,
+	fn func(key string, value []byte, valid bool) error) error {
+	var mu sync.Mutex
+	var fnErr error
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.MGetStream(ctx, keys, func(key string, value []byte, valid bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			// stops the other caches once fn fails
+			if fnErr == nil {
+				fnErr = fn(key, value, valid)
+			}
+			return fnErr
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// MGetDetailed .
+func (f *Federation) MGetDetailed(ctx context.Context, keys []string) (map[string][]byte, map[string]bool,
+	map[string]bool, error) {
+	var mu sync.Mutex
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	negativesMap := make(map[string]bool)
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, valids, negatives, err := cache.MGetDetailed(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		for k, v := range negatives {
+			negativesMap[k] = v
+		}
+		return err
+	})
+	return valuesMap, validsMap, negativesMap, err
+}
+
+// MGetFull .
+func (f *Federation) MGetFull(ctx context.Context, keys []string) (map[string]MGetResult, error) {
+	var mu sync.Mutex
+	resultsMap := make(map[string]MGetResult, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		results, err := cache.MGetFull(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range results {
+			resultsMap[k] = v
+		}
+		return err
+	})
+	return resultsMap, err
+}
+
+// MGetWithSummary .
+func (f *Federation) MGetWithSummary(ctx context.Context, keys []string) (map[string][]byte, map[string]bool,
+	Summary, error) {
+	var mu sync.Mutex
+	var summary Summary
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, valids, s, err := cache.MGetWithSummary(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		summary.LRUHits += s.LRUHits
+		summary.RedisHits += s.RedisHits
+		summary.LoaderHits += s.LoaderHits
+		summary.Misses += s.Misses
+		return err
+	})
+	return valuesMap, validsMap, summary, err
+}
+
+// MGetDecorated .
+func (f *Federation) MGetDecorated(ctx context.Context, keys []string) (map[string]interface{}, map[string]bool,
+	error) {
+	var mu sync.Mutex
+	valuesMap := make(map[string]interface{}, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, valids, err := cache.MGetDecorated(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		return err
+	})
+	return valuesMap, validsMap, err
+}
+
+// MGetWithRefresh fresh receives the values loaded by all caches merged
+func (f *Federation) MGetWithRefresh(ctx context.Context, keys []string) (map[string][]byte,
+	<-chan map[string][]byte, error) {
+	var mu sync.Mutex
+	valuesMap := make(map[string][]byte, len(keys))
+	var freshes []<-chan map[string][]byte
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, fresh, err := cache.MGetWithRefresh(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		freshes = append(freshes, fresh)
+		return err
+	})
+
+	merged := make(chan map[string][]byte, 1)
+	go func() {
+		defer close(merged)
+		var loaded map[string][]byte
+		for _, fresh := range freshes {
+			for values := range fresh {
+				if loaded == nil {
+					loaded = make(map[string][]byte, len(values))
+				}
+				for k, v := range values {
+					loaded[k] = v
+				}
+			}
+		}
+		if loaded != nil {
+			merged <- loaded
+		}
+	}()
+	return valuesMap, merged, err
+}
+
+// MGetWithBudget each cache is given the whole budget, as they are called concurrently
+func (f *Federation) MGetWithBudget(ctx context.Context, keys []string, budget time.Duration) (map[string][]byte,
+	map[string]bool, error) {
+	var mu sync.Mutex
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		values, valids, err := cache.MGetWithBudget(ctx, keys, budget)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range values {
+			valuesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		return err
+	})
+	return valuesMap, validsMap, err
+}
+
+// MGetRaw .
+func (f *Federation) MGetRaw(ctx context.Context, keys []string) (map[string]RawEntry, map[string]bool, error) {
+	var mu sync.Mutex
+	entriesMap := make(map[string]RawEntry, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		entries, valids, err := cache.MGetRaw(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range entries {
+			entriesMap[k] = v
+		}
+		for k, v := range valids {
+			validsMap[k] = v
+		}
+		return err
+	})
+	return entriesMap, validsMap, err
+}
+
+// InspectRedis .
+func (f *Federation) InspectRedis(ctx context.Context, key string) (*Data, error) {
+	i, err := f.index(key)
+	if err != nil {
+		return nil, err
+	}
+	return f.caches[i].InspectRedis(ctx, key)
+}
+
+// MExists .
+func (f *Federation) MExists(ctx context.Context, keys []string) (map[string]bool, error) {
+	var mu sync.Mutex
+	existsMap := make(map[string]bool, len(keys))
+	err := f.eachKeys(keys, func(cache Cache, keys []string) error {
+		exists, err := cache.MExists(ctx, keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range exists {
+			existsMap[k] = v
+		}
+		return err
+	})
+	return existsMap, err
+}
+
+// MSet .
+func (f *Federation) MSet(ctx context.Context, kvs map[string][]byte) error {
+	return f.eachKVs(kvs, func(cache Cache, kvs map[string][]byte) error {
+		return cache.MSet(ctx, kvs)
+	})
+}
+
+// MDel .
+func (f *Federation) MDel(ctx context.Context, keys []string) error {
+	return f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.MDel(ctx, keys)
+	})
+}
+
+// MSetNX .
+func (f *Federation) MSetNX(ctx context.Context, kvs map[string][]byte) error {
+	return f.eachKVs(kvs, func(cache Cache, kvs map[string][]byte) error {
+		return cache.MSetNX(ctx, kvs)
+	})
+}
+
+// MSetXX .
+func (f *Federation) MSetXX(ctx context.Context, kvs map[string][]byte) error {
+	return f.eachKVs(kvs, func(cache Cache, kvs map[string][]byte) error {
+		return cache.MSetXX(ctx, kvs)
+	})
+}
+
+// MSetIfNewer .
+func (f *Federation) MSetIfNewer(ctx context.Context, entries map[string]MetaEntry) error {
+	return f.eachEntries(entries, func(cache Cache, entries map[string]MetaEntry) error {
+		return cache.MSetIfNewer(ctx, entries)
+	})
+}
+
+// Touch .
+func (f *Federation) Touch(ctx context.Context, keys []string, ttl time.Duration) error {
+	return f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.Touch(ctx, keys, ttl)
+	})
+}
+
+// Incr .
+func (f *Federation) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	i, err := f.index(key)
+	if err != nil {
+		return 0, err
+	}
+	return f.caches[i].Incr(ctx, key, delta)
+}
+
+// MSetWithMeta .
+func (f *Federation) MSetWithMeta(ctx context.Context, entries map[string]MetaEntry) error {
+	return f.eachEntries(entries, func(cache Cache, entries map[string]MetaEntry) error {
+		return cache.MSetWithMeta(ctx, entries)
+	})
+}
+
+// MSetAliases aliases are routed by themselves, not by their canonical keys
+func (f *Federation) MSetAliases(ctx context.Context, canonicalKVs map[string][]byte,
+	aliases map[string]string) error {
+	kvs := make(map[string][]byte, len(canonicalKVs)+len(aliases))
+	for k, v := range canonicalKVs {
+		kvs[k] = v
+	}
+	for alias, key := range aliases {
+		v, ok := canonicalKVs[key]
+		if !ok {
+			return errs.New("alias %s of unknown key %s", alias, key)
+		}
+		kvs[alias] = v
+	}
+	return f.MSet(ctx, kvs)
+}
+
+// MSetTagged .
+func (f *Federation) MSetTagged(ctx context.Context, kvs map[string][]byte, tags map[string][]string) error {
+	return f.eachKVs(kvs, func(cache Cache, kvs map[string][]byte) error {
+		keyTags := make(map[string][]string, len(kvs))
+		for k := range kvs {
+			if t, ok := tags[k]; ok {
+				keyTags[k] = t
+			}
+		}
+		return cache.MSetTagged(ctx, kvs, keyTags)
+	})
+}
+
+// InvalidateTag .
+func (f *Federation) InvalidateTag(ctx context.Context, tag string) error {
+	return f.each(allCaches, func(i int) error {
+		return f.caches[i].InvalidateTag(ctx, tag)
+	})
+}
+
+// BumpVersion .
+func (f *Federation) BumpVersion(ctx context.Context) error {
+	return f.each(allCaches, func(i int) error {
+		return f.caches[i].BumpVersion(ctx)
+	})
+}
+
+// Recompress .
+func (f *Federation) Recompress(ctx context.Context, keys []string) error {
+	return f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.Recompress(ctx, keys)
+	})
+}
+
+// TrimLRU trims each cache to targetSize
+func (f *Federation) TrimLRU(targetSize int64) error {
+	return f.each(allCaches, func(i int) error {
+		return f.caches[i].TrimLRU(targetSize)
+	})
+}
+
+// DumpLRU writes the dump of every cache in order, each prefixed by its length, to be read by LoadLRU of a
+// federation of as many caches
+func (f *Federation) DumpLRU(w io.Writer) error {
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, cache := range f.caches {
+		var buf bytes.Buffer
+		if err := cache.DumpLRU(&buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(buf.Len()))]); err != nil {
+			return errs.Trace(err)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	return nil
+}
+
+// LoadLRU .
+func (f *Federation) LoadLRU(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for _, cache := range f.caches {
+		dump, err := readSnapshotBytes(br)
+		if err != nil {
+			return errs.Trace(noEOF(err))
+		}
+		if err := cache.LoadLRU(bytes.NewReader(dump)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrewarmFromRedis .
+func (f *Federation) PrewarmFromRedis(ctx context.Context, keys []string) error {
+	return f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.PrewarmFromRedis(ctx, keys)
+	})
+}
+
+// Ping .
+func (f *Federation) Ping(ctx context.Context) error {
+	return f.each(allCaches, func(i int) error {
+		return f.caches[i].Ping(ctx)
+	})
+}
+
+// Stats sums stats of all caches
+func (f *Federation) Stats() Stats {
+	var sum Stats
+	for _, cache := range f.caches {
+		stats := cache.Stats()
+		sum.LoaderExtraKeys += stats.LoaderExtraKeys
+		sum.SlowRedisOps += stats.SlowRedisOps
+		sum.Hits += stats.Hits
+		sum.NegativeHits += stats.NegativeHits
+		for i, bucket := range stats.ValueSizes {
+			if i == len(sum.ValueSizes) {
+				sum.ValueSizes = append(sum.ValueSizes, ValueSizeBucket{UpperBound: bucket.UpperBound})
+			}
+			sum.ValueSizes[i].Count += bucket.Count
+		}
+	}
+	return sum
+}
+
+// HotKeys interleaves hot keys of all caches, as hits of different caches are not comparable
+func (f *Federation) HotKeys(n int) []string {
+	tops := make([][]string, len(f.caches))
+	for i, cache := range f.caches {
+		tops[i] = cache.HotKeys(n)
+	}
+
+	var keys []string
+	for rank := 0; len(keys) < n; rank++ {
+		found := false
+		for _, top := range tops {
+			if rank < len(top) && len(keys) < n {
+				keys = append(keys, top[rank])
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return keys
+}
+
+// RegisterRefresh .
+func (f *Federation) RegisterRefresh(keys []string, interval time.Duration) error {
+	return f.eachKeys(keys, func(cache Cache, keys []string) error {
+		return cache.RegisterRefresh(keys, interval)
+	})
+}
+
+// Close .
+func (f *Federation) Close() error {
+	return f.each(allCaches, func(i int) error {
+		return f.caches[i].Close()
+	})
+}
+
+// Name .
+func (f *Federation) Name() string {
+	return f.name
+}
+
+// Options returns options of the first cache only, as a federation has none of its own. other caches may be
+// configured differently, e.g. by Prefix or Loader, which are not reflected.
+func (f *Federation) Options() Options {
+	return f.caches[0].Options()
+}
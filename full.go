@@ -0,0 +1,159 @@
+package levelcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ericuni/errs"
+)
+
+// Source the level a key of MGetFull is resolved by
+type Source int
+
+const (
+	// SourceMiss no level has the key, e.g. not loaded as loader is not configured or failed
+	SourceMiss Source = iota
+	// SourceLRU value from lru cache
+	SourceLRU
+	// SourceRedis value from redis cache
+	SourceRedis
+	// SourceLoader value just loaded by loader
+	SourceLoader
+	// SourceNegative negatively cached, or just missed by loader
+	SourceNegative
+)
+
+// MGetResult result of a key of MGetFull
+type MGetResult struct {
+	Value  []byte
+	Valid  bool // false for expired values
+	Source Source
+	// modify time recorded by the level of Source, lru cache and loader record the time of caching and loading. zero
+	// for SourceMiss and SourceNegative.
+	ModifyTime time.Time
+}
+
+type sourceTraceKey struct{}
+
+// sourceTrace records which level set each value of an mGet, carried by ctx of MGetFull
+type sourceTrace struct {
+	mu     sync.Mutex
+	values map[string]traced
+}
+
+type traced struct {
+	source     Source
+	modifyTime int64
+}
+
+// traceOf returns the sourceTrace of ctx, nil if none
+func traceOf(ctx context.Context) *sourceTrace {
+	if ctx == nil {
+		return nil
+	}
+	trace, _ := ctx.Value(sourceTraceKey{}).(*sourceTrace)
+	return trace
+}
+
+// value records key is set to valuesMap by source, it may be set again by a later level
+func (t *sourceTrace) value(key string, source Source, modifyTime int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.values[key] = traced{source: source, modifyTime: modifyTime}
+	t.mu.Unlock()
+}
+
+// MGetFull .
+func (cache *cacheImpl) MGetFull(ctx context.Context, keys []string) (map[string]MGetResult, error) {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	if err := cache.acquireMGet(ctx); err != nil {
+		return nil, errs.Trace(err)
+	}
+	defer cache.releaseMGet()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	trace := &sourceTrace{values: make(map[string]traced)}
+	ctx = context.WithValue(ctx, sourceTraceKey{}, trace)
+
+	// keys resolved by a level without a value are negative
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	negative := make(map[string]bool)
+	emit := func(keys []string) error {
+		for _, key := range keys {
+			if _, ok := valuesMap[key]; !ok {
+				negative[key] = true
+			}
+		}
+		return nil
+	}
+	err = cache.mGet(ctx, keys, valuesMap, validsMap, emit)
+
+	results := make(map[string]MGetResult, len(keys))
+	for _, key := range keys {
+		value, ok := valuesMap[key]
+		switch {
+		case ok:
+			t := trace.values[key]
+			results[key] = MGetResult{
+				Value:      value,
+				Valid:      validsMap[key],
+				Source:     t.source,
+				ModifyTime: time.Unix(t.modifyTime, 0),
+			}
+		case negative[key]:
+			results[key] = MGetResult{Source: SourceNegative}
+		default:
+			results[key] = MGetResult{Source: SourceMiss}
+		}
+	}
+	return results, err
+}
+
+// Summary counts of keys of MGetWithSummary by the level resolving them
+type Summary struct {
+	LRUHits    int // valid or expired values of lru cache
+	RedisHits  int // valid or soft expired values of redis cache
+	LoaderHits int // values just loaded
+	Misses     int // keys without a value, negatively cached included
+}
+
+// MGetWithSummary .
+func (cache *cacheImpl) MGetWithSummary(ctx context.Context, keys []string) (map[string][]byte, map[string]bool,
+	Summary, error) {
+	var summary Summary
+	results, err := cache.MGetFull(ctx, keys)
+	valuesMap := make(map[string][]byte, len(results))
+	validsMap := make(map[string]bool, len(results))
+	for key, result := range results {
+		switch result.Source {
+		case SourceMiss:
+			summary.Misses++
+			continue
+		case SourceNegative:
+			summary.Misses++
+			if cache.options.ReportNegative {
+				validsMap[key] = false
+			}
+			continue
+		case SourceLRU:
+			summary.LRUHits++
+		case SourceRedis:
+			summary.RedisHits++
+		case SourceLoader:
+			summary.LoaderHits++
+		}
+		valuesMap[key] = result.Value
+		validsMap[key] = result.Valid
+	}
+	return valuesMap, validsMap, summary, err
+}
@@ -0,0 +1,70 @@
+//go:build go1.18
+// +build go1.18
+
+package levelcache_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ericuni/levelcache"
+	"github.com/ericuni/levelcache/levelcachetest"
+	"github.com/golang/protobuf/proto"
+)
+
+// FuzzRedisValue reads arbitrary bytes stored in redis, which must be a miss or a value, never a panic
+func FuzzRedisValue(f *testing.F) {
+	client := levelcachetest.NewRedisClient()
+	options := levelcache.Options{
+		RedisCacheOptions: &levelcache.RedisCacheOptions{
+			ContextClient: client,
+			Prefix:        "levelcache.test.fuzz",
+			HardTimeout:   time.Minute,
+			SoftTimeout:   time.Minute,
+			MissTimeout:   time.Minute,
+		},
+		VerifyLength: true,
+	}
+	ctx := context.Background()
+	key := options.RedisCacheOptions.Prefix + "_k1"
+
+	// seeds are entries as written of every compression type
+	for _, compressionType := range []levelcache.CompressionType{levelcache.CompressionType_None,
+		levelcache.CompressionType_Snappy, levelcache.CompressionType_Zstd} {
+		options.CompressionType = compressionType
+		cache := levelcache.NewCache("levelcache.test.fuzz.seed", &options)
+		// compressible, as incompressible values are stored uncompressed
+		seedValue := bytes.Repeat([]byte("levelcache fuzz seed value "), 4)
+		if err := cache.MSet(ctx, map[string][]byte{"k1": seedValue}); err != nil {
+			f.Fatal(err)
+		}
+		seed, _ := client.Value(key)
+		f.Add(seed)
+	}
+	f.Add([]byte{})
+	// snappy header claiming 4GB
+	corrupt, err := proto.Marshal(&levelcache.Data{CompressionType: levelcache.CompressionType_Snappy,
+		Raw: []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, UncompressedLen: 5, ModifyTime: time.Now().Unix()})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(corrupt)
+
+	options.CompressionType = levelcache.CompressionType_None
+	cache := levelcache.NewCache("levelcache.test.fuzz", &options)
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		if err := client.Set(ctx, []levelcache.RedisEntry{{Key: key, Value: bs}}); err != nil {
+			t.Fatal(err)
+		}
+		values, valids, err := cache.MGet(ctx, []string{"k1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a stale value is returned but not valid
+		if _, ok := values["k1"]; valids["k1"] && !ok {
+			t.Fatal("valid without value")
+		}
+	})
+}
@@ -11,6 +11,7 @@ require (
 	github.com/golang/snappy v0.0.3
 	github.com/karlseguin/ccache v2.0.3+incompatible
 	github.com/karlseguin/expect v1.0.8 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/onsi/ginkgo v1.16.1 // indirect
 	github.com/onsi/gomega v1.11.0 // indirect
 	github.com/stretchr/testify v1.6.1
@@ -0,0 +1,18 @@
+package levelcache
+
+import "hash/fnv"
+
+// fnvHash the default Options.Hasher, 64 bit FNV-1a
+func fnvHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// hasher returns Hasher, or the default if not set
+func (options *Options) hasher() func(key string) uint64 {
+	if options.Hasher != nil {
+		return options.Hasher
+	}
+	return fnvHash
+}
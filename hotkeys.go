@@ -0,0 +1,69 @@
+package levelcache
+
+import (
+	"sort"
+	"sync"
+)
+
+// hotKeys counts lru hits of at most capacity keys. once full, counts are halved and keys counted 0 dropped, so
+// keys hot lately stay while cold ones make room.
+type hotKeys struct {
+	mu       sync.Mutex
+	capacity int
+	counts   map[string]int64
+}
+
+func newHotKeys(capacity int) *hotKeys {
+	return &hotKeys{capacity: capacity, counts: make(map[string]int64)}
+}
+
+func (h *hotKeys) hit(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.counts[key]; !ok && len(h.counts) >= h.capacity {
+		h.decay()
+	}
+	h.counts[key]++
+}
+
+// decay is called with mu held
+func (h *hotKeys) decay() {
+	for key, count := range h.counts {
+		if count /= 2; count == 0 {
+			delete(h.counts, key)
+		} else {
+			h.counts[key] = count
+		}
+	}
+}
+
+// top returns at most n keys of the most hits, ties by key
+func (h *hotKeys) top(n int) []string {
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.counts))
+	counts := make(map[string]int64, len(h.counts))
+	for key, count := range h.counts {
+		keys = append(keys, key)
+		counts[key] = count
+	}
+	h.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if n < len(keys) {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// HotKeys .
+func (cache *cacheImpl) HotKeys(n int) []string {
+	if cache.hotKeys == nil || n <= 0 {
+		return nil
+	}
+	return cache.hotKeys.top(n)
+}
@@ -0,0 +1,74 @@
+package levelcache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// keyspaceChannelPattern matches keyspace notification channels of keys of prefix, in any db
+func keyspaceChannelPattern(prefix string) string {
+	var b strings.Builder
+	b.WriteString("__keyspace@*__:")
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString("*")
+	return b.String()
+}
+
+// startInvalidation subscribes to keyspace notifications of Prefix in the background until Close
+func (cache *cacheImpl) startInvalidation() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cache.invalidationCancel = cancel
+	cache.invalidationWG.Add(1)
+	go cache.invalidationLoop(ctx)
+}
+
+// invalidationLoop evicts lru entries of keys notified, subscribing again a second after the subscription fails
+// or is lost
+func (cache *cacheImpl) invalidationLoop(ctx context.Context) {
+	defer cache.invalidationWG.Done()
+
+	subscriber := cache.redis.(RedisSubscriber)
+	pattern := keyspaceChannelPattern(cache.options.RedisCacheOptions.Prefix)
+	for {
+		messages, err := subscriber.PSubscribe(ctx, pattern)
+		if err != nil {
+			glog.Errorf("%s keyspace subscribe error %+v", cache.name, err)
+		} else {
+			for msg := range messages {
+				cache.invalidate(msg.Channel)
+			}
+		}
+
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// invalidate evicts the lru entry of the key of a keyspace notification channel, whatever the event is. keys of
+// other versions are not in lru cache.
+func (cache *cacheImpl) invalidate(channel string) {
+	i := strings.Index(channel, "__:")
+	if i < 0 {
+		return
+	}
+	suffix, _ := cache.versionSuffix.Load().(string)
+	prefix := cache.options.RedisCacheOptions.Prefix + suffix + "_"
+	key := channel[i+len("__:"):]
+	if !strings.HasPrefix(key, prefix) {
+		return
+	}
+	cache.lruData.Delete(cache.lruKey(context.Background(), key[len(prefix):]))
+}
@@ -0,0 +1,44 @@
+package levelcache
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyLocks striped mutexes, keys of the same stripe share a mutex
+type keyLocks struct {
+	mus  []sync.Mutex
+	hash func(key string) uint64
+}
+
+func newKeyLocks(stripes int, hash func(key string) uint64) *keyLocks {
+	return &keyLocks{mus: make([]sync.Mutex, stripes), hash: hash}
+}
+
+// lock locks stripes of keys in ascending order, so calls locking overlapping keys never deadlock.
+// returns the function to unlock them.
+func (l *keyLocks) lock(keys []string) func() {
+	seen := make(map[int]bool, len(keys))
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripe := l.stripe(key)
+		if !seen[stripe] {
+			seen[stripe] = true
+			stripes = append(stripes, stripe)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, stripe := range stripes {
+		l.mus[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			l.mus[stripes[i]].Unlock()
+		}
+	}
+}
+
+func (l *keyLocks) stripe(key string) int {
+	return int(l.hash(key) % uint64(len(l.mus)))
+}
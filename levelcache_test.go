@@ -3,6 +3,7 @@ package levelcache_test
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/ericuni/levelcache"
@@ -51,3 +52,25 @@ func waitAsyncRedis() {
 	// we could set redis async, so we give it some time
 	time.Sleep(10 * time.Millisecond)
 }
+
+// fakeClock a levelcache.Clock which only moves by Add
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
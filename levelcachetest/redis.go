@@ -0,0 +1,346 @@
+// Package levelcachetest provides helpers to test code using levelcache without a redis server.
+package levelcachetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ericuni/levelcache"
+)
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// RedisClient an in memory levelcache.RedisClient, set as RedisCacheOptions.ContextClient.
+// ttls are by the real clock, except that sets never expire. lua scripts are not supported, so neither are
+// Cache.MSetIfNewer, Cache.Incr, Cache.BumpVersion and Cache.Recompress. keyspace notifications are not sent by
+// commands, but can be published by Publish.
+type RedisClient struct {
+	mu            sync.Mutex
+	entries       map[string]entry
+	sets          map[string]map[string]bool
+	onCommand     func(ctx context.Context)
+	getErrs       map[string]error
+	pingErr       error
+	subscriptions map[*subscription]bool
+}
+
+type subscription struct {
+	ctx      context.Context
+	pattern  string
+	mu       sync.Mutex // held across sends, so messages is not closed during one
+	closed   bool
+	messages chan levelcache.RedisMessage
+}
+
+var (
+	_ levelcache.RedisClient            = (*RedisClient)(nil)
+	_ levelcache.RedisSubscriber        = (*RedisClient)(nil)
+	_ levelcache.RedisConditionalSetter = (*RedisClient)(nil)
+)
+
+// NewRedisClient .
+func NewRedisClient() *RedisClient {
+	return &RedisClient{
+		entries:       make(map[string]entry),
+		sets:          make(map[string]map[string]bool),
+		getErrs:       make(map[string]error),
+		subscriptions: make(map[*subscription]bool),
+	}
+}
+
+// OnCommand sets fn called with the ctx of every command, e.g. to check the ctx is passed through
+func (c *RedisClient) OnCommand(fn func(ctx context.Context)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onCommand = fn
+}
+
+// SetGetError makes Get fail on key with err, nil err to clear it
+func (c *RedisClient) SetGetError(key string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.getErrs, key)
+		return
+	}
+	c.getErrs[key] = err
+}
+
+// SetPingError makes Ping return err
+func (c *RedisClient) SetPingError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pingErr = err
+}
+
+// Value returns the value of key as stored
+func (c *RedisClient) Value(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+// command is called with mu held
+func (c *RedisClient) command(ctx context.Context) {
+	if c.onCommand != nil {
+		c.onCommand(ctx)
+	}
+}
+
+func (c *RedisClient) get(key string) ([]byte, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Get .
+func (c *RedisClient) Get(ctx context.Context, keys []string) ([]levelcache.RedisResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	var firstErr error
+	results := make([]levelcache.RedisResult, len(keys))
+	for i, key := range keys {
+		if err := c.getErrs[key]; err != nil {
+			results[i] = levelcache.RedisResult{Err: err}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		v, ok := c.get(key)
+		results[i] = levelcache.RedisResult{Value: v, Found: ok}
+	}
+	return results, firstErr
+}
+
+// Set .
+func (c *RedisClient) Set(ctx context.Context, entries []levelcache.RedisEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	for _, e := range entries {
+		var expires time.Time
+		if e.TTL > 0 {
+			expires = time.Now().Add(e.TTL)
+		}
+		c.entries[e.Key] = entry{value: append([]byte{}, e.Value...), expires: expires}
+	}
+	return nil
+}
+
+// SetNX .
+func (c *RedisClient) SetNX(ctx context.Context, entries []levelcache.RedisEntry) ([]bool, error) {
+	return c.setIf(ctx, entries, false), nil
+}
+
+// SetXX .
+func (c *RedisClient) SetXX(ctx context.Context, entries []levelcache.RedisEntry) ([]bool, error) {
+	return c.setIf(ctx, entries, true), nil
+}
+
+func (c *RedisClient) setIf(ctx context.Context, entries []levelcache.RedisEntry, exist bool) []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	written := make([]bool, len(entries))
+	for i, e := range entries {
+		if _, ok := c.get(e.Key); ok != exist {
+			continue
+		}
+		var expires time.Time
+		if e.TTL > 0 {
+			expires = time.Now().Add(e.TTL)
+		}
+		c.entries[e.Key] = entry{value: append([]byte{}, e.Value...), expires: expires}
+		written[i] = true
+	}
+	return written
+}
+
+// Del .
+func (c *RedisClient) Del(ctx context.Context, keys []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	for _, key := range keys {
+		delete(c.entries, key)
+		delete(c.sets, key)
+	}
+	return nil
+}
+
+// Exists .
+func (c *RedisClient) Exists(ctx context.Context, keys []string) ([]bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		_, exists[i] = c.get(key)
+	}
+	return exists, nil
+}
+
+// PTTL .
+func (c *RedisClient) PTTL(ctx context.Context, keys []string) ([]time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	ttls := make([]time.Duration, len(keys))
+	for i, key := range keys {
+		if _, ok := c.get(key); ok && !c.entries[key].expires.IsZero() {
+			ttls[i] = time.Until(c.entries[key].expires)
+		}
+	}
+	return ttls, nil
+}
+
+// PExpire .
+func (c *RedisClient) PExpire(ctx context.Context, keys []string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	for _, key := range keys {
+		if _, ok := c.get(key); ok {
+			e := c.entries[key]
+			e.expires = time.Now().Add(ttl)
+			c.entries[key] = e
+		}
+	}
+	return nil
+}
+
+// SAdd .
+func (c *RedisClient) SAdd(ctx context.Context, sets map[string][]string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	for key, members := range sets {
+		if c.sets[key] == nil {
+			c.sets[key] = make(map[string]bool)
+		}
+		for _, member := range members {
+			c.sets[key][member] = true
+		}
+	}
+	return nil
+}
+
+// SPopAll .
+func (c *RedisClient) SPopAll(ctx context.Context, key string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	var members []string
+	for member := range c.sets[key] {
+		members = append(members, member)
+	}
+	delete(c.sets, key)
+	return members, nil
+}
+
+// Ping .
+func (c *RedisClient) Ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+	return c.pingErr
+}
+
+// Eval .
+func (c *RedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{},
+	error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+	return nil, errors.New("eval not supported")
+}
+
+// PSubscribe supports patterns of * wildcards and \ escapes only
+func (c *RedisClient) PSubscribe(ctx context.Context, pattern string) (<-chan levelcache.RedisMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.command(ctx)
+
+	sub := &subscription{ctx: ctx, pattern: pattern, messages: make(chan levelcache.RedisMessage)}
+	c.subscriptions[sub] = true
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.subscriptions, sub)
+		c.mu.Unlock()
+
+		sub.mu.Lock()
+		sub.closed = true
+		close(sub.messages)
+		sub.mu.Unlock()
+	}()
+	return sub.messages, nil
+}
+
+// Publish delivers payload to subscriptions matching channel, returns once they have all received it
+func (c *RedisClient) Publish(channel, payload string) {
+	c.mu.Lock()
+	var subs []*subscription
+	for sub := range c.subscriptions {
+		if matchGlob(sub.pattern, channel) {
+			subs = append(subs, sub)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.mu.Lock()
+		if !sub.closed {
+			select {
+			case sub.messages <- levelcache.RedisMessage{Channel: channel, Payload: payload}:
+			case <-sub.ctx.Done():
+			}
+		}
+		sub.mu.Unlock()
+	}
+}
+
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if len(s) == 0 || s[0] != pattern[0] {
+			return false
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,208 @@
+package levelcache
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+// lfuAgingPeriod accesses per cached item between halvings of all hits
+const lfuAgingPeriod = 10
+
+// lfuCache localCache evicting the least frequently used items, the least recently used of them first. hits are
+// counted by Get of unexpired items while they are cached, an item set again keeps its hits. hits are halved every
+// lfuAgingPeriod accesses per item, so items hot once, expired ones included, are evicted in the end. Set evicts
+// right away rather than in a goroutine, never the item it sets. unlike ccache, Clear calls onDelete too.
+type lfuCache struct {
+	maxSize  int64
+	onDelete func(item localItem)
+
+	mu       sync.Mutex
+	items    map[string]*lfuItem
+	heap     lfuHeap
+	size     int64
+	tick     uint64 // counts accesses, orders items of equal hits
+	accesses uint64 // since hits were halved
+}
+
+type lfuItem struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires int64 // unix nano, accessed atomically
+	hits    uint64
+	used    uint64 // tick of the last access
+	index   int    // in heap
+}
+
+func newLFUCache(maxSize int64, onDelete func(item localItem)) *lfuCache {
+	return &lfuCache{
+		maxSize:  maxSize,
+		onDelete: onDelete,
+		items:    make(map[string]*lfuItem),
+	}
+}
+
+func (c *lfuCache) Get(key string) localItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	if !item.Expired() {
+		c.tick++
+		item.hits++
+		item.used = c.tick
+		heap.Fix(&c.heap, item.index)
+		c.age()
+	}
+	return item
+}
+
+func (c *lfuCache) Set(key string, value interface{}, duration time.Duration) {
+	item := &lfuItem{
+		key:     key,
+		value:   value,
+		size:    1,
+		expires: time.Now().Add(duration).UnixNano(),
+	}
+	if sized, ok := value.(ccache.Sized); ok {
+		item.size = sized.Size()
+	}
+
+	c.mu.Lock()
+	c.tick++
+	item.used = c.tick
+	var deleted []localItem
+	if old, ok := c.items[key]; ok {
+		item.hits = old.hits
+		heap.Remove(&c.heap, old.index)
+		c.size -= old.size
+		deleted = append(deleted, old)
+	}
+	for c.size+item.size > c.maxSize && len(c.heap) > 0 {
+		victim := heap.Pop(&c.heap).(*lfuItem)
+		delete(c.items, victim.key)
+		c.size -= victim.size
+		deleted = append(deleted, victim)
+	}
+	c.items[key] = item
+	heap.Push(&c.heap, item)
+	c.size += item.size
+	c.age()
+	c.mu.Unlock()
+
+	c.deleted(deleted)
+}
+
+func (c *lfuCache) Delete(key string) bool {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if ok {
+		delete(c.items, key)
+		heap.Remove(&c.heap, item.index)
+		c.size -= item.size
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.deleted([]localItem{item})
+	}
+	return ok
+}
+
+func (c *lfuCache) Clear() {
+	c.mu.Lock()
+	deleted := make([]localItem, 0, len(c.heap))
+	for _, item := range c.heap {
+		deleted = append(deleted, item)
+	}
+	c.items = make(map[string]*lfuItem)
+	c.heap = nil
+	c.size = 0
+	c.accesses = 0
+	c.mu.Unlock()
+
+	c.deleted(deleted)
+}
+
+// age counts an access and halves hits once there are lfuAgingPeriod per item since the last time. mu is held.
+func (c *lfuCache) age() {
+	c.accesses++
+	if c.accesses < lfuAgingPeriod*uint64(len(c.items)) {
+		return
+	}
+	c.accesses = 0
+	for _, item := range c.heap {
+		item.hits /= 2
+	}
+	heap.Init(&c.heap)
+}
+
+// deleted calls onDelete without the lock held
+func (c *lfuCache) deleted(items []localItem) {
+	if c.onDelete == nil {
+		return
+	}
+	for _, item := range items {
+		c.onDelete(item)
+	}
+}
+
+func (i *lfuItem) Value() interface{} {
+	return i.value
+}
+
+func (i *lfuItem) Expired() bool {
+	return atomic.LoadInt64(&i.expires) < time.Now().UnixNano()
+}
+
+func (i *lfuItem) Expires() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&i.expires))
+}
+
+func (i *lfuItem) TTL() time.Duration {
+	return time.Until(i.Expires())
+}
+
+func (i *lfuItem) Extend(duration time.Duration) {
+	atomic.StoreInt64(&i.expires, time.Now().Add(duration).UnixNano())
+}
+
+// lfuHeap min heap of items by hits and then last access
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].used < h[j].used
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,316 @@
+package levelcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+)
+
+// ErrLoaderResultTooLarge returned by MGet if a loader returns more than Options.LoaderMaxResultKeys keys
+var ErrLoaderResultTooLarge = errors.New("loader result too large")
+
+// LoaderFunc loads values of keys from the data source, keys not in the returned map are treated as misses
+type LoaderFunc = func(ctx context.Context, keys []string) (map[string][]byte, error)
+
+// TTLLoaderFunc LoaderFunc returning values with their own lifetimes
+type TTLLoaderFunc = func(ctx context.Context, keys []string) (map[string]LoadedValue, error)
+
+// LoadedValue a value loaded with its lifetime at the data source
+type LoadedValue struct {
+	Value []byte
+	// if positive, the soft timeout of the value like MetaEntry.SoftTimeout, otherwise the configured timeouts apply
+	TTL time.Duration
+}
+
+// LoaderKeysError returned(maybe wrapped) by a loader failing only Keys, e.g. one of the chunks it splits keys into.
+// the other keys requested are cached as loaded or missed, and the error is still returned by MGet.
+type LoaderKeysError struct {
+	Keys []string
+	Err  error
+}
+
+func (e *LoaderKeysError) Error() string {
+	return fmt.Sprintf("loader failed %d keys: %v", len(e.Keys), e.Err)
+}
+
+// Unwrap .
+func (e *LoaderKeysError) Unwrap() error {
+	return e.Err
+}
+
+// succeededKeys returns keys and their values not failed by a LoaderKeysError err, false for other errors
+func succeededKeys(err error, keys []string, values map[string][]byte) ([]string, map[string][]byte, bool) {
+	var keysErr *LoaderKeysError
+	if !errors.As(err, &keysErr) {
+		return nil, nil, false
+	}
+
+	failed := make(map[string]bool, len(keysErr.Keys))
+	for _, key := range keysErr.Keys {
+		failed[key] = true
+	}
+	succeeded := make([]string, 0, len(keys))
+	succeededValues := make(map[string][]byte, len(values))
+	for _, key := range keys {
+		if failed[key] {
+			continue
+		}
+		succeeded = append(succeeded, key)
+		if v, ok := values[key]; ok {
+			succeededValues[key] = v
+		}
+	}
+	return succeeded, succeededValues, true
+}
+
+// hasLoader reports whether Loader or TTLLoader is configured
+func (cache *cacheImpl) hasLoader() bool {
+	return cache.options.Loader != nil || cache.options.TTLLoader != nil
+}
+
+// load loads keys with Loader or TTLLoader, keys it fails or misses are retried with FallbackLoader if configured.
+// ttls are of values loaded by TTLLoader with a positive TTL.
+func (cache *cacheImpl) load(ctx context.Context, keys []string) (map[string][]byte, map[string]time.Duration,
+	error) {
+	loader := cache.options.Loader
+	var ttls map[string]time.Duration
+	if ttlLoader := cache.options.TTLLoader; ttlLoader != nil {
+		loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			loaded, err := ttlLoader(ctx, keys)
+			if loaded == nil {
+				return nil, err
+			}
+			values := make(map[string][]byte, len(loaded))
+			for k, v := range loaded {
+				values[k] = v.Value
+				if v.TTL > 0 {
+					if ttls == nil {
+						ttls = make(map[string]time.Duration)
+					}
+					ttls[k] = v.TTL
+				}
+			}
+			return values, err
+		}
+	}
+
+	values, err := cache.callPartitioned(ctx, loader, keys)
+	if cache.options.FallbackLoader == nil {
+		return values, ttls, err
+	}
+
+	if err != nil {
+		glog.Errorf("%s loader error, try fallback loader %+v", cache.name, err)
+	}
+
+	var missKeys []string
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			missKeys = append(missKeys, key)
+		}
+	}
+	if len(missKeys) == 0 {
+		return values, ttls, nil
+	}
+
+	fallbackValues, err := cache.callPartitioned(ctx, cache.options.FallbackLoader, missKeys)
+	if len(fallbackValues) > 0 && values == nil {
+		values = make(map[string][]byte, len(fallbackValues))
+	}
+	for k, v := range fallbackValues {
+		values[k] = v
+	}
+	if err != nil {
+		return values, ttls, errs.Trace(err)
+	}
+	return values, ttls, nil
+}
+
+// mSetLoaded sets loaded values filtered by OnLoaded, those with ttls are set with them as soft timeouts
+func (cache *cacheImpl) mSetLoaded(ctx context.Context, kvs map[string][]byte, ttls map[string]time.Duration,
+	missKeys []string) error {
+	if onLoaded := cache.options.OnLoaded; onLoaded != nil {
+		kvs, missKeys = onLoaded(ctx, kvs, missKeys)
+	}
+	if options := cache.options.RedisCacheOptions; options != nil && options.SkipRedisWrite {
+		cache.mSetLoadedLRU(ctx, kvs, ttls, missKeys)
+		return nil
+	}
+	if len(ttls) == 0 {
+		return cache.mSet(ctx, kvs, missKeys)
+	}
+
+	rest := make(map[string][]byte, len(kvs))
+	entries := make(map[string]MetaEntry, len(ttls))
+	for k, v := range kvs {
+		if ttl, ok := ttls[k]; ok {
+			entries[k] = MetaEntry{Value: v, SoftTimeout: ttl}
+		} else {
+			rest[k] = v
+		}
+	}
+	err := cache.mSet(ctx, rest, missKeys)
+	if err := cache.mSetMeta(ctx, entries); err != nil {
+		return errs.Trace(err)
+	}
+	return errs.Trace(err)
+}
+
+// mSetLoadedLRU is mSetLoaded of lru cache only
+func (cache *cacheImpl) mSetLoadedLRU(ctx context.Context, kvs map[string][]byte, ttls map[string]time.Duration,
+	missKeys []string) {
+	cache.stats.recordValueSizes(kvs)
+	rest := kvs
+	if len(ttls) > 0 {
+		rest = make(map[string][]byte, len(kvs))
+		for k, v := range kvs {
+			if ttl, ok := ttls[k]; ok {
+				cache.setLRUMeta(ctx, k, MetaEntry{Value: v, SoftTimeout: ttl})
+			} else {
+				rest[k] = v
+			}
+		}
+	}
+	cache.mSetLRUCache(ctx, rest, missKeys)
+}
+
+// callPartitioned calls loader with keys of each partition by LoaderPartitioner one after another, keys of failed
+// partitions are reported by a LoaderKeysError, so the others are still cached
+func (cache *cacheImpl) callPartitioned(ctx context.Context, loader LoaderFunc, keys []string) (map[string][]byte,
+	error) {
+	partitioner := cache.options.LoaderPartitioner
+	if partitioner == nil {
+		return cache.retryLoader(ctx, loader, keys)
+	}
+
+	// partitions in the order of their first keys
+	var partitions []string
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		partition := partitioner(key)
+		if _, ok := groups[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		groups[partition] = append(groups[partition], key)
+	}
+	if len(partitions) <= 1 {
+		return cache.retryLoader(ctx, loader, keys)
+	}
+
+	values := make(map[string][]byte, len(keys))
+	var failedKeys []string
+	var firstErr error
+	failed := 0
+	for _, partition := range partitions {
+		group := groups[partition]
+		groupValues, err := cache.retryLoader(ctx, loader, group)
+		for k, v := range groupValues {
+			values[k] = v
+		}
+		if err == nil {
+			continue
+		}
+
+		glog.Errorf("%s loader partition %s error %+v", cache.name, partition, err)
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+		var keysErr *LoaderKeysError
+		if errors.As(err, &keysErr) {
+			failedKeys = append(failedKeys, keysErr.Keys...)
+		} else {
+			failedKeys = append(failedKeys, group...)
+		}
+	}
+	if firstErr == nil {
+		return values, nil
+	}
+	return values, &LoaderKeysError{
+		Keys: failedKeys,
+		Err:  errs.Tracef(firstErr, "%d of %d loader partitions failed", failed, len(partitions)),
+	}
+}
+
+// retryLoader calls loader, again after a backoff on a retryable error if LoaderRetry is set
+func (cache *cacheImpl) retryLoader(ctx context.Context, loader LoaderFunc, keys []string) (map[string][]byte, error) {
+	retry := cache.options.LoaderRetry
+	if retry == nil {
+		return cache.callLoader(ctx, loader, keys)
+	}
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	for attempt := 1; ; attempt++ {
+		values, err := cache.callLoader(ctx, loader, keys)
+		if err == nil || attempt >= retry.MaxAttempts || !retry.IsRetryable(err) {
+			return values, err
+		}
+
+		backoff := jitter(retry.BaseBackoff<<(attempt-1), retry.Jitter)
+		glog.Warningf("%s loader attempt %d error, retry in %v %+v", cache.name, attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return values, err
+		}
+	}
+}
+
+// callLoader calls loader, converting a loader panic into an error unless DisableLoaderRecover is set
+func (cache *cacheImpl) callLoader(ctx context.Context, loader LoaderFunc, keys []string) (values map[string][]byte,
+	err error) {
+	if !cache.options.DisableLoaderRecover {
+		defer func() {
+			if r := recover(); r != nil {
+				values = nil
+				err = errs.New("%s loader panic: %v\n%s", cache.name, r, debug.Stack())
+			}
+		}()
+	}
+	values, err = loader(ctx, keys)
+	if maxKeys := cache.options.LoaderMaxResultKeys; maxKeys > 0 && len(values) > maxKeys {
+		glog.Errorf("%s loader returned %d keys for %d requested, over %d", cache.name, len(values), len(keys), maxKeys)
+		if !cache.options.TruncateLoaderResult {
+			return nil, errs.Tracef(ErrLoaderResultTooLarge, "%d keys", len(values))
+		}
+	}
+	return cache.dropExtraKeys(keys, values), err
+}
+
+// dropExtraKeys removes values of keys not requested, so a buggy loader does not fill the cache with them
+func (cache *cacheImpl) dropExtraKeys(keys []string, values map[string][]byte) map[string][]byte {
+	if len(values) == 0 {
+		return values
+	}
+
+	requested := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		requested[key] = true
+	}
+	var extraKeys []string
+	for key := range values {
+		if !requested[key] {
+			extraKeys = append(extraKeys, key)
+		}
+	}
+	if len(extraKeys) == 0 {
+		return values
+	}
+
+	glog.Errorf("%s loader returned %d keys not requested, e.g. %s", cache.name, len(extraKeys), extraKeys[0])
+	cache.stats.recordLoaderExtraKeys(len(extraKeys))
+	for _, key := range extraKeys {
+		delete(values, key)
+	}
+	return values
+}
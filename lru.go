@@ -0,0 +1,343 @@
+package levelcache
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+// rough memory of an lru item besides key and value, for byte size based eviction
+const lruItemOverhead = 128
+
+// stripes of keys serializing sets and deletes of entries tracked
+const lruKeyStripes = 256
+
+// localItem an item of a localCache, *ccache.Item for ccache based ones
+type localItem interface {
+	Value() interface{}
+	Expired() bool
+	Expires() time.Time
+	TTL() time.Duration
+	Extend(duration time.Duration)
+}
+
+// localCache a shard of lru cache, evicting by LRUCacheOptions.EvictionPolicy. values implementing ccache.Sized
+// count as that size, others as 1.
+type localCache interface {
+	Get(key string) localItem // may return an expired item, nil if not found
+	Set(key string, value interface{}, duration time.Duration)
+	Delete(key string) bool
+	Clear() // not thread safe
+}
+
+// ccacheLocal localCache of ccache, which evicts least recently used items, or earliest set ones if items are
+// never promoted
+type ccacheLocal struct {
+	*ccache.Cache
+}
+
+func (c ccacheLocal) Get(key string) localItem {
+	if item := c.Cache.Get(key); item != nil {
+		return item
+	}
+	return nil
+}
+
+// newLocalCache returns a shard of size evicting by policy, onDelete is called with items evicted, deleted or
+// replaced if not nil
+func newLocalCache(policy LRUPolicy, size int64, sized bool, onDelete func(item localItem)) localCache {
+	if policy == LRUPolicyLFU {
+		return newLFUCache(size, onDelete)
+	}
+
+	config := ccache.Configure().MaxSize(size)
+	if !sized {
+		config = config.ItemsToPrune(itemsToPrune(size))
+	}
+	if onDelete != nil {
+		config = config.OnDelete(func(item *ccache.Item) {
+			onDelete(item)
+		})
+	}
+	if policy == LRUPolicyFIFO {
+		config = config.GetsPerPromote(math.MaxInt32)
+	}
+	return ccacheLocal{ccache.New(config)}
+}
+
+// lruCache local lru cache, keys are routed to one of the shards by hash
+type lruCache struct {
+	shards    []localCache // allocated by allocate
+	n         int          // of shards
+	shardSize int64
+	policy    LRUPolicy
+	allocOnce sync.Once
+	hash      func(key string) uint64
+	sized     bool // ccache size of items is bytes instead of 1
+
+	onGC func(dropped int)
+
+	// current entries of keys if trimmable or onGC is set, as ccache neither lists its items nor shrinks on demand,
+	// and reports deleted and replaced items the same way as gc evicted ones. keyMus serialize Set and Delete of a
+	// key, so the entry replaced is the one marked removed.
+	trimmable bool
+	keyMus    *keyLocks
+	entriesMu sync.Mutex
+	entries   map[string]*lruEntry
+}
+
+func newLRUCache(options *LRUCacheOptions, hash func(key string) uint64) *lruCache {
+	n := options.LRUShards
+	if n <= 1 {
+		n = 1
+	}
+
+	// aggregate size is divided across shards
+	size := options.Size
+	if options.LRUMaxBytes > 0 {
+		size = options.LRUMaxBytes
+	}
+	size = (size + int64(n) - 1) / int64(n)
+	c := &lruCache{
+		n:         n,
+		shardSize: size,
+		policy:    options.EvictionPolicy,
+		hash:      hash,
+		sized:     options.LRUMaxBytes > 0,
+		onGC:      options.OnGC,
+		trimmable: options.Trimmable,
+	}
+	if c.tracking() {
+		c.keyMus = newKeyLocks(lruKeyStripes, hash)
+		c.entries = make(map[string]*lruEntry)
+	}
+	if !options.LazyInit {
+		c.allocate()
+	}
+	return c
+}
+
+// allocate creates the shards once, ccache based ones run a gc goroutine each
+func (c *lruCache) allocate() {
+	c.allocOnce.Do(func() {
+		var onDelete func(item localItem)
+		if c.tracking() {
+			onDelete = c.onDelete
+		}
+		shards := make([]localCache, c.n)
+		for i := range shards {
+			shards[i] = newLocalCache(c.policy, c.shardSize, c.sized, onDelete)
+		}
+		c.shards = shards
+	})
+}
+
+// itemsToPrune returns items ccache's gc evicts at once for a shard of size items.
+// ccache prunes 500 items by default once it is over size, which empties a small cache, the item just set
+// included, so gc prunes a tenth of the size instead. bytes sized shards keep the default.
+func itemsToPrune(size int64) uint32 {
+	n := size / 10
+	if n < 1 {
+		return 1
+	}
+	if n > 500 {
+		return 500
+	}
+	return uint32(n)
+}
+
+func (c *lruCache) shard(key string) localCache {
+	c.allocate()
+	return c.shards[c.shardIndex(key)]
+}
+
+func (c *lruCache) shardIndex(key string) int {
+	if c.n == 1 {
+		return 0
+	}
+	return int(c.hash(key) % uint64(c.n))
+}
+
+// Get may return an expired item, nil if not found
+func (c *lruCache) Get(key string) localItem {
+	item := c.shard(key).Get(key)
+	if c.trimmable && item != nil {
+		if entry, ok := item.Value().(*lruEntry); ok {
+			atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+		}
+	}
+	return item
+}
+
+func (c *lruCache) Set(key string, value interface{}, duration time.Duration) {
+	shard := c.shard(key)
+	if !c.sized && !c.tracking() {
+		shard.Set(key, value, duration)
+		return
+	}
+
+	entry := &lruEntry{value: value, size: 1, key: key, lastUsed: time.Now().UnixNano()}
+	if c.sized {
+		entry.size = int64(len(key)+lruValueSize(value)) + lruItemOverhead
+	}
+	if !c.tracking() {
+		shard.Set(key, entry, duration)
+		return
+	}
+
+	mu := &c.keyMus.mus[c.keyMus.stripe(key)]
+	mu.Lock()
+	defer mu.Unlock()
+	c.entriesMu.Lock()
+	c.markRemoved(key)
+	c.entries[key] = entry
+	c.entriesMu.Unlock()
+	shard.Set(key, entry, duration)
+}
+
+func (c *lruCache) Delete(key string) bool {
+	shard := c.shard(key)
+	if !c.tracking() {
+		return shard.Delete(key)
+	}
+
+	mu := &c.keyMus.mus[c.keyMus.stripe(key)]
+	mu.Lock()
+	defer mu.Unlock()
+	c.entriesMu.Lock()
+	c.markRemoved(key)
+	// ccache calls onDelete later in its worker goroutine
+	delete(c.entries, key)
+	c.entriesMu.Unlock()
+	return shard.Delete(key)
+}
+
+// Clear is not thread safe
+func (c *lruCache) Clear() {
+	c.allocate()
+	if c.tracking() {
+		// shards calling onDelete on Clear do not report gc evictions
+		c.entriesMu.Lock()
+		for key := range c.entries {
+			c.markRemoved(key)
+		}
+		c.entriesMu.Unlock()
+	}
+	for _, shard := range c.shards {
+		shard.Clear()
+	}
+	if c.tracking() {
+		c.entriesMu.Lock()
+		c.entries = make(map[string]*lruEntry)
+		c.entriesMu.Unlock()
+	}
+}
+
+// Trim deletes least recently used entries until their total size, items or bytes as the lru is sized, is at most
+// target
+func (c *lruCache) Trim(target int64) {
+	c.entriesMu.Lock()
+	entries := make([]*lruEntry, 0, len(c.entries))
+	var total int64
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+		total += entry.size
+	}
+	c.entriesMu.Unlock()
+	if total <= target {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return atomic.LoadInt64(&entries[i].lastUsed) < atomic.LoadInt64(&entries[j].lastUsed)
+	})
+	for _, entry := range entries {
+		if total <= target {
+			break
+		}
+		c.Delete(entry.key)
+		total -= entry.size
+	}
+}
+
+// Keys returns keys of current entries if trimmable
+func (c *lruCache) Keys() []string {
+	c.entriesMu.Lock()
+	defer c.entriesMu.Unlock()
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Peek gets key without updating its last use for Trim, nil if not found
+func (c *lruCache) Peek(key string) localItem {
+	return c.shard(key).Get(key)
+}
+
+// tracking reports whether entries are tracked
+func (c *lruCache) tracking() bool {
+	return c.trimmable || c.onGC != nil
+}
+
+// markRemoved marks the current entry of key deleted or replaced by us, so it is not reported as a gc eviction.
+// entriesMu is held.
+func (c *lruCache) markRemoved(key string) {
+	if entry := c.entries[key]; entry != nil {
+		atomic.StoreInt32(&entry.removed, 1)
+	}
+}
+
+// onDelete is called from ccache's worker goroutine, or by the shard's caller for other policies
+func (c *lruCache) onDelete(item localItem) {
+	entry, ok := item.Value().(*lruEntry)
+	if !ok {
+		return
+	}
+	// the key may have been set again
+	c.entriesMu.Lock()
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+	c.entriesMu.Unlock()
+
+	if atomic.LoadInt32(&entry.removed) == 0 && c.onGC != nil {
+		c.onGC(1)
+	}
+}
+
+// lruEntry wraps values if the lru is sized by bytes or entries are tracked
+type lruEntry struct {
+	value    interface{}
+	size     int64 // bytes if sized, otherwise 1
+	key      string
+	lastUsed int64 // unix nano of the last Set or Get
+	removed  int32 // set once deleted or replaced by us
+}
+
+// Size implements ccache.Sized
+func (e *lruEntry) Size() int64 {
+	return e.size
+}
+
+// lruValue returns the value set by lruCache.Set
+func lruValue(item localItem) interface{} {
+	if e, ok := item.Value().(*lruEntry); ok {
+		return e.value
+	}
+	return item.Value()
+}
+
+func lruValueSize(value interface{}) int {
+	switch v := value.(type) {
+	case *Data:
+		return len(v.Raw)
+	default:
+		return 0
+	}
+}
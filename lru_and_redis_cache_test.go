@@ -1,7 +1,11 @@
 package levelcache_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -217,7 +221,1126 @@ func (s *LRUAndRedisCacheSuite) TestCompression() {
 	assert.Empty(s.loaderRequestKeys)
 }
 
+func (s *LRUAndRedisCacheSuite) TestRedisOnlyNegativeCache() {
+	assert := s.Assert()
+	t := s.T()
+
+	options := s.options
+	options.LRUCacheOptions.MissTimeout = 0
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.redis_only_negative_cache", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	key := s.keys[0]
+	redisKey := options.RedisCacheOptions.Prefix + "_" + key
+
+	t.Run("loader miss", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+	})
+
+	t.Run("redis negative cached", func(t *testing.T) {
+		v, err := s.client.Get(redisKey).Result()
+		assert.Nil(err)
+		assert.Equal("", v)
+
+		s.loaderRequestKeys = nil
+		_, _, err = s.get(key)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+	})
+
+	t.Run("lru not negative cached", func(t *testing.T) {
+		assert.Nil(s.client.Del(redisKey).Err())
+
+		s.loaderRequestKeys = nil
+		_, _, err := s.get(key)
+		assert.Nil(err)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestTombstoneOnDel() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.TombstoneOnDel = true
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.tombstone", &options)
+
+	// another instance reading the same redis
+	otherOptions := options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.tombstone.other", &otherOptions)
+
+	key := s.keys[0]
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v1")}))
+	values, _, err := other.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("v1", string(values[key]))
+
+	assert.Nil(cache.MDel(s.ctx, []string{key}))
+	s.loaderRequestKeys = nil
+	values, valids, negative, err := other.MGetDetailed(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(values)
+	assert.Empty(valids)
+	assert.True(negative[key])
+	assert.Empty(s.loaderRequestKeys)
+
+	// loaded again once the tombstone expires
+	time.Sleep(redisOptions.MissTimeout + 10*time.Millisecond)
+	_, _, err = other.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+}
+
+func (s *LRUAndRedisCacheSuite) TestMSetOverMiss() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := s.keys[0]
+	for _, async := range []bool{false, true} {
+		options := *s.options
+		redisOptions := *options.RedisCacheOptions
+		redisOptions.AsyncWrite = async
+		options.RedisCacheOptions = &redisOptions
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis.mset_over_miss", &options)
+
+		t.Run(fmt.Sprintf("async %v", async), func(t *testing.T) {
+			defer cache.MDel(s.ctx, []string{key})
+
+			values, _, negative, err := cache.MGetDetailed(s.ctx, []string{key})
+			assert.Nil(err)
+			assert.Empty(values)
+			assert.True(negative[key])
+
+			assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+			waitAsyncRedis()
+			s.loaderRequestKeys = nil
+			values, valids, err := cache.MGet(s.ctx, []string{key})
+			assert.Nil(err)
+			assert.Empty(s.loaderRequestKeys)
+			assert.Equal("v", string(values[key]))
+			assert.True(valids[key])
+
+			// redis holds the value as well
+			otherOptions := options
+			otherOptions.LRUCacheOptions = nil
+			other := levelcache.NewCache("levelcache.test.lru_and_redis.mset_over_miss.other", &otherOptions)
+			values, valids, err = other.MGet(s.ctx, []string{key})
+			assert.Nil(err)
+			assert.Empty(s.loaderRequestKeys)
+			assert.Equal("v", string(values[key]))
+			assert.True(valids[key])
+		})
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestMGetWithSummary() {
+	assert := s.Assert()
+
+	keys := []string{"k1", "k2", "k3", "k4"}
+	defer s.cache.MDel(s.ctx, keys)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{"k3": []byte("v3")}, nil
+	})
+	defer patches.Reset()
+
+	// k1 is in lru cache, k2 in redis only
+	otherOptions := *s.options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.summary.other", &otherOptions)
+	assert.Nil(other.MSet(s.ctx, map[string][]byte{"k2": []byte("v2")}))
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+
+	values, valids, summary, err := s.cache.MGetWithSummary(s.ctx, keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}, convert(values))
+	assert.Equal(map[string]bool{"k1": true, "k2": true, "k3": true}, valids)
+	assert.Equal(levelcache.Summary{LRUHits: 1, RedisHits: 1, LoaderHits: 1, Misses: 1}, summary)
+
+	// all cached now, k4 negatively. lru cache of size 3 may have evicted some to redis cache.
+	s.loaderRequestKeys = nil
+	_, _, summary, err = s.cache.MGetWithSummary(s.ctx, keys)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(3, summary.LRUHits+summary.RedisHits)
+	assert.Equal(0, summary.LoaderHits)
+	assert.Equal(1, summary.Misses)
+}
+
+func (s *LRUAndRedisCacheSuite) TestMGetFull() {
+	assert := s.Assert()
+	t := s.T()
+
+	keys := []string{"k1", "k2", "k3", "k4"}
+	defer s.cache.MDel(s.ctx, keys)
+
+	loaderErr := error(nil)
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{"k3": []byte("v3")}, loaderErr
+	})
+	defer patches.Reset()
+
+	// k2 is written by another instance, so it is in redis only
+	otherOptions := *s.options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.full.other", &otherOptions)
+	modifyTime := time.Unix(time.Now().Add(-time.Second).Unix(), 0)
+	assert.Nil(other.MSetWithMeta(s.ctx, map[string]levelcache.MetaEntry{
+		"k2": {Value: []byte("v2"), ModifyTime: modifyTime},
+	}))
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+
+	t.Run("mixed", func(t *testing.T) {
+		start := time.Now().Unix()
+		results, err := s.cache.MGetFull(s.ctx, keys)
+		assert.Nil(err)
+		assert.Len(results, 4)
+
+		assert.Equal("v1", string(results["k1"].Value))
+		assert.True(results["k1"].Valid)
+		assert.Equal(levelcache.SourceLRU, results["k1"].Source)
+		assert.True(results["k1"].ModifyTime.Unix() >= start-1)
+
+		assert.Equal("v2", string(results["k2"].Value))
+		assert.True(results["k2"].Valid)
+		assert.Equal(levelcache.SourceRedis, results["k2"].Source)
+		assert.Equal(modifyTime, results["k2"].ModifyTime)
+
+		assert.Equal("v3", string(results["k3"].Value))
+		assert.True(results["k3"].Valid)
+		assert.Equal(levelcache.SourceLoader, results["k3"].Source)
+		assert.True(results["k3"].ModifyTime.Unix() >= start)
+
+		assert.Equal(levelcache.MGetResult{Source: levelcache.SourceNegative}, results["k4"])
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		results, err := s.cache.MGetFull(s.ctx, keys)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal(levelcache.SourceLRU, results["k2"].Source)
+		assert.Equal(levelcache.SourceLRU, results["k3"].Source)
+		assert.Equal(levelcache.SourceNegative, results["k4"].Source)
+	})
+
+	t.Run("loader error", func(t *testing.T) {
+		loaderErr = errors.New("loader error")
+		results, err := s.cache.MGetFull(s.ctx, []string{"k5"})
+		assert.NotNil(err)
+		assert.Equal(map[string]levelcache.MGetResult{"k5": {Source: levelcache.SourceMiss}}, results)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestMSetNX() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+	assert.Nil(s.cache.MSetNX(s.ctx, map[string][]byte{k1: []byte("nx1"), k2: []byte("nx2")}))
+
+	// redis as seen by another instance
+	otherOptions := *s.options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.nx.other", &otherOptions)
+	for _, cache := range []levelcache.Cache{s.cache, other} {
+		values, _, err := cache.MGet(s.ctx, s.keys)
+		assert.Nil(err)
+		assert.Equal(map[string]string{k1: "v1", k2: "nx2"}, convert(values))
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestMSetXX() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+	assert.Nil(s.cache.MSetXX(s.ctx, map[string][]byte{k1: []byte("xx1"), k2: []byte("xx2")}))
+
+	otherOptions := *s.options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.xx.other", &otherOptions)
+	for _, cache := range []levelcache.Cache{s.cache, other} {
+		values, _, err := cache.MGet(s.ctx, s.keys)
+		assert.Nil(err)
+		assert.Equal(map[string]string{k1: "xx1"}, convert(values))
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestSkipRedisWrite() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.SkipRedisWrite = true
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.skip_redis_write", &options)
+
+	k1, k2 := s.keys[0], s.keys[1]
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{k1: []byte("v1")}, nil
+	})
+	defer patches.Reset()
+
+	values, _, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{k1: "v1"}, convert(values))
+	waitAsyncRedis()
+
+	// neither the value nor the miss is in redis
+	n, err := s.client.Exists(redisOptions.Prefix+"_"+k1, redisOptions.Prefix+"_"+k2).Result()
+	assert.Nil(err)
+	assert.Equal(int64(0), n)
+
+	s.loaderRequestKeys = nil
+	values, _, err = cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "v1"}, convert(values))
+}
+
+func (s *LRUAndRedisCacheSuite) TestPrewarmFromRedis() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	otherOptions := *s.options
+	otherOptions.LRUCacheOptions = nil
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.prewarm.other", &otherOptions)
+	assert.Nil(other.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+
+	s.loaderRequestKeys = nil
+	assert.Nil(s.cache.PrewarmFromRedis(s.ctx, s.keys))
+	assert.Empty(s.loaderRequestKeys)
+
+	// read from lru cache only
+	prefix := s.options.RedisCacheOptions.Prefix
+	assert.Nil(s.client.Del(prefix + "_" + k1).Err())
+	values, valids, err := s.cache.MGet(s.ctx, []string{k1})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "v1"}, convert(values))
+	assert.True(valids[k1])
+
+	// absent in redis, so not prewarmed
+	_, _, err = s.cache.MGet(s.ctx, []string{k2})
+	assert.Nil(err)
+	assert.Equal([]string{k2}, s.loaderRequestKeys)
+}
+
+func (s *LRUAndRedisCacheSuite) TestRedisWriteFilter() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.RedisWriteFilter = func(key string) bool {
+		return key != k2
+	}
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.redis_write_filter", &options)
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1"), k2: []byte("v2")}))
+	prefix := redisOptions.Prefix
+	n, err := s.client.Exists(prefix + "_" + k1).Result()
+	assert.Nil(err)
+	assert.Equal(int64(1), n)
+	n, err = s.client.Exists(prefix + "_" + k2).Result()
+	assert.Nil(err)
+	assert.Equal(int64(0), n)
+
+	// lru cache has both
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "v1", k2: "v2"}, convert(values))
+	assert.Len(valids, 2)
+
+	// values loaded with ttls too, which are reported by OnSet the same way
+	assert.Nil(cache.MDel(s.ctx, s.keys))
+	var redisSets []string
+	options.OnSet = func(key string, level string, ttl time.Duration) {
+		if level == levelcache.LevelRedis {
+			redisSets = append(redisSets, key)
+		}
+	}
+	options.Loader = nil
+	options.TTLLoader = func(ctx context.Context, keys []string) (map[string]levelcache.LoadedValue, error) {
+		values := make(map[string]levelcache.LoadedValue, len(keys))
+		for _, key := range keys {
+			values[key] = levelcache.LoadedValue{Value: []byte(key), TTL: time.Minute}
+		}
+		return values, nil
+	}
+	cache = levelcache.NewCache("levelcache.test.lru_and_redis.redis_write_filter.ttl", &options)
+	values, _, err = cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Len(values, 2)
+	n, err = s.client.Exists(prefix + "_" + k1).Result()
+	assert.Nil(err)
+	assert.Equal(int64(1), n)
+	n, err = s.client.Exists(prefix + "_" + k2).Result()
+	assert.Nil(err)
+	assert.Equal(int64(0), n)
+	assert.Equal([]string{k1}, redisSets)
+}
+
+func (s *LRUAndRedisCacheSuite) TestWithoutNegativeCache() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := s.keys[0]
+	ctx := levelcache.WithoutNegativeCache(s.ctx)
+	_, _, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+
+	t.Run("lru cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		_, _, err := s.get(key)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+
+		_, _, err = s.cache.MGet(ctx, []string{key})
+		assert.Nil(err)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+	})
+
+	t.Run("redis cache", func(t *testing.T) {
+		time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+
+		s.loaderRequestKeys = nil
+		_, _, err = s.cache.MGet(ctx, []string{key})
+		assert.Nil(err)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+	})
+
+	t.Run("not written", func(t *testing.T) {
+		other := s.keys[1]
+		_, _, err = s.cache.MGet(ctx, []string{other})
+		assert.Nil(err)
+
+		s.loaderRequestKeys = nil
+		_, _, err := s.get(other)
+		assert.Nil(err)
+		assert.Equal([]string{other}, s.loaderRequestKeys)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestTTLLoader() {
+	assert := s.Assert()
+
+	options := *s.options
+	options.Loader = nil
+	options.TTLLoader = func(ctx context.Context, keys []string) (map[string]levelcache.LoadedValue, error) {
+		s.loaderRequestKeys = keys
+		all := map[string]levelcache.LoadedValue{
+			s.keys[0]: {Value: []byte("short"), TTL: 50 * time.Millisecond},
+			s.keys[1]: {Value: []byte("long")},
+		}
+		values := make(map[string]levelcache.LoadedValue, len(keys))
+		for _, key := range keys {
+			values[key] = all[key]
+		}
+		return values, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.ttl_loader", &options)
+
+	values, valids, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{s.keys[0]: "short", s.keys[1]: "long"}, convert(values))
+	assert.Len(valids, 2)
+
+	s.loaderRequestKeys = nil
+	_, valids, err = cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Len(valids, 2)
+	assert.Empty(s.loaderRequestKeys)
+
+	// expired in both levels by its own ttl
+	time.Sleep(60 * time.Millisecond)
+	_, valids, err = cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Len(valids, 2)
+	assert.Equal([]string{s.keys[0]}, s.loaderRequestKeys)
+}
+
+func (s *LRUAndRedisCacheSuite) TestLoaderKeysError() {
+	assert := s.Assert()
+
+	keys := []string{"k1", "k2", "k3"}
+	assert.Nil(s.cache.MDel(s.ctx, keys))
+	defer s.cache.MDel(s.ctx, keys)
+
+	// chunks of 2 keys, the second one fails
+	loaderErr := errors.New("chunk failed")
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		values := make(map[string][]byte)
+		var failed []string
+		for i, key := range keys {
+			if i >= 2 {
+				failed = append(failed, key)
+			} else if key == "k1" {
+				values[key] = []byte("v1")
+			}
+		}
+		if len(failed) > 0 {
+			return values, &levelcache.LoaderKeysError{Keys: failed, Err: loaderErr}
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	values, valids, err := s.cache.MGet(s.ctx, keys)
+	assert.True(errors.Is(err, loaderErr))
+	var keysErr *levelcache.LoaderKeysError
+	assert.True(errors.As(err, &keysErr))
+	assert.Equal([]string{"k3"}, keysErr.Keys)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.Equal(map[string]bool{"k1": true}, valids)
+
+	// the value and the miss of the succeeded chunk are cached, the failed key is loaded again
+	values, valids, err = s.cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.Equal(map[string]bool{"k1": true}, valids)
+	assert.Equal([]string{"k3"}, s.loaderRequestKeys)
+}
+
+func (s *LRUAndRedisCacheSuite) TestNegativeHits() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	_, _, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+	assert.Zero(s.cache.Stats().NegativeHits)
+
+	s.loaderRequestKeys = nil
+	_, _, err = s.get(key)
+	assert.Nil(err)
+	assert.Equal(int64(1), s.cache.Stats().NegativeHits)
+
+	// lru cache entry expired, served by redis cache
+	time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+	_, _, err = s.get(key)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(int64(2), s.cache.Stats().NegativeHits)
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{s.keys[1]: []byte("value")}))
+	_, _, err = s.get(s.keys[1])
+	assert.Nil(err)
+	stats := s.cache.Stats()
+	assert.Equal(int64(1), stats.Hits)
+	assert.Equal(int64(2), stats.NegativeHits)
+}
+
+func (s *LRUAndRedisCacheSuite) TestInvalidateTag() {
+	assert := s.Assert()
+	t := s.T()
+
+	k1, k2, k3 := s.keys[0], s.keys[1], "k3"
+	tag := "entity"
+	defer s.cache.MDel(s.ctx, []string{k3})
+
+	err := s.cache.MSetTagged(s.ctx, map[string][]byte{k1: []byte("v1"), k2: []byte("v2"), k3: []byte("v3")},
+		map[string][]string{k1: {tag}, k2: {tag, "other"}})
+	assert.Nil(err)
+
+	t.Run("hit cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.mget([]string{k1, k2, k3})
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(map[string]string{k1: "v1", k2: "v2", k3: "v3"}, values)
+		assert.Len(valids, 3)
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		assert.Nil(s.cache.InvalidateTag(s.ctx, tag))
+
+		s.loaderRequestKeys = nil
+		values, _, err := s.mget([]string{k1, k2, k3})
+		assert.Equal([]string{k1, k2}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(map[string]string{k3: "v3"}, values)
+
+		n, err := s.client.Exists(s.options.RedisCacheOptions.Prefix + "#tag_" + tag).Result()
+		assert.Nil(err)
+		assert.Equal(int64(0), n)
+	})
+
+	t.Run("no expiry", func(t *testing.T) {
+		options := *s.options
+		redisOptions := *options.RedisCacheOptions
+		redisOptions.HardTimeout = 0
+		options.RedisCacheOptions = &redisOptions
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis.tag_no_expiry", &options)
+		defer cache.InvalidateTag(s.ctx, tag)
+
+		assert.Nil(cache.MSetTagged(s.ctx, map[string][]byte{k1: []byte("v1")}, map[string][]string{k1: {tag}}))
+		ttl, err := s.client.PTTL(redisOptions.Prefix + "#tag_" + tag).Result()
+		assert.Nil(err)
+		assert.Equal(-time.Millisecond, ttl)
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		options := *s.options
+		options.KeyValidator = func(key string) error {
+			if key == "bad" {
+				return errors.New("bad key")
+			}
+			return nil
+		}
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis.tag_invalid_keys", &options)
+		defer cache.InvalidateTag(s.ctx, tag)
+
+		assert.Nil(cache.MSetTagged(s.ctx, map[string][]byte{k1: []byte("v1"), "bad": []byte("v")},
+			map[string][]string{k1: {tag}, "bad": {tag}}))
+		members, err := s.client.SMembers(s.options.RedisCacheOptions.Prefix + "#tag_" + tag).Result()
+		assert.Nil(err)
+		assert.Equal([]string{k1}, members)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestFillIfNewer() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.FillIfNewer = true
+	options.RedisCacheOptions = &redisOptions
+	// another instance writes k1 while it is loaded
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.fill_if_newer.other", s.options)
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		s.loaderRequestKeys = keys
+		assert.Nil(other.MSet(ctx, map[string][]byte{k1: []byte("newer")}))
+		return map[string][]byte{k1: []byte("loaded"), k2: []byte("loaded")}, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.fill_if_newer", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	values, _, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{k1: "loaded", k2: "loaded"}, convert(values))
+
+	// k1 is read from redis again
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "newer", k2: "loaded"}, convert(values))
+	assert.Equal(map[string]bool{k1: true, k2: true}, valids)
+}
+
+type evalCountingClient struct {
+	levelcache.RedisClient
+	evals []int // keys of each eval
+}
+
+func (c *evalCountingClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (
+	interface{}, error) {
+	c.evals = append(c.evals, len(keys))
+	return c.RedisClient.Eval(ctx, script, keys, args...)
+}
+
+func (s *LRUAndRedisCacheSuite) TestFillIfNewerMaxPipelineBytes() {
+	assert := s.Assert()
+
+	client := &evalCountingClient{RedisClient: levelcache.NewRedisV6Client(s.client)}
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = nil
+	redisOptions.ContextClient = client
+	redisOptions.FillIfNewer = true
+	redisOptions.MaxPipelineBytes = 3000
+	redisOptions.SlowRedisThreshold = time.Nanosecond
+	options.RedisCacheOptions = &redisOptions
+	// about 1k each, so 2 per script
+	kvs := make(map[string][]byte)
+	keys := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		kvs[key] = bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		keys = append(keys, key)
+	}
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		return kvs, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.fill_if_newer_max_pipeline_bytes", &options)
+	defer cache.MDel(s.ctx, keys)
+
+	values, _, err := cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Equal(kvs, values)
+	assert.Equal([]int{2, 2, 1}, client.evals)
+	// the get and the evals
+	assert.Equal(int64(4), cache.Stats().SlowRedisOps)
+	for _, key := range keys {
+		value, err := s.client.Get(redisOptions.Prefix + "_" + key).Bytes()
+		assert.Nil(err)
+		assert.NotEmpty(value, key)
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestMSetIfNewerMaxPipelineBytes() {
+	assert := s.Assert()
+
+	client := &evalCountingClient{RedisClient: levelcache.NewRedisV6Client(s.client)}
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = nil
+	redisOptions.ContextClient = client
+	redisOptions.MaxPipelineBytes = 3000
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.mset_if_newer_max_pipeline_bytes", &options)
+
+	// about 1k each, so 2 per script
+	entries := make(map[string]levelcache.MetaEntry)
+	keys := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		entries[key] = levelcache.MetaEntry{Value: bytes.Repeat([]byte{byte('a' + i)}, 1000)}
+		keys = append(keys, key)
+	}
+	defer cache.MDel(s.ctx, keys)
+
+	assert.Nil(cache.MSetIfNewer(s.ctx, entries))
+	assert.Equal([]int{2, 2, 1}, client.evals)
+	for _, key := range keys {
+		value, err := s.client.Get(redisOptions.Prefix + "_" + key).Bytes()
+		assert.Nil(err)
+		assert.NotEmpty(value, key)
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestScriptsWithoutExpiry() {
+	assert := s.Assert()
+
+	// a HardTimeout of 0 writes keys never expiring
+	k1, k2 := s.keys[0], s.keys[1]
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.HardTimeout = 0
+	redisOptions.FillIfNewer = true
+	options.RedisCacheOptions = &redisOptions
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		return map[string][]byte{k2: []byte("loaded")}, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.scripts_without_expiry", &options)
+
+	assert.Nil(cache.MSetIfNewer(s.ctx, map[string]levelcache.MetaEntry{k1: {Value: []byte("v1")}}))
+	_, err := cache.Incr(s.ctx, "k3", 1)
+	assert.Nil(err)
+	defer cache.MDel(s.ctx, []string{"k3"})
+	values, _, err := cache.MGet(s.ctx, []string{k2})
+	assert.Nil(err)
+	assert.Equal(map[string]string{k2: "loaded"}, convert(values))
+
+	// -1ms for no ttl
+	for _, key := range []string{k1, k2, "k3"} {
+		ttl, err := s.client.PTTL(redisOptions.Prefix + "_" + key).Result()
+		assert.Nil(err)
+		assert.Equal(-time.Millisecond, ttl, key)
+	}
+}
+
+func (s *LRUAndRedisCacheSuite) TestIncr() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := s.cache.Incr(s.ctx, k1, 1)
+				assert.Nil(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	values, valids, err := s.cache.MGet(s.ctx, []string{k1})
+	assert.Nil(err)
+	assert.Equal(map[string]string{k1: "100"}, convert(values))
+	assert.True(valids[k1])
+
+	// lru cache does not keep the old counter
+	n, err := s.cache.Incr(s.ctx, k1, -101)
+	assert.Nil(err)
+	assert.Equal(int64(-1), n)
+	values, _, err = s.cache.MGet(s.ctx, []string{k1})
+	assert.Nil(err)
+	assert.Equal(map[string]string{k1: "-1"}, convert(values))
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k2: []byte("v2")}))
+	_, err = s.cache.Incr(s.ctx, k2, 1)
+	assert.NotNil(err)
+}
+
+func (s *LRUAndRedisCacheSuite) TestMSetIfNewer() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := s.keys[0]
+	now := time.Now()
+
+	err := s.cache.MSetIfNewer(s.ctx, map[string]levelcache.MetaEntry{key: {Value: []byte("v1"), ModifyTime: now}})
+	assert.Nil(err)
+
+	t.Run("older rejected", func(t *testing.T) {
+		err := s.cache.MSetIfNewer(s.ctx, map[string]levelcache.MetaEntry{
+			key: {Value: []byte("v0"), ModifyTime: now.Add(-time.Minute)},
+		})
+		assert.Nil(err)
+
+		values, valids, err := s.get(key)
+		assert.Nil(err)
+		assert.Equal("v1", values[key])
+		assert.True(valids[key])
+		assert.Empty(s.loaderRequestKeys)
+	})
+
+	t.Run("newer written", func(t *testing.T) {
+		err := s.cache.MSetIfNewer(s.ctx, map[string]levelcache.MetaEntry{
+			key: {Value: []byte("v2"), ModifyTime: now.Add(time.Minute)},
+		})
+		assert.Nil(err)
+
+		values, _, err := s.get(key)
+		assert.Nil(err)
+		assert.Equal("v2", values[key])
+	})
+
+	t.Run("older rejected by redis", func(t *testing.T) {
+		// a fresh cache has an empty lru cache
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis", s.options)
+		err := cache.MSetIfNewer(s.ctx, map[string]levelcache.MetaEntry{key: {Value: []byte("v1"), ModifyTime: now}})
+		assert.Nil(err)
+
+		values, _, err := cache.MGet(s.ctx, []string{key})
+		assert.Nil(err)
+		assert.Equal("v2", string(values[key]))
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestMExists() {
+	assert := s.Assert()
+	t := s.T()
+
+	present, negative, absent := s.keys[0], s.keys[1], "k3"
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{present: []byte("v1")}))
+	_, _, err := s.get(negative)
+	assert.Nil(err)
+	assert.Equal([]string{negative}, s.loaderRequestKeys)
+
+	expected := map[string]bool{present: true, negative: true, absent: false}
+
+	t.Run("lru cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		exists, err := s.cache.MExists(s.ctx, []string{present, negative, absent})
+		assert.Nil(err)
+		assert.Equal(expected, exists)
+		assert.Empty(s.loaderRequestKeys)
+	})
+
+	t.Run("redis cache", func(t *testing.T) {
+		// a fresh cache has an empty lru cache
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis", s.options)
+		exists, err := cache.MExists(s.ctx, []string{present, negative, absent})
+		assert.Nil(err)
+		assert.Equal(expected, exists)
+		assert.Empty(s.loaderRequestKeys)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestMGetStream() {
+	assert := s.Assert()
+	t := s.T()
+
+	k1, k2, k3 := s.keys[0], s.keys[1], "k3"
+	keys := []string{k1, k2, k3}
+	defer s.cache.MDel(s.ctx, []string{k3})
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{k3: []byte("v3")}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1"), k2: []byte("v2")}))
+	// k1 in lru cache, k2 only in redis cache, and k3 from loader
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis", s.options)
+	_, _, err := cache.MGet(s.ctx, []string{k1})
+	assert.Nil(err)
+
+	t.Run("stream", func(t *testing.T) {
+		var streamed []string
+		values := make(map[string][]byte)
+		valids := make(map[string]bool)
+		err := cache.MGetStream(s.ctx, keys, func(key string, value []byte, valid bool) error {
+			streamed = append(streamed, key)
+			values[key] = value
+			valids[key] = valid
+			return nil
+		})
+		assert.Nil(err)
+		assert.Equal(keys, streamed)
+		assert.Equal([]string{k3}, s.loaderRequestKeys)
+
+		expectedValues, expectedValids, err := cache.MGet(s.ctx, keys)
+		assert.Nil(err)
+		assert.Equal(expectedValues, values)
+		assert.Equal(expectedValids, valids)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		stop := errors.New("stop")
+		var streamed []string
+		err := cache.MGetStream(s.ctx, keys, func(key string, value []byte, valid bool) error {
+			streamed = append(streamed, key)
+			return stop
+		})
+		assert.True(errors.Is(err, stop))
+		assert.Len(streamed, 1)
+	})
+}
+
+func (s *LRUAndRedisCacheSuite) TestBumpVersion() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte("v1")}))
+
+	versionKey := s.options.RedisCacheOptions.Prefix + ":version"
+	defer s.client.Del(versionKey)
+	assert.Nil(s.cache.BumpVersion(s.ctx))
+	defer s.cache.MDel(s.ctx, s.keys)
+	assert.Equal(int64(1), s.cache.Options().RedisCacheOptions.PrefixVersion)
+	version, err := s.client.Get(versionKey).Int64()
+	assert.Nil(err)
+	assert.Equal(int64(1), version)
+
+	s.loaderRequestKeys = nil
+	values, _, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+	assert.Empty(values)
+
+	// the old entry is left to expire
+	n, err := s.client.Exists(s.options.RedisCacheOptions.Prefix + "_" + key).Result()
+	assert.Nil(err)
+	assert.Equal(int64(1), n)
+
+	// other instances read the version kept in redis, and pick up later bumps
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.VersionSyncInterval = 50 * time.Millisecond
+	options.RedisCacheOptions = &redisOptions
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.bump_version", &options)
+	defer other.Close()
+	assert.Equal(int64(1), other.Options().RedisCacheOptions.PrefixVersion)
+
+	assert.Nil(s.cache.BumpVersion(s.ctx))
+	assert.Equal(int64(2), s.cache.Options().RedisCacheOptions.PrefixVersion)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(int64(2), other.Options().RedisCacheOptions.PrefixVersion)
+}
+
+func (s *LRUAndRedisCacheSuite) TestMaxStaleness() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	clock := newFakeClock()
+	options := *s.options
+	options.LRUCacheOptions = &levelcache.LRUCacheOptions{
+		Size:    3,
+		Timeout: 100 * time.Millisecond,
+	}
+	options.Clock = clock
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.max_staleness", &options)
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.max_staleness", &options)
+
+	// promoted to lru cache 8s after modified by another instance, then expired and deleted from redis
+	assert.Nil(other.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+	clock.Add(8 * time.Second)
+	_, _, err := cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(s.client.Del(options.RedisCacheOptions.Prefix + "_" + key).Err())
+
+	s.loaderRequestKeys = nil
+	ctx := levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{MaxStaleness: 10 * time.Second})
+	values, valids, err := cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal("v", string(values[key]))
+	assert.False(valids[key])
+
+	ctx = levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{MaxStaleness: 5 * time.Second})
+	_, _, err = cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+}
+
+func (s *LRUAndRedisCacheSuite) TestOnSet() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	ttls := make(map[string]time.Duration)
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.MissTimeoutJitter = 50 * time.Millisecond
+	options.LRUCacheOptions = &lruOptions
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.MissTimeoutJitter = 200 * time.Millisecond
+	options.RedisCacheOptions = &redisOptions
+	options.OnSet = func(key string, level string, ttl time.Duration) {
+		ttls[level+" "+key] = ttl
+	}
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		return map[string][]byte{k1: []byte("v1")}, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.on_set", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	_, _, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Len(ttls, 4)
+	assert.Equal(lruOptions.Timeout, ttls[levelcache.LevelLRU+" "+k1])
+	assert.Equal(redisOptions.HardTimeout, ttls[levelcache.LevelRedis+" "+k1])
+
+	// misses are jittered
+	ttl := ttls[levelcache.LevelLRU+" "+k2]
+	assert.True(ttl >= lruOptions.MissTimeout && ttl < lruOptions.MissTimeout+lruOptions.MissTimeoutJitter, ttl)
+	ttl = ttls[levelcache.LevelRedis+" "+k2]
+	assert.True(ttl >= redisOptions.MissTimeout && ttl < redisOptions.MissTimeout+redisOptions.MissTimeoutJitter, ttl)
+}
+
+func (s *LRUAndRedisCacheSuite) TestMGetDecorated() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	options := *s.options
+	options.LRUCacheOptions = &levelcache.LRUCacheOptions{
+		Size:    3,
+		Timeout: 100 * time.Millisecond,
+	}
+	options.Decorator = func(key string, raw []byte) (interface{}, error) {
+		return "decorated " + string(raw), nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru_and_redis.decorated", &options)
+	other := levelcache.NewCache("levelcache.test.lru_and_redis.decorated.other", &options)
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v1")}))
+	values, _, err := cache.MGetDecorated(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("decorated v1", values[key])
+
+	// served from redis while the expired lru value is kept, so is its decorated object
+	assert.Nil(other.MSet(s.ctx, map[string][]byte{key: []byte("v2")}))
+	time.Sleep(150 * time.Millisecond)
+	ctx := levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{NoStore: true})
+	values, _, err = cache.MGetDecorated(ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("decorated v2", values[key])
+}
+
+func (s *LRUAndRedisCacheSuite) TestStaleResolution() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := s.keys[0]
+
+	// mget key after its lru cache value "lru" expires, while redis cache holds "redis" written by another process.
+	// lruNewer tells which is modified later.
+	mget := func(resolution levelcache.StaleResolution, lruNewer, redisStale bool) (string, bool) {
+		clock := newFakeClock()
+		options := *s.options
+		options.LRUCacheOptions = &levelcache.LRUCacheOptions{
+			Size:        3,
+			Timeout:     100 * time.Millisecond,
+			MissTimeout: 50 * time.Millisecond,
+		}
+		options.Clock = clock
+		options.StaleResolution = resolution
+		cache := levelcache.NewCache("levelcache.test.lru_and_redis.stale", &options)
+		other := levelcache.NewCache("levelcache.test.lru_and_redis.stale", &options)
+
+		offset := time.Second
+		if !lruNewer {
+			offset = -offset
+		}
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("lru")}))
+		clock.Add(-offset)
+		assert.Nil(other.MSet(s.ctx, map[string][]byte{key: []byte("redis")}))
+
+		time.Sleep(150 * time.Millisecond)
+		if redisStale {
+			clock.Add(options.RedisCacheOptions.SoftTimeout + 2*time.Second)
+		}
+		values, valids, err := cache.MGet(s.ctx, []string{key})
+		assert.Nil(err)
+		return string(values[key]), valids[key]
+	}
+
+	resolutions := map[string]levelcache.StaleResolution{
+		"prefer lru":      levelcache.StalePreferLRU,
+		"prefer freshest": levelcache.StalePreferFreshest,
+		"prefer redis":    levelcache.StalePreferRedis,
+	}
+	for name, resolution := range resolutions {
+		t.Run(name+" redis valid", func(t *testing.T) {
+			value, valid := mget(resolution, true, false)
+			assert.Equal("redis", value)
+			assert.True(valid)
+		})
+	}
+
+	t.Run("prefer lru both stale", func(t *testing.T) {
+		value, valid := mget(levelcache.StalePreferLRU, false, true)
+		assert.Equal("lru", value)
+		assert.False(valid)
+	})
+
+	t.Run("prefer redis both stale", func(t *testing.T) {
+		value, valid := mget(levelcache.StalePreferRedis, true, true)
+		assert.Equal("redis", value)
+		assert.False(valid)
+	})
+
+	t.Run("prefer freshest both stale", func(t *testing.T) {
+		value, _ := mget(levelcache.StalePreferFreshest, true, true)
+		assert.Equal("lru", value)
+		value, _ = mget(levelcache.StalePreferFreshest, false, true)
+		assert.Equal("redis", value)
+	})
+}
+
 func TestLRUAndRedisCache(t *testing.T) {
 	suite.Run(t, new(LRUAndRedisCacheSuite))
 }
-
@@ -1,13 +1,21 @@
 package levelcache_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/agiledragon/gomonkey"
 	"github.com/ericuni/levelcache"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -60,6 +68,32 @@ func (s *LRUCacheSuite) TestEmpty() {
 		assert.Nil(valids)
 	})
 
+	t.Run("empty string key", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.mget([]string{"", "a"})
+		assert.Equal([]string{"a"}, s.loaderRequestKeys)
+
+		assert.Nil(err)
+		_, ok := values[""]
+		assert.False(ok)
+		assert.False(valids[""])
+
+		s.loaderRequestKeys = nil
+		values, valids, err = s.mget([]string{""})
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"": []byte("v"), "b": []byte("vb")}))
+		values, valids, err = s.mget([]string{"", "b"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"b": "vb"}, values)
+		assert.True(valids["b"])
+
+		assert.Nil(s.cache.MDel(s.ctx, []string{""}))
+	})
+
 	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte, error) {
 		return nil, errors.New("loader error")
 	})
@@ -74,6 +108,15 @@ func (s *LRUCacheSuite) TestEmpty() {
 	})
 }
 
+func (s *LRUCacheSuite) TestPing() {
+	assert := s.Assert()
+
+	assert.Nil(s.cache.Ping(s.ctx))
+
+	s.options.LRUCacheOptions.Size = 0
+	assert.NotNil(s.cache.Ping(s.ctx))
+}
+
 func (s *LRUCacheSuite) TestHitLoader() {
 	assert := s.Assert()
 	t := s.T()
@@ -136,82 +179,1618 @@ func (s *LRUCacheSuite) TestHitLoader() {
 		})
 	})
 
-	t.Run("loader error", func(t *testing.T) {
-		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
-			error) {
-			s.loaderRequestKeys = keys
-			return nil, errors.New("loader error")
-		})
-		defer patches.Reset()
+	t.Run("loader error", func(t *testing.T) {
+		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+			error) {
+			s.loaderRequestKeys = keys
+			return nil, errors.New("loader error")
+		})
+		defer patches.Reset()
+
+		values, valids, err := s.get("new key")
+		assert.NotNil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+	})
+
+	t.Run("loader panic", func(t *testing.T) {
+		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+			error) {
+			panic("loader panic")
+		})
+		defer patches.Reset()
+
+		values, valids, err := s.get("panic key")
+		assert.NotNil(err)
+		assert.Contains(err.Error(), "loader panic")
+		assert.Empty(values)
+		assert.Empty(valids)
+
+		s.options.DisableLoaderRecover = true
+		assert.Panics(func() {
+			s.get("panic key")
+		})
+	})
+}
+
+func (s *LRUCacheSuite) TestFallbackLoader() {
+	assert := s.Assert()
+	t := s.T()
+
+	k1 := "k1"
+	k2 := "k2"
+	var fallbackRequestKeys []string
+
+	options := s.options
+	options.FallbackLoader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		fallbackRequestKeys = keys
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("fallback " + key)
+		}
+		return values, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.fallback_loader", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	t.Run("primary error", func(t *testing.T) {
+		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+			error) {
+			s.loaderRequestKeys = keys
+			return nil, errors.New("loader error")
+		})
+		defer patches.Reset()
+
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(k1)
+		assert.Equal([]string{k1}, s.loaderRequestKeys)
+		assert.Equal([]string{k1}, fallbackRequestKeys)
+
+		assert.Nil(err)
+		assert.Equal("fallback "+k1, values[k1])
+		assert.True(valids[k1])
+	})
+
+	t.Run("primary part miss", func(t *testing.T) {
+		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+			error) {
+			s.loaderRequestKeys = keys
+			return map[string][]byte{"k3": []byte("primary k3")}, nil
+		})
+		defer patches.Reset()
+
+		values, valids, err := s.mget([]string{k2, "k3"})
+		assert.Equal([]string{k2}, fallbackRequestKeys)
+
+		assert.Nil(err)
+		assert.Equal("fallback "+k2, values[k2])
+		assert.Equal("primary k3", values["k3"])
+		assert.True(valids[k2])
+	})
+
+	t.Run("hit cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		fallbackRequestKeys = nil
+		values, valids, err := s.mget([]string{k1, k2})
+		assert.Empty(s.loaderRequestKeys)
+		assert.Empty(fallbackRequestKeys)
+
+		assert.Nil(err)
+		assert.Equal("fallback "+k1, values[k1])
+		assert.Equal("fallback "+k2, values[k2])
+		assert.True(valids[k1])
+		assert.True(valids[k2])
+	})
+}
+
+func (s *LRUCacheSuite) TestMaxLoaderCostPerCall() {
+	assert := s.Assert()
+	t := s.T()
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("value " + key)
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	// keys of "big" cost 10, others 1
+	options := *s.options
+	options.KeyCost = func(key string) int {
+		if strings.HasPrefix(key, "big") {
+			return 10
+		}
+		return 1
+	}
+	options.MaxLoaderCostPerCall = 5
+
+	t.Run("reject", func(t *testing.T) {
+		cache := levelcache.NewCache("levelcache.test.lru.loader_cost", &options)
+
+		s.loaderRequestKeys = nil
+		values, _, err := cache.MGet(s.ctx, []string{"k1", "big1"})
+		assert.True(errors.Is(err, levelcache.ErrLoaderCostExceeded))
+		assert.Empty(s.loaderRequestKeys)
+		assert.Empty(values)
+
+		values, _, err = cache.MGet(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+		assert.Equal([]string{"k1", "k2"}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": "value k1", "k2": "value k2"}, convert(values))
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		options := options
+		options.LoaderCostPartial = true
+		cache := levelcache.NewCache("levelcache.test.lru.loader_cost", &options)
+
+		s.loaderRequestKeys = nil
+		values, _, err := cache.MGet(s.ctx, []string{"big1", "k1", "k2"})
+		assert.True(errors.Is(err, levelcache.ErrLoaderCostExceeded))
+		assert.Equal([]string{"k1", "k2"}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": "value k1", "k2": "value k2"}, convert(values))
+	})
+}
+
+func (s *LRUCacheSuite) TestLoaderRateLimiter() {
+	assert := s.Assert()
+	t := s.T()
+
+	var loadedKeys int
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		loadedKeys += len(keys)
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("value " + key)
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	t.Run("not wait", func(t *testing.T) {
+		options := *s.options
+		options.LoaderRateLimiter = &levelcache.LoaderRateLimiterOptions{Rate: 1, Burst: 2}
+		cache := levelcache.NewCache("levelcache.test.lru.rate_limiter", &options)
+
+		values, valids, err := cache.MGet(s.ctx, []string{"k1", "k2", "k3"})
+		assert.True(errors.Is(err, levelcache.ErrLoaderRateLimited))
+		assert.Equal([]string{"k1", "k2"}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": "value k1", "k2": "value k2"}, convert(values))
+		assert.Len(valids, 2)
+
+		// k3 is not cached as a miss
+		s.loaderRequestKeys = nil
+		_, _, err = cache.MGet(s.ctx, []string{"k3"})
+		assert.True(errors.Is(err, levelcache.ErrLoaderRateLimited))
+		assert.Empty(s.loaderRequestKeys)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		options := *s.options
+		options.LoaderRateLimiter = &levelcache.LoaderRateLimiterOptions{Rate: 20, Burst: 1, MaxWait: time.Second}
+		cache := levelcache.NewCache("levelcache.test.lru.rate_limiter", &options)
+
+		loadedKeys = 0
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			_, valids, err := cache.MGet(s.ctx, []string{fmt.Sprintf("key%d", i)})
+			assert.Nil(err)
+			assert.Len(valids, 1)
+		}
+		assert.Equal(5, loadedKeys)
+		// 1 key of burst, then 1 key per 50ms
+		assert.True(time.Since(start) >= 4*50*time.Millisecond-10*time.Millisecond)
+	})
+}
+
+func (s *LRUCacheSuite) TestMaxConcurrentMGet() {
+	assert := s.Assert()
+	t := s.T()
+
+	var running, maxRunning int32
+	release := make(chan struct{})
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+				break
+			}
+		}
+		<-release
+		return map[string][]byte{keys[0]: []byte("value")}, nil
+	})
+	defer patches.Reset()
+
+	t.Run("queue", func(t *testing.T) {
+		options := *s.options
+		options.MaxConcurrentMGet = 3
+		cache := levelcache.NewCache("levelcache.test.lru.max_concurrent_mget", &options)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, valids, err := cache.MGet(s.ctx, []string{fmt.Sprintf("key%d", i)})
+				assert.Nil(err)
+				assert.Len(valids, 1)
+			}(i)
+		}
+		for i := 0; i < 20; i++ {
+			time.Sleep(time.Millisecond)
+			release <- struct{}{}
+		}
+		wg.Wait()
+		assert.Equal(int32(3), atomic.LoadInt32(&maxRunning))
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		options := *s.options
+		options.MaxConcurrentMGet = 1
+		options.FailFastMGet = true
+		cache := levelcache.NewCache("levelcache.test.lru.max_concurrent_mget", &options)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _, err := cache.MGet(s.ctx, []string{"k1"})
+			assert.Nil(err)
+		}()
+		for atomic.LoadInt32(&running) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		_, _, err := cache.MGet(s.ctx, []string{"k2"})
+		assert.True(errors.Is(err, levelcache.ErrTooManyMGet))
+		release <- struct{}{}
+		<-done
+
+		// the slot is released
+		_, valids, err := cache.MGet(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Len(valids, 1)
+	})
+}
+
+func (s *LRUCacheSuite) TestLoaderLockStripes() {
+	assert := s.Assert()
+
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		mu.Lock()
+		for _, key := range keys {
+			loads[key]++
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("value " + key)
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Size = 100
+	options.LRUCacheOptions = &lruOptions
+	options.LoaderLockStripes = 4
+	cache := levelcache.NewCache("levelcache.test.lru.loader_lock", &options)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// overlapping keys in different orders
+			keys := []string{"k1", "k2", "k3"}
+			if i%2 == 1 {
+				keys = []string{"k3", fmt.Sprintf("key%d", i), "k1"}
+			}
+			values, valids, err := cache.MGet(s.ctx, keys)
+			assert.Nil(err)
+			assert.Len(valids, 3)
+			assert.Equal("value k1", string(values["k1"]))
+		}(i)
+	}
+	wg.Wait()
+
+	for key, n := range loads {
+		assert.Equal(1, n, key)
+	}
+	assert.Len(loads, 8)
+}
+
+func (s *LRUCacheSuite) TestHasher() {
+	assert := s.Assert()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Size = 100
+	lruOptions.LRUShards = 4
+	options.LRUCacheOptions = &lruOptions
+	options.LoaderLockStripes = 8
+
+	// the default spreads keys the same across shards and stripes too
+	cache := levelcache.NewCache("levelcache.test.lru.hasher.default", &options)
+	shards := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		shard, stripe := levelcache.ShardAndStripe(cache, key)
+		assert.Equal(shard, stripe%4, key)
+		shards[shard] = true
+	}
+	assert.Len(shards, 4)
+
+	hashes := map[string]uint64{"k1": 1, "k2": 6, "k3": 11}
+	options.Hasher = func(key string) uint64 {
+		return hashes[key]
+	}
+	cache = levelcache.NewCache("levelcache.test.lru.hasher", &options)
+	for key, h := range hashes {
+		shard, stripe := levelcache.ShardAndStripe(cache, key)
+		assert.Equal(int(h%4), shard, key)
+		assert.Equal(int(h%8), stripe, key)
+	}
+
+	// routing by the hasher keeps the cache working
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2")}))
+	values, valids, err := cache.MGet(s.ctx, []string{"k1", "k2"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "v2"}, convert(values))
+	assert.Len(valids, 2)
+}
+
+func (s *LRUCacheSuite) TestLoaderCoalesceWindow() {
+	assert := s.Assert()
+
+	var mu sync.Mutex
+	var calls [][]string
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		mu.Lock()
+		calls = append(calls, keys)
+		mu.Unlock()
+
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("value " + key)
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Size = 100
+	options.LRUCacheOptions = &lruOptions
+	options.LoaderCoalesceWindow = 50 * time.Millisecond
+	cache := levelcache.NewCache("levelcache.test.lru.loader_coalesce", &options)
+
+	var wg sync.WaitGroup
+	for _, keys := range [][]string{{"k1", "k2"}, {"k2", "k3"}, {"k3", "k4"}} {
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			values, valids, err := cache.MGet(s.ctx, keys)
+			assert.Nil(err)
+			assert.Len(valids, 2)
+			for _, key := range keys {
+				assert.Equal("value "+key, string(values[key]))
+			}
+		}(keys)
+	}
+	wg.Wait()
+
+	assert.Len(calls, 1)
+	sort.Strings(calls[0])
+	assert.Equal([]string{"k1", "k2", "k3", "k4"}, calls[0])
+}
+
+func (s *LRUCacheSuite) TestLoaderExtraKeys() {
+	assert := s.Assert()
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{"k1": []byte("v1"), "extra": []byte("extra")}, nil
+	})
+	defer patches.Reset()
+
+	values, _, err := s.get("k1")
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1"}, values)
+	assert.Equal(int64(1), s.cache.Stats().LoaderExtraKeys)
+
+	// not cached
+	s.loaderRequestKeys = nil
+	_, _, err = s.get("extra")
+	assert.Nil(err)
+	assert.Equal([]string{"extra"}, s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestLoaderMaxResultKeys() {
+	assert := s.Assert()
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		table := make(map[string][]byte)
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("k%d", i)
+			table[key] = []byte("v")
+		}
+		return table, nil
+	})
+	defer patches.Reset()
+
+	options := *s.options
+	options.LoaderMaxResultKeys = 5
+	cache := levelcache.NewCache("levelcache.test.lru.loader_max_result_keys", &options)
+	values, valids, err := cache.MGet(s.ctx, []string{"k1"})
+	assert.True(errors.Is(err, levelcache.ErrLoaderResultTooLarge))
+	assert.Empty(values)
+	assert.Empty(valids)
+
+	// nothing cached, not even as a miss
+	s.loaderRequestKeys = nil
+	_, _, err = cache.MGet(s.ctx, []string{"k1"})
+	assert.NotNil(err)
+	assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+
+	options.TruncateLoaderResult = true
+	cache = levelcache.NewCache("levelcache.test.lru.loader_max_result_keys.truncate", &options)
+	values, valids, err = cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v"}, convert(values))
+	assert.Len(valids, 1)
+}
+
+func (s *LRUCacheSuite) TestLRUServeStaleWithoutRefresh() {
+	assert := s.Assert()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Timeout = 50 * time.Millisecond
+	lruOptions.MissTimeout = 10 * time.Millisecond
+	lruOptions.LRUServeStaleWithoutRefresh = true
+	options.LRUCacheOptions = &lruOptions
+	cache := levelcache.NewCache("levelcache.test.lru.serve_stale", &options)
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	time.Sleep(lruOptions.Timeout + 10*time.Millisecond)
+
+	// stale, but not loaded
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(s.ctx, []string{"k1", "k2"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.Empty(valids)
+	assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestMGetWithBudget() {
+	assert := s.Assert()
+
+	var running int32
+	release := make(chan struct{})
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		atomic.AddInt32(&running, 1)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		case <-release:
+		}
+		return nil, ctx.Err()
+	})
+	defer patches.Reset()
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	start := time.Now()
+	values, valids, err := s.cache.MGetWithBudget(s.ctx, []string{"k1", "k2"}, 50*time.Millisecond)
+	assert.True(time.Since(start) < 200*time.Millisecond, time.Since(start))
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.Len(valids, 1)
+
+	// within the budget
+	values, valids, err = s.cache.MGetWithBudget(s.ctx, []string{"k1"}, 50*time.Millisecond)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.Len(valids, 1)
+
+	// waiting for a slot is within the budget
+	options := *s.options
+	options.MaxConcurrentMGet = 1
+	cache := levelcache.NewCache("levelcache.test.lru.mget_with_budget.max_concurrent_mget", &options)
+	atomic.StoreInt32(&running, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := cache.MGet(context.Background(), []string{"k2"})
+		assert.Nil(err)
+	}()
+	for atomic.LoadInt32(&running) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	_, _, err = cache.MGetWithBudget(s.ctx, []string{"k1"}, 50*time.Millisecond)
+	assert.True(time.Since(start) < 200*time.Millisecond, time.Since(start))
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	close(release)
+	<-done
+}
+
+func (s *LRUCacheSuite) TestEmptyValue() {
+	assert := s.Assert()
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k": {}}))
+	s.loaderRequestKeys = nil
+	values, valids, err := s.get("k")
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	v, ok := values["k"]
+	assert.True(ok)
+	assert.Empty(v)
+	assert.True(valids["k"])
+}
+
+func (s *LRUCacheSuite) TestLoaderPartitioner() {
+	assert := s.Assert()
+	t := s.T()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Size = 100
+	options.LRUCacheOptions = &lruOptions
+	options.LoaderPartitioner = func(key string) string {
+		return key[:1]
+	}
+	var calls [][]string
+	var failPartition string
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		calls = append(calls, keys)
+		if keys[0][:1] == failPartition {
+			return nil, errors.New("partition error")
+		}
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte("v" + key)
+		}
+		return values, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.partitioner", &options)
+
+	t.Run("grouped", func(t *testing.T) {
+		calls = nil
+		values, valids, err := cache.MGet(s.ctx, []string{"a1", "b1", "a2"})
+		assert.Nil(err)
+		assert.Equal([][]string{{"a1", "a2"}, {"b1"}}, calls)
+		assert.Equal(map[string]string{"a1": "va1", "a2": "va2", "b1": "vb1"}, convert(values))
+		assert.Len(valids, 3)
+	})
+
+	t.Run("partition failed", func(t *testing.T) {
+		calls, failPartition = nil, "d"
+		values, _, err := cache.MGet(s.ctx, []string{"c1", "d1"})
+		assert.Len(calls, 2)
+		var keysErr *levelcache.LoaderKeysError
+		assert.True(errors.As(err, &keysErr))
+		assert.Equal([]string{"d1"}, keysErr.Keys)
+		assert.Equal(map[string]string{"c1": "vc1"}, convert(values))
+
+		// the partition succeeded is cached
+		calls = nil
+		_, _, err = cache.MGet(s.ctx, []string{"c1"})
+		assert.Nil(err)
+		assert.Empty(calls)
+	})
+}
+
+func (s *LRUCacheSuite) TestLoaderRetry() {
+	assert := s.Assert()
+	t := s.T()
+
+	transient := errors.New("transient")
+	options := *s.options
+	options.LoaderRetry = &levelcache.LoaderRetryOptions{
+		MaxAttempts: 3,
+		BaseBackoff: time.Millisecond,
+		Jitter:      time.Millisecond,
+		IsRetryable: func(err error) bool {
+			return errors.Is(err, transient)
+		},
+	}
+	var calls int
+	var loaderErrs []error
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		calls++
+		if len(loaderErrs) > 0 {
+			err := loaderErrs[0]
+			loaderErrs = loaderErrs[1:]
+			return nil, err
+		}
+		return map[string][]byte{keys[0]: []byte("v")}, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.loader_retry", &options)
+
+	t.Run("retryable", func(t *testing.T) {
+		calls, loaderErrs = 0, []error{transient}
+		values, valids, err := cache.MGet(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Equal(2, calls)
+		assert.Equal("v", string(values["k1"]))
+		assert.True(valids["k1"])
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		calls, loaderErrs = 0, []error{transient, transient, transient}
+		_, _, err := cache.MGet(s.ctx, []string{"k2"})
+		assert.True(errors.Is(err, transient))
+		assert.Equal(3, calls)
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		permanent := errors.New("permanent")
+		calls, loaderErrs = 0, []error{permanent}
+		_, _, err := cache.MGet(s.ctx, []string{"k3"})
+		assert.True(errors.Is(err, permanent))
+		assert.Equal(1, calls)
+	})
+}
+
+func (s *LRUCacheSuite) TestMGetDecorated() {
+	assert := s.Assert()
+	t := s.T()
+
+	type decorated struct {
+		s string
+	}
+	decorations := 0
+	var onDecorate func()
+	options := *s.options
+	options.Decorator = func(key string, raw []byte) (interface{}, error) {
+		decorations++
+		if onDecorate != nil {
+			onDecorate()
+		}
+		return &decorated{s: key + ":" + string(raw)}, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.decorated", &options)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		return map[string][]byte{"k2": []byte("v2")}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+
+	t.Run("decorated once per cached value", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			values, valids, err := cache.MGetDecorated(s.ctx, []string{"k1", "k2"})
+			assert.Nil(err)
+			assert.Equal(&decorated{s: "k1:v1"}, values["k1"])
+			assert.Equal(&decorated{s: "k2:v2"}, values["k2"])
+			assert.Len(valids, 2)
+		}
+		assert.Equal(2, decorations)
+	})
+
+	t.Run("decorated again once value changes", func(t *testing.T) {
+		decorations = 0
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1.1")}))
+		for i := 0; i < 2; i++ {
+			values, _, err := cache.MGetDecorated(s.ctx, []string{"k1"})
+			assert.Nil(err)
+			assert.Equal(&decorated{s: "k1:v1.1"}, values["k1"])
+		}
+		assert.Equal(1, decorations)
+	})
+
+	t.Run("value set again while decorated", func(t *testing.T) {
+		onDecorate = func() {
+			onDecorate = nil
+			assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1.2")}))
+		}
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1.1.1")}))
+		values, _, err := cache.MGetDecorated(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Equal(&decorated{s: "k1:v1.1.1"}, values["k1"])
+
+		// not kept as the decorated object of v1.2
+		values, _, err = cache.MGetDecorated(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Equal(&decorated{s: "k1:v1.2"}, values["k1"])
+	})
+
+	t.Run("lazy init", func(t *testing.T) {
+		options := options
+		lruOptions := *options.LRUCacheOptions
+		lruOptions.LazyInit = true
+		options.LRUCacheOptions = &lruOptions
+		cache := levelcache.NewCache("levelcache.test.lru.decorated.lazy_init", &options)
+		assert.False(levelcache.DecoratedAllocated(cache))
+
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+		values, _, err := cache.MGetDecorated(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Equal(&decorated{s: "k1:v1"}, values["k1"])
+		assert.True(levelcache.DecoratedAllocated(cache))
+	})
+}
+
+func (s *LRUCacheSuite) TestSkipOversizedBatch() {
+	assert := s.Assert()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.SkipOversizedBatch = true
+	options.LRUCacheOptions = &lruOptions
+	options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		s.loaderRequestKeys = keys
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = []byte(key)
+		}
+		return values, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.skip_oversized_batch", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+
+	// a batch larger than size is returned but not cached
+	keys := []string{"k2", "k3", "k4", "k5"}
+	values, _, err := cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Len(values, len(keys))
+	assert.Equal(keys, s.loaderRequestKeys)
+
+	// so what is cached stays
+	time.Sleep(10 * time.Millisecond)
+	s.loaderRequestKeys = nil
+	values, _, err = cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+
+	_, _, err = cache.MGet(s.ctx, []string{"k2"})
+	assert.Nil(err)
+	assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+
+	// except older entries of keys of the batch, which must not be served instead of the values skipped
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k2": []byte("v2"), "k3": []byte("v3"), "k4": []byte("v4"),
+		"k5": []byte("v5")}))
+	time.Sleep(10 * time.Millisecond)
+	s.loaderRequestKeys = nil
+	values, _, err = cache.MGet(s.ctx, []string{"k1", "k2"})
+	assert.Nil(err)
+	assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "k2"}, convert(values))
+}
+
+func (s *LRUCacheSuite) TestFederation() {
+	assert := s.Assert()
+	t := s.T()
+
+	// keys of "a" go to the first cache, others to the second
+	loaderKeys := make([][]string, 2)
+	caches := make([]levelcache.Cache, 2)
+	for i := range caches {
+		i := i
+		options := *s.options
+		options.TrackValueSizes = true
+		options.Loader = func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			loaderKeys[i] = keys
+			values := make(map[string][]byte, len(keys))
+			for _, key := range keys {
+				if !strings.HasSuffix(key, "miss") {
+					values[key] = []byte(fmt.Sprintf("%s.%d", key, i))
+				}
+			}
+			return values, nil
+		}
+		caches[i] = levelcache.NewCache(fmt.Sprintf("levelcache.test.lru.federation.%d", i), &options)
+	}
+	federation := levelcache.NewFederation("levelcache.test.lru.federation", caches, func(key string) int {
+		if strings.HasPrefix(key, "a") {
+			return 0
+		}
+		return 1
+	})
+
+	t.Run("mget", func(t *testing.T) {
+		values, valids, err := federation.MGet(s.ctx, []string{"a1", "b1", "a2"})
+		assert.Nil(err)
+		assert.Equal([]string{"a1", "a2"}, loaderKeys[0])
+		assert.Equal([]string{"b1"}, loaderKeys[1])
+		assert.Equal(map[string]string{"a1": "a1.0", "b1": "b1.1", "a2": "a2.0"}, convert(values))
+		assert.Equal(map[string]bool{"a1": true, "b1": true, "a2": true}, valids)
+	})
+
+	t.Run("mget into", func(t *testing.T) {
+		// leftovers of requested keys are dropped even without reset, others kept
+		valuesOut := map[string][]byte{"a1": []byte("old"), "amiss": []byte("old"), "c1": []byte("other")}
+		validsOut := map[string]bool{"a1": false, "amiss": false, "c1": true}
+		assert.Nil(federation.MGetInto(s.ctx, []string{"a1", "b1", "amiss"}, valuesOut, validsOut, false))
+		assert.Equal(map[string]string{"a1": "a1.0", "b1": "b1.1", "c1": "other"}, convert(valuesOut))
+		assert.Equal(map[string]bool{"a1": true, "b1": true, "c1": true}, validsOut)
+
+		assert.Nil(federation.MGetInto(s.ctx, []string{"a1"}, valuesOut, validsOut, true))
+		assert.Equal(map[string]string{"a1": "a1.0"}, convert(valuesOut))
+		assert.Equal(map[string]bool{"a1": true}, validsOut)
+	})
+
+	t.Run("mget with refresh", func(t *testing.T) {
+		// loads of both caches are merged into one fresh
+		values, fresh, err := federation.MGetWithRefresh(s.ctx, []string{"a1", "a4", "b4"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"a1": "a1.0"}, convert(values))
+		assert.Equal(map[string]string{"a4": "a4.0", "b4": "b4.1"}, convert(<-fresh))
+		_, ok := <-fresh
+		assert.False(ok)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats0, stats1 := caches[0].Stats(), caches[1].Stats()
+		stats := federation.Stats()
+		assert.NotZero(stats0.Hits)
+		assert.NotZero(stats1.Hits)
+		assert.Equal(stats0.Hits+stats1.Hits, stats.Hits)
+		assert.Equal(stats0.NegativeHits+stats1.NegativeHits, stats.NegativeHits)
+		assert.Equal(stats0.LoaderExtraKeys+stats1.LoaderExtraKeys, stats.LoaderExtraKeys)
+		assert.Len(stats.ValueSizes, len(stats0.ValueSizes))
+		var count int64
+		for i, bucket := range stats.ValueSizes {
+			assert.Equal(stats0.ValueSizes[i].UpperBound, bucket.UpperBound)
+			assert.Equal(stats0.ValueSizes[i].Count+stats1.ValueSizes[i].Count, bucket.Count)
+			count += bucket.Count
+		}
+		assert.NotZero(count)
+	})
+
+	t.Run("mset", func(t *testing.T) {
+		assert.Nil(federation.MSet(s.ctx, map[string][]byte{"a3": []byte("v"), "b3": []byte("v")}))
+		exists, err := caches[0].MExists(s.ctx, []string{"a3", "b3"})
+		assert.Nil(err)
+		assert.Equal(map[string]bool{"a3": true, "b3": false}, exists)
+		exists, err = caches[1].MExists(s.ctx, []string{"a3", "b3"})
+		assert.Nil(err)
+		assert.Equal(map[string]bool{"a3": false, "b3": true}, exists)
+	})
+
+	t.Run("route out of range", func(t *testing.T) {
+		federation := levelcache.NewFederation("levelcache.test.lru.federation", caches, func(key string) int {
+			return 2
+		})
+		_, _, err := federation.MGet(s.ctx, []string{"a1"})
+		assert.NotNil(err)
+	})
+}
+
+func (s *LRUCacheSuite) TestEvictionPolicyLFU() {
+	assert := s.Assert()
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.EvictionPolicy = levelcache.LRUPolicyLFU
+	options.LRUCacheOptions = &lruOptions
+	cache := levelcache.NewCache("levelcache.test.lru.lfu", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2"), "k3": []byte("v3")}))
+	// k1 and k2 are hot, k3 is read once but last
+	for i := 0; i < 3; i++ {
+		_, _, err := cache.MGet(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+	}
+	_, _, err := cache.MGet(s.ctx, []string{"k3"})
+	assert.Nil(err)
+
+	// k3 is evicted, where lru would evict k1
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k4": []byte("v4")}))
+	s.loaderRequestKeys = nil
+	values, _, err := cache.MGet(s.ctx, []string{"k1", "k2", "k4"})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "v2", "k4": "v4"}, convert(values))
+
+	_, _, err = cache.MGet(s.ctx, []string{"k3"})
+	assert.Nil(err)
+	assert.Equal([]string{"k3"}, s.loaderRequestKeys)
+
+	s.Run("aging", func() {
+		lruOptions.Timeout = 200 * time.Millisecond
+		lruOptions.MissTimeout = 50 * time.Millisecond
+		cache := levelcache.NewCache("levelcache.test.lru.lfu.aging", &options)
+
+		// k1 is hot once and expires, then k2 and k3 are read less than k1 was
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+		for i := 0; i < 50; i++ {
+			_, _, err := cache.MGet(s.ctx, []string{"k1"})
+			assert.Nil(err)
+		}
+		time.Sleep(250 * time.Millisecond)
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k2": []byte("v2"), "k3": []byte("v3")}))
+		for i := 0; i < 20; i++ {
+			_, _, err := cache.MGet(s.ctx, []string{"k2", "k3"})
+			assert.Nil(err)
+		}
+
+		// k1 is evicted
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k4": []byte("v4")}))
+		s.loaderRequestKeys = nil
+		values, _, err := cache.MGet(s.ctx, []string{"k2", "k3", "k4"})
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Len(values, 3)
+	})
+
+	s.Run("clear", func() {
+		var gcs int64
+		lruOptions.OnGC = func(n int) {
+			atomic.AddInt64(&gcs, int64(n))
+		}
+		cache := levelcache.NewCache("levelcache.test.lru.lfu.clear", &options)
+
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2")}))
+		levelcache.ClearLRU(cache)
+		assert.Zero(atomic.LoadInt64(&gcs))
+		s.loaderRequestKeys = nil
+		_, _, err := cache.MGet(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+		assert.ElementsMatch([]string{"k1", "k2"}, s.loaderRequestKeys)
+	})
+}
+
+func (s *LRUCacheSuite) TestLazyInit() {
+	assert := s.Assert()
+
+	assert.True(levelcache.LRUAllocated(s.cache))
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.LazyInit = true
+	options.LRUCacheOptions = &lruOptions
+	cache := levelcache.NewCache("levelcache.test.lru.lazy_init", &options)
+	assert.NotNil(cache)
+	assert.False(levelcache.LRUAllocated(cache))
+	s.cache = cache
+
+	// concurrent first uses share one lru cache
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(cache.MSet(s.ctx, map[string][]byte{fmt.Sprintf("k%d", i): []byte("v")}))
+		}(i)
+	}
+	wg.Wait()
+	assert.True(levelcache.LRUAllocated(cache))
+
+	s.loaderRequestKeys = nil
+	values, _, err := cache.MGet(s.ctx, []string{"k0", "k1", "k2"})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Len(values, 3)
+}
+
+func (s *LRUCacheSuite) TestHotKeys() {
+	assert := s.Assert()
+	t := s.T()
+
+	newCache := func(capacity int) levelcache.Cache {
+		options := *s.options
+		lruOptions := *options.LRUCacheOptions
+		lruOptions.Size = 100
+		lruOptions.HotKeysCapacity = capacity
+		options.LRUCacheOptions = &lruOptions
+		cache := levelcache.NewCache("levelcache.test.lru.hot_keys", &options)
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2"), "k3": []byte("v3")}))
+		return cache
+	}
+	read := func(cache levelcache.Cache, key string, times int) {
+		for i := 0; i < times; i++ {
+			_, _, err := cache.MGet(s.ctx, []string{key})
+			assert.Nil(err)
+		}
+	}
+
+	t.Run("ranked", func(t *testing.T) {
+		cache := newCache(10)
+		read(cache, "k2", 3)
+		read(cache, "k1", 5)
+		read(cache, "k3", 1)
+		assert.Equal([]string{"k1", "k2"}, cache.HotKeys(2))
+		assert.Equal([]string{"k1", "k2", "k3"}, cache.HotKeys(10))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		cache := newCache(2)
+		read(cache, "k1", 4)
+		read(cache, "k2", 1)
+		// k1 halved to 2, k2 to 0 and forgotten
+		read(cache, "k3", 1)
+		assert.Equal([]string{"k1", "k3"}, cache.HotKeys(3))
+	})
+
+	t.Run("not tracked", func(t *testing.T) {
+		read(s.cache, "k1", 1)
+		assert.Nil(s.cache.HotKeys(1))
+	})
+}
+
+func (s *LRUCacheSuite) TestCacheControl() {
+	assert := s.Assert()
+	t := s.T()
+
+	loaded := "loaded"
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{keys[0]: []byte(loaded)}, nil
+	})
+	defer patches.Reset()
+
+	ctx := func(control levelcache.CacheControl) context.Context {
+		return levelcache.WithCacheControl(context.Background(), control)
+	}
+
+	t.Run("no cache", func(t *testing.T) {
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+		s.loaderRequestKeys = nil
+		values, valids, err := s.cache.MGet(ctx(levelcache.CacheControl{NoCache: true}), []string{"k1"})
+		assert.Nil(err)
+		assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": loaded}, convert(values))
+		assert.True(valids["k1"])
+
+		// the loaded value replaces the cached one
+		s.loaderRequestKeys = nil
+		values, _, err = s.cache.MGet(s.ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": loaded}, convert(values))
+	})
+
+	t.Run("no store", func(t *testing.T) {
+		values, _, err := s.cache.MGet(ctx(levelcache.CacheControl{NoStore: true}), []string{"k2"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"k2": loaded}, convert(values))
+
+		s.loaderRequestKeys = nil
+		_, _, err = s.cache.MGet(s.ctx, []string{"k2"})
+		assert.Nil(err)
+		assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+	})
+
+	t.Run("max stale", func(t *testing.T) {
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k3": []byte("v3")}))
+		time.Sleep(s.options.LRUCacheOptions.Timeout + 50*time.Millisecond)
+
+		s.loaderRequestKeys = nil
+		values, valids, err := s.cache.MGet(ctx(levelcache.CacheControl{MaxStale: time.Second}), []string{"k3"})
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k3": "v3"}, convert(values))
+		assert.False(valids["k3"])
+
+		// expired longer than max stale
+		values, valids, err = s.cache.MGet(ctx(levelcache.CacheControl{MaxStale: 10 * time.Millisecond}),
+			[]string{"k3"})
+		assert.Nil(err)
+		assert.Equal([]string{"k3"}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k3": loaded}, convert(values))
+		assert.True(valids["k3"])
+	})
+}
+
+func (s *LRUCacheSuite) TestMiss() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := "a"
+	value := "va"
+
+	t.Run("loader always misses", func(t *testing.T) {
+		t.Run("loader miss", func(t *testing.T) {
+			s.loaderRequestKeys = nil
+			values, valids, err := s.get(key)
+			assert.Equal([]string{key}, s.loaderRequestKeys)
+
+			assert.Nil(err)
+			assert.Empty(values)
+			assert.Empty(valids)
+		})
+
+		t.Run("hit cache", func(t *testing.T) {
+			s.loaderRequestKeys = nil
+			values, valids, err := s.get(key)
+			assert.Empty(s.loaderRequestKeys)
+
+			assert.Nil(err)
+			assert.Empty(values)
+			assert.Empty(valids)
+		})
+
+		t.Run("timeout and arrive loader agagin but miss agagin", func(t *testing.T) {
+			time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+
+			s.loaderRequestKeys = nil
+			values, valids, err := s.get(key)
+			assert.Equal([]string{key}, s.loaderRequestKeys)
+
+			assert.Nil(err)
+			assert.Empty(values)
+			assert.Empty(valids)
+		})
+	})
+
+	t.Run("hittable loader", func(t *testing.T) {
+		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+			error) {
+			s.loaderRequestKeys = keys
+			return map[string][]byte{key: []byte(value)}, nil
+		})
+		defer patches.Reset()
+
+		t.Run("timeout and hit loader", func(t *testing.T) {
+			time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+
+			s.loaderRequestKeys = nil
+			values, valids, err := s.get(key)
+			assert.Equal([]string{key}, s.loaderRequestKeys)
+
+			assert.Nil(err)
+			assert.Equal(value, values[key])
+			assert.True(valids[key])
+		})
+	})
+}
+
+func (s *LRUCacheSuite) TestMGetDetailed() {
+	assert := s.Assert()
+	t := s.T()
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{"k1": []byte("v1")}, nil
+	})
+	defer patches.Reset()
+
+	t.Run("loader miss", func(t *testing.T) {
+		values, valids, negative, err := s.cache.MGetDetailed(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+		assert.Equal(map[string]bool{"k1": true}, valids)
+		assert.Equal(map[string]bool{"k2": true}, negative)
+	})
+
+	t.Run("negative cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, negative, err := s.cache.MGetDetailed(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+		assert.Equal(map[string]bool{"k1": true}, valids)
+		assert.Equal(map[string]bool{"k2": true}, negative)
+	})
+}
+
+func (s *LRUCacheSuite) TestKeyValidator() {
+	assert := s.Assert()
+	t := s.T()
+
+	options := *s.options
+	options.KeyValidator = func(key string) error {
+		if strings.Contains(key, " ") {
+			return errors.New("space in key")
+		}
+		return nil
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		cache := levelcache.NewCache("levelcache.test.lru.key_validator", &options)
+
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "bad key": []byte("v")}))
+		s.loaderRequestKeys = nil
+		values, valids, err := cache.MGet(s.ctx, []string{"k1", "bad key", "k2"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+		assert.Len(valids, 1)
+		assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+		assert.Nil(cache.MDel(s.ctx, []string{"bad key"}))
+
+		// by every method taking keys
+		assert.Nil(cache.MSetWithMeta(s.ctx, map[string]levelcache.MetaEntry{"bad key": {Value: []byte("v")}}))
+		exists, err := cache.MExists(s.ctx, []string{"k1", "bad key"})
+		assert.Nil(err)
+		assert.Equal(map[string]bool{"k1": true}, exists)
+		assert.Nil(cache.Touch(s.ctx, []string{"bad key"}, time.Second))
+		s.loaderRequestKeys = nil
+		values, fresh, err := cache.MGetWithRefresh(s.ctx, []string{"bad key"})
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(<-fresh)
+		assert.Empty(s.loaderRequestKeys)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		options := options
+		options.FailOnInvalidKey = true
+		cache := levelcache.NewCache("levelcache.test.lru.key_validator", &options)
+
+		err := cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "bad key": []byte("v")})
+		assert.True(errors.Is(err, levelcache.ErrInvalidKey))
+		s.loaderRequestKeys = nil
+		values, _, err := cache.MGet(s.ctx, []string{"k1", "bad key"})
+		assert.True(errors.Is(err, levelcache.ErrInvalidKey))
+		assert.Empty(values)
+		assert.Empty(s.loaderRequestKeys)
+		assert.True(errors.Is(cache.MDel(s.ctx, []string{"bad key"}), levelcache.ErrInvalidKey))
+
+		err = cache.MSetWithMeta(s.ctx, map[string]levelcache.MetaEntry{"bad key": {Value: []byte("v")}})
+		assert.True(errors.Is(err, levelcache.ErrInvalidKey))
+		_, err = cache.MExists(s.ctx, []string{"bad key"})
+		assert.True(errors.Is(err, levelcache.ErrInvalidKey))
+		assert.True(errors.Is(cache.Touch(s.ctx, []string{"bad key"}, time.Second), levelcache.ErrInvalidKey))
+		_, _, err = cache.MGetWithRefresh(s.ctx, []string{"bad key"})
+		assert.True(errors.Is(err, levelcache.ErrInvalidKey))
+		assert.True(errors.Is(cache.RegisterRefresh([]string{"bad key"}, time.Second), levelcache.ErrInvalidKey))
+	})
+}
+
+func (s *LRUCacheSuite) TestSetBeyondSize() {
+	assert := s.Assert()
+
+	// lru cache holds 3 items, setting more evicts only the least recently used ones
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte("value of " + key)}))
+		time.Sleep(time.Millisecond)
+
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal("value of "+key, values[key])
+		assert.True(valids[key])
+	}
+}
+
+func (s *LRUCacheSuite) TestMissRetries() {
+	assert := s.Assert()
+
+	options := *s.options
+	options.MissRetries = 2
+	cache := levelcache.NewCache("levelcache.test.lru.miss_retries", &options)
+
+	key := "k1"
+	for i := 0; i < 3; i++ {
+		s.loaderRequestKeys = nil
+		_, _, err := cache.MGet(s.ctx, []string{key})
+		assert.Nil(err)
+		assert.Equal([]string{key}, s.loaderRequestKeys, i)
+	}
+
+	// cached as a miss after the third miss in a row
+	s.loaderRequestKeys = nil
+	_, _, err := cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestOnLoaded() {
+	assert := s.Assert()
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		values := make(map[string][]byte)
+		for _, key := range keys {
+			switch key {
+			case "k1":
+				values[key] = []byte("v1")
+			case "k2":
+				values[key] = []byte("placeholder")
+			}
+		}
+		return values, nil
+	})
+	defer patches.Reset()
+
+	options := *s.options
+	options.OnLoaded = func(ctx context.Context, results map[string][]byte, missKeys []string) (map[string][]byte,
+		[]string) {
+		kvs := make(map[string][]byte, len(results))
+		for k, v := range results {
+			if string(v) != "placeholder" {
+				kvs[k] = v
+			}
+		}
+		return kvs, nil
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.on_loaded", &options)
+
+	keys := []string{"k1", "k2", "k3"}
+	values, valids, err := cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "placeholder"}, convert(values))
+	assert.Len(valids, 2)
+
+	// the placeholder and the miss are not cached
+	s.loaderRequestKeys = nil
+	values, _, err = cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "placeholder"}, convert(values))
+	sort.Strings(s.loaderRequestKeys)
+	assert.Equal([]string{"k2", "k3"}, s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestReportNegative() {
+	assert := s.Assert()
+
+	options := *s.options
+	options.ReportNegative = true
+	cache := levelcache.NewCache("levelcache.test.lru.report_negative", &options)
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k2": []byte("v2")}))
+
+	// missed by loader, then negatively cached
+	for i := 0; i < 2; i++ {
+		s.loaderRequestKeys = nil
+		values, valids, err := cache.MGet(s.ctx, []string{"k1", "k2"})
+		assert.Nil(err)
+		assert.Equal(map[string]string{"k2": "v2"}, convert(values))
+		valid, ok := valids["k1"]
+		assert.True(ok, i)
+		assert.False(valid, i)
+		assert.True(valids["k2"])
+	}
+	assert.Empty(s.loaderRequestKeys)
+
+	valids := make(map[string]bool)
+	assert.Nil(cache.MGetInto(s.ctx, []string{"k1"}, make(map[string][]byte), valids, true))
+	assert.Equal(map[string]bool{"k1": false}, valids)
+
+	// absent without the flag
+	_, _, err := s.cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	_, valids, err = s.cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Empty(valids)
+}
+
+func (s *LRUCacheSuite) TestMaxBytes() {
+	assert := s.Assert()
+	t := s.T()
+
+	options := s.options
+	options.LRUCacheOptions.Size = 0
+	options.LRUCacheOptions.LRUMaxBytes = 10000
+	cache := levelcache.NewCache("levelcache.test.lru.max_bytes", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	var keys []string
+	kvs := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte("value of " + key)
+	}
+
+	t.Run("small values beyond item count", func(t *testing.T) {
+		assert.Nil(s.cache.MSet(s.ctx, kvs))
+		time.Sleep(10 * time.Millisecond)
+
+		s.loaderRequestKeys = nil
+		values, _, err := s.mget(keys)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Len(values, len(keys))
+	})
+
+	t.Run("large value evicts", func(t *testing.T) {
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"large": make([]byte, 8000)}))
+		time.Sleep(10 * time.Millisecond)
+
+		s.loaderRequestKeys = nil
+		_, _, err := s.mget(keys)
+		assert.Nil(err)
+		assert.NotEmpty(s.loaderRequestKeys)
+	})
+}
+
+func (s *LRUCacheSuite) TestLRUCompress() {
+	assert := s.Assert()
+	t := s.T()
+
+	var keys []string
+	kvs := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte("value of " + key)
+	}
+	large := make([]byte, 8000)
+
+	newCache := func(compress bool) levelcache.Cache {
+		options := *s.options
+		lruOptions := *options.LRUCacheOptions
+		lruOptions.Size = 0
+		lruOptions.LRUMaxBytes = 10000
+		options.LRUCacheOptions = &lruOptions
+		options.CompressionType = levelcache.CompressionType_Snappy
+		options.LRUCompress = compress
+		cache := levelcache.NewCache("levelcache.test.lru.compress", &options)
+		assert.Nil(cache.MSet(s.ctx, kvs))
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{"large": large}))
+		time.Sleep(10 * time.Millisecond)
+		return cache
+	}
+
+	t.Run("uncompressed", func(t *testing.T) {
+		cache := newCache(false)
+
+		// the large value takes its full length and evicts
+		s.loaderRequestKeys = nil
+		_, _, err := cache.MGet(s.ctx, keys)
+		assert.Nil(err)
+		assert.NotEmpty(s.loaderRequestKeys)
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		cache := newCache(true)
 
-		values, valids, err := s.get("new key")
-		assert.NotNil(err)
-		assert.Empty(values)
-		assert.Empty(valids)
+		s.loaderRequestKeys = nil
+		values, valids, err := cache.MGet(s.ctx, append([]string{"large"}, keys...))
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Len(valids, len(keys)+1)
+		assert.Equal(large, values["large"])
+		assert.Equal(kvs["k1"], values["k1"])
 	})
 }
 
-func (s *LRUCacheSuite) TestMiss() {
+func (s *LRUCacheSuite) TestDumpLRU() {
 	assert := s.Assert()
-	t := s.T()
 
-	key := "a"
-	value := "va"
+	var buf bytes.Buffer
+	assert.NotNil(s.cache.DumpLRU(&buf))
 
-	t.Run("loader always misses", func(t *testing.T) {
-		t.Run("loader miss", func(t *testing.T) {
-			s.loaderRequestKeys = nil
-			values, valids, err := s.get(key)
-			assert.Equal([]string{key}, s.loaderRequestKeys)
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Trimmable = true
+	options.LRUCacheOptions = &lruOptions
+	cache := levelcache.NewCache("levelcache.test.lru.dump", &options)
 
-			assert.Nil(err)
-			assert.Empty(values)
-			assert.Empty(valids)
-		})
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2")}))
+	_, _, err := cache.MGet(s.ctx, []string{"k3"})
+	assert.Nil(err)
+	assert.Nil(cache.DumpLRU(&buf))
+	snapshot := buf.Bytes()
 
-		t.Run("hit cache", func(t *testing.T) {
-			s.loaderRequestKeys = nil
-			values, valids, err := s.get(key)
-			assert.Empty(s.loaderRequestKeys)
+	restored := levelcache.NewCache("levelcache.test.lru.dump.restored", &options)
+	assert.Nil(restored.LoadLRU(bytes.NewReader(snapshot)))
+	s.loaderRequestKeys = nil
+	values, valids, negative, err := restored.MGetDetailed(s.ctx, []string{"k1", "k2", "k3"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1", "k2": "v2"}, convert(values))
+	assert.Len(valids, 2)
+	assert.Equal(map[string]bool{"k3": true}, negative)
+	assert.Empty(s.loaderRequestKeys)
 
-			assert.Nil(err)
-			assert.Empty(values)
-			assert.Empty(valids)
-		})
+	// the miss expired since the dump
+	time.Sleep(lruOptions.MissTimeout + 10*time.Millisecond)
+	restored = levelcache.NewCache("levelcache.test.lru.dump.restored_later", &options)
+	assert.Nil(restored.LoadLRU(bytes.NewReader(snapshot)))
+	_, valids, err = restored.MGet(s.ctx, []string{"k1", "k2", "k3"})
+	assert.Nil(err)
+	assert.Len(valids, 2)
+	assert.Equal([]string{"k3"}, s.loaderRequestKeys)
 
-		t.Run("timeout and arrive loader agagin but miss agagin", func(t *testing.T) {
-			time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+	assert.NotNil(restored.LoadLRU(bytes.NewReader(snapshot[:len(snapshot)-1])))
+}
 
-			s.loaderRequestKeys = nil
-			values, valids, err := s.get(key)
-			assert.Equal([]string{key}, s.loaderRequestKeys)
+func (s *LRUCacheSuite) TestTrimLRU() {
+	assert := s.Assert()
 
-			assert.Nil(err)
-			assert.Empty(values)
-			assert.Empty(valids)
-		})
-	})
+	assert.NotNil(s.cache.TrimLRU(1))
+
+	options := *s.options
+	lruOptions := *options.LRUCacheOptions
+	lruOptions.Size = 100
+	lruOptions.LRUShards = 4
+	lruOptions.Trimmable = true
+	options.LRUCacheOptions = &lruOptions
+	cache := levelcache.NewCache("levelcache.test.lru.trim", &options)
+
+	var keys []string
+	kvs := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte("value of " + key)
+	}
+	assert.Nil(cache.MSet(s.ctx, kvs))
 
-	t.Run("hittable loader", func(t *testing.T) {
-		patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
-			error) {
-			s.loaderRequestKeys = keys
-			return map[string][]byte{key: []byte(value)}, nil
-		})
-		defer patches.Reset()
+	// the first keys become the most recently used
+	_, valids, err := cache.MGet(s.ctx, keys[:10])
+	assert.Nil(err)
+	assert.Len(valids, 10)
 
-		t.Run("timeout and hit loader", func(t *testing.T) {
-			time.Sleep(s.options.LRUCacheOptions.MissTimeout + 10*time.Millisecond)
+	assert.NotNil(cache.TrimLRU(-1))
+	assert.Nil(cache.TrimLRU(10))
 
-			s.loaderRequestKeys = nil
-			values, valids, err := s.get(key)
-			assert.Equal([]string{key}, s.loaderRequestKeys)
+	s.loaderRequestKeys = nil
+	_, valids, err = cache.MGet(s.ctx, keys[:10])
+	assert.Nil(err)
+	assert.Len(valids, 10)
+	assert.Empty(s.loaderRequestKeys)
 
-			assert.Nil(err)
-			assert.Equal(value, values[key])
-			assert.True(valids[key])
-		})
-	})
+	// deleted keys do not count, even those used last
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k50": []byte("v50")}))
+	assert.Nil(cache.MDel(s.ctx, []string{"k50"}))
+	assert.Nil(cache.TrimLRU(10))
+	s.loaderRequestKeys = nil
+	_, valids, err = cache.MGet(s.ctx, keys[:10])
+	assert.Nil(err)
+	assert.Len(valids, 10)
+	assert.Empty(s.loaderRequestKeys)
+
+	_, valids, err = cache.MGet(s.ctx, keys[10:])
+	assert.Nil(err)
+	assert.Empty(valids)
+	assert.ElementsMatch(keys[10:], s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestMissTimeoutJitter() {
+	assert := s.Assert()
+
+	options := s.options
+	options.LRUCacheOptions.Size = 100
+	options.LRUCacheOptions.MissTimeoutJitter = 200 * time.Millisecond
+	cache := levelcache.NewCache("levelcache.test.lru.miss_timeout_jitter", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("k%d", i))
+	}
+
+	s.loaderRequestKeys = nil
+	_, _, err := s.mget(keys)
+	assert.Nil(err)
+	assert.Equal(keys, s.loaderRequestKeys)
+
+	// miss timeouts are spread in [100ms, 300ms)
+	time.Sleep(options.LRUCacheOptions.MissTimeout + 50*time.Millisecond)
+	s.loaderRequestKeys = nil
+	_, _, err = s.mget(keys)
+	assert.Nil(err)
+	assert.NotEmpty(s.loaderRequestKeys)
+	assert.True(len(s.loaderRequestKeys) < len(keys))
 }
 
 func (s *LRUCacheSuite) TestLoaderPartMiss() {
@@ -315,6 +1894,68 @@ func (s *LRUCacheSuite) TestFull() {
 	})
 }
 
+func (s *LRUCacheSuite) TestOnGC() {
+	assert := s.Assert()
+	t := s.T()
+
+	var dropped int64
+	options := s.options
+	options.LRUCacheOptions.OnGC = func(n int) {
+		atomic.AddInt64(&dropped, int64(n))
+	}
+	cache := levelcache.NewCache("levelcache.test.lru.on_gc", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	t.Run("delete and overwrite", func(t *testing.T) {
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"a": []byte("va")}))
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"a": []byte("va2")}))
+		assert.Nil(s.cache.MDel(s.ctx, []string{"a"}))
+
+		// give lrucache async gc some time
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(int64(0), atomic.LoadInt64(&dropped))
+	})
+
+	t.Run("beyond capacity", func(t *testing.T) {
+		kvs := make(map[string][]byte)
+		for i := 0; i < 6; i++ {
+			key := fmt.Sprintf("k%d", i)
+			kvs[key] = []byte(key)
+		}
+		assert.Nil(s.cache.MSet(s.ctx, kvs))
+
+		time.Sleep(10 * time.Millisecond)
+		assert.True(atomic.LoadInt64(&dropped) >= 3)
+	})
+
+	t.Run("concurrent overwrite", func(t *testing.T) {
+		lruOptions := *options.LRUCacheOptions
+		lruOptions.Size = 100
+		cacheOptions := *options
+		cacheOptions.LRUCacheOptions = &lruOptions
+		cache := levelcache.NewCache("levelcache.test.lru.on_gc.concurrent", &cacheOptions)
+		atomic.StoreInt64(&dropped, 0)
+
+		// items replaced before they are promoted included
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					assert.Nil(cache.MSet(s.ctx, map[string][]byte{"b": []byte("vb")}))
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Nil(cache.MDel(s.ctx, []string{"b"}))
+
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(int64(0), atomic.LoadInt64(&dropped))
+	})
+}
+
 func (s *LRUCacheSuite) TestMSet() {
 	assert := s.Assert()
 	t := s.T()
@@ -350,6 +1991,181 @@ func (s *LRUCacheSuite) TestMSet() {
 	})
 }
 
+func (s *LRUCacheSuite) TestMSetAliases() {
+	assert := s.Assert()
+
+	err := s.cache.MSetAliases(s.ctx, map[string][]byte{"id_1": []byte("v1")}, map[string]string{"slug_1": "id_1"})
+	assert.Nil(err)
+
+	s.loaderRequestKeys = nil
+	values, valids, err := s.mget([]string{"id_1", "slug_1"})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{"id_1": "v1", "slug_1": "v1"}, values)
+	assert.True(valids["slug_1"])
+
+	err = s.cache.MSetAliases(s.ctx, map[string][]byte{"id_2": []byte("v2")}, map[string]string{"slug_2": "id_3"})
+	assert.NotNil(err)
+}
+
+func (s *LRUCacheSuite) TestCopyOnRead() {
+	assert := s.Assert()
+
+	options := s.options
+	options.CopyOnRead = true
+	cache := levelcache.NewCache("levelcache.test.lru.copy_on_read", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	key := "a"
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte("va")}))
+
+	values, _, err := s.cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	values[key][0] = 'x'
+
+	values, valids, err := s.cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("va", string(values[key]))
+	assert.True(valids[key])
+}
+
+func (s *LRUCacheSuite) TestMGetIntoAllocs() {
+	assert := s.Assert()
+
+	keys := []string{"k1", "k2"}
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2")}))
+	values := make(map[string][]byte, len(keys))
+	valids := make(map[string]bool, len(keys))
+
+	// lru keys of no qualifier are not allocated
+	allocs := testing.AllocsPerRun(100, func() {
+		assert.Nil(s.cache.MGetInto(s.ctx, keys, values, valids, true))
+	})
+	assert.Zero(allocs)
+}
+
+func (s *LRUCacheSuite) TestRecompress() {
+	assert := s.Assert()
+
+	// rediscache not configured
+	assert.NotNil(s.cache.Recompress(s.ctx, []string{"k1"}))
+}
+
+func (s *LRUCacheSuite) TestTouch() {
+	assert := s.Assert()
+
+	key := "k1"
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte("v1")}))
+	assert.NotNil(s.cache.Touch(s.ctx, []string{key}, 0))
+	assert.NotNil(s.cache.Touch(s.ctx, []string{key}, -time.Second))
+	assert.Nil(s.cache.Touch(s.ctx, []string{key, "k2"}, time.Second))
+
+	// past the original 500ms timeout
+	time.Sleep(600 * time.Millisecond)
+	values, valids, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal("v1", values[key])
+	assert.True(valids[key])
+	assert.Empty(s.loaderRequestKeys)
+
+	// not added by touch
+	_, _, err = s.get("k2")
+	assert.Nil(err)
+	assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+}
+
+func (s *LRUCacheSuite) TestRegisterRefresh() {
+	assert := s.Assert()
+
+	key := "k1"
+	var loads int32
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		n := atomic.AddInt32(&loads, 1)
+		return map[string][]byte{key: []byte(fmt.Sprintf("v%d", n))}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(s.cache.RegisterRefresh([]string{key}, 100*time.Millisecond))
+	time.Sleep(350 * time.Millisecond)
+	assert.Nil(s.cache.Close())
+
+	// right away and 3 ticks
+	n := atomic.LoadInt32(&loads)
+	assert.True(n >= 3 && n <= 5, "loads %d", n)
+	values, valids, err := s.cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("v%d", n), string(values[key]))
+	assert.True(valids[key])
+
+	// stopped
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(n, atomic.LoadInt32(&loads))
+	assert.NotNil(s.cache.RegisterRefresh([]string{key}, 100*time.Millisecond))
+}
+
+func (s *LRUCacheSuite) TestMGetWithRefresh() {
+	assert := s.Assert()
+	t := s.T()
+
+	k1, k2 := "k1", "k2"
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{k1: []byte("new v1"), k2: []byte("v2")}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+	time.Sleep(s.options.LRUCacheOptions.Timeout + 100*time.Millisecond)
+
+	stale, fresh, err := s.cache.MGetWithRefresh(s.ctx, []string{k1, k2})
+	assert.Nil(err)
+	assert.Equal(map[string]string{k1: "v1"}, convert(stale))
+
+	select {
+	case values := <-fresh:
+		assert.Equal(map[string]string{k1: "new v1", k2: "v2"}, convert(values))
+	case <-time.After(time.Second):
+		assert.Fail("no fresh values")
+	}
+	_, ok := <-fresh
+	assert.False(ok)
+
+	// cached by the refresh
+	s.loaderRequestKeys = nil
+	values, valids, err := s.mget([]string{k1, k2})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "new v1", k2: "v2"}, values)
+	assert.Len(valids, 2)
+
+	t.Run("all valid", func(t *testing.T) {
+		_, fresh, err := s.cache.MGetWithRefresh(s.ctx, []string{k1})
+		assert.Nil(err)
+		_, ok := <-fresh
+		assert.False(ok)
+	})
+}
+
+func (s *LRUCacheSuite) TestMGetInto() {
+	assert := s.Assert()
+
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"a": []byte("va"), "b": []byte("vb")}))
+
+	values := map[string][]byte{"x": []byte("vx")}
+	valids := map[string]bool{"x": true}
+	assert.Nil(s.cache.MGetInto(s.ctx, []string{"a"}, values, valids, false))
+	assert.Equal(map[string][]byte{"a": []byte("va"), "x": []byte("vx")}, values)
+	assert.Equal(map[string]bool{"a": true, "x": true}, valids)
+
+	assert.Nil(s.cache.MGetInto(s.ctx, []string{"b", "none"}, values, valids, true))
+	assert.Equal(map[string][]byte{"b": []byte("vb")}, values)
+	assert.Equal(map[string]bool{"b": true}, valids)
+	assert.Equal([]string{"none"}, s.loaderRequestKeys)
+}
+
 func (s *LRUCacheSuite) TestMDel() {
 	assert := s.Assert()
 	t := s.T()
@@ -433,6 +2249,181 @@ func (s *LRUCacheSuite) TestCompression() {
 	assert.Empty(s.loaderRequestKeys)
 }
 
+func (s *LRUCacheSuite) TestValueSizes() {
+	assert := s.Assert()
+
+	options := s.options
+	options.TrackValueSizes = true
+	cache := levelcache.NewCache("levelcache.test.lru.value_sizes", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	err := s.cache.MSet(s.ctx, map[string][]byte{
+		"a": make([]byte, 10),
+		"b": make([]byte, 64),
+		"c": make([]byte, 100),
+		"d": make([]byte, 2000),
+		"e": make([]byte, 2<<20),
+	})
+	assert.Nil(err)
+
+	counts := make(map[int]int64)
+	for _, bucket := range s.cache.Stats().ValueSizes {
+		counts[bucket.UpperBound] = bucket.Count
+	}
+	assert.Equal(int64(2), counts[64])
+	assert.Equal(int64(1), counts[256])
+	assert.Equal(int64(0), counts[1<<10])
+	assert.Equal(int64(1), counts[4<<10])
+	assert.Equal(int64(1), counts[math.MaxInt32])
+
+	t := s.T()
+	t.Run("disabled", func(t *testing.T) {
+		options.TrackValueSizes = false
+		cache := levelcache.NewCache("levelcache.test.lru.value_sizes.disabled", options)
+		cache.MSet(s.ctx, map[string][]byte{"a": []byte("va")})
+		assert.Nil(cache.Stats().ValueSizes)
+	})
+}
+
+func (s *LRUCacheSuite) TestShards() {
+	assert := s.Assert()
+
+	options := s.options
+	options.LRUCacheOptions.Size = 100
+	options.LRUCacheOptions.LRUShards = 4
+	cache := levelcache.NewCache("levelcache.test.lru.shards", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	kvs := make(map[string][]byte)
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte("value of " + key)
+	}
+	assert.Nil(s.cache.MSet(s.ctx, kvs))
+
+	s.loaderRequestKeys = nil
+	values, valids, err := s.mget(keys)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	for _, key := range keys {
+		assert.Equal("value of "+key, values[key])
+		assert.True(valids[key])
+	}
+
+	assert.Nil(s.cache.MDel(s.ctx, keys[:5]))
+	s.loaderRequestKeys = nil
+	_, _, err = s.mget(keys)
+	assert.Nil(err)
+	assert.ElementsMatch(keys[:5], s.loaderRequestKeys)
+}
+
+func TestNewLRUCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var loaderRequestKeys []string
+	cache := levelcache.NewLRUCache("levelcache.test.new_lru_cache", 10, time.Second, 100*time.Millisecond,
+		func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			loaderRequestKeys = keys
+			return map[string][]byte{"a": []byte("va")}, nil
+		})
+	assert.NotNil(cache)
+
+	values, valids, err := cache.MGet(ctx, []string{"a", "b"})
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b"}, loaderRequestKeys)
+	assert.Equal(map[string][]byte{"a": []byte("va")}, values)
+	assert.Equal(map[string]bool{"a": true}, valids)
+
+	loaderRequestKeys = nil
+	values, _, err = cache.MGet(ctx, []string{"a", "b"})
+	assert.Nil(err)
+	assert.Empty(loaderRequestKeys)
+	assert.Equal(map[string][]byte{"a": []byte("va")}, values)
+
+	assert.Panics(func() {
+		levelcache.NewLRUCache("levelcache.test.new_lru_cache.invalid", 0, time.Second, 0, nil)
+	})
+}
+
 func TestLRUCache(t *testing.T) {
 	suite.Run(t, new(LRUCacheSuite))
 }
+
+func BenchmarkLRUShards(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards_%d", shards), func(b *testing.B) {
+			cache := levelcache.NewCache("levelcache.bench.lru.shards", &levelcache.Options{
+				LRUCacheOptions: &levelcache.LRUCacheOptions{
+					Size:      10000,
+					Timeout:   time.Minute,
+					LRUShards: shards,
+				},
+			})
+
+			ctx := context.Background()
+			kvs := make(map[string][]byte, 1000)
+			keys := make([]string, 0, 1000)
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("k%d", i)
+				keys = append(keys, key)
+				kvs[key] = []byte(key)
+			}
+			cache.MSet(ctx, kvs)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%10 == 0 {
+						cache.MSet(ctx, map[string][]byte{key: kvs[key]})
+					} else {
+						cache.MGet(ctx, []string{key})
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkLRUAllHit(b *testing.B) {
+	cache := levelcache.NewCache("levelcache.bench.lru.all_hit", &levelcache.Options{
+		LRUCacheOptions: &levelcache.LRUCacheOptions{
+			Size:    1000,
+			Timeout: time.Minute,
+		},
+	})
+
+	ctx := context.Background()
+	kvs := make(map[string][]byte, 10)
+	keys := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte("value of " + key)
+	}
+	cache.MSet(ctx, kvs)
+
+	b.Run("MGet", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.MGet(ctx, keys)
+		}
+	})
+
+	b.Run("MGetInto", func(b *testing.B) {
+		values := make(map[string][]byte, len(keys))
+		valids := make(map[string]bool, len(keys))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cache.MGetInto(ctx, keys, values, valids, true)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package levelcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+const (
+	missCounterSize = 10000       // keys counted at most, the least recently missed are forgotten
+	missCounterTTL  = time.Minute // misses further apart do not count as in a row
+)
+
+// missCounter counts loader misses of keys in a row, for MissRetries. keys are qualified by lruKey, so tenants and
+// versions are counted apart.
+type missCounter struct {
+	mu     sync.Mutex
+	counts *ccache.Cache
+}
+
+func newMissCounter() *missCounter {
+	return &missCounter{counts: ccache.New(ccache.Configure().MaxSize(missCounterSize))}
+}
+
+// miss increases misses of key in a row, returns the count
+func (c *missCounter) miss(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 1
+	if item := c.counts.Get(key); item != nil && !item.Expired() {
+		n = item.Value().(int) + 1
+	}
+	c.counts.Set(key, n, missCounterTTL)
+	return n
+}
+
+func (c *missCounter) reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts.Delete(key)
+}
+
+// loaderMissKeys returns keys missed by loader to be cached as misses, the ones missed no more than MissRetries times
+// in a row are left out
+func (cache *cacheImpl) loaderMissKeys(ctx context.Context, keys []string, values map[string][]byte) []string {
+	var missKeys []string
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			if cache.misses != nil {
+				cache.misses.reset(cache.lruKey(ctx, key))
+			}
+			continue
+		}
+		if cache.misses != nil && cache.misses.miss(cache.lruKey(ctx, key)) <= cache.options.MissRetries {
+			continue
+		}
+		missKeys = append(missKeys, key)
+	}
+	return missKeys
+}
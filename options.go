@@ -12,24 +12,260 @@ import (
 type Options struct {
 	LRUCacheOptions   *LRUCacheOptions
 	RedisCacheOptions *RedisCacheOptions
-	Loader            func(ctx context.Context, keys []string) (map[string][]byte, error)
-	CompressionType   CompressionType
+	Loader            LoaderFunc
+	TTLLoader         TTLLoaderFunc // alternative to Loader, for values whose lifetimes are given by the data source
+	// called for keys Loader failed or missed, values from either loader are cached identically
+	FallbackLoader  LoaderFunc
+	CompressionType CompressionType
+	// picks the compression type per entry instead of CompressionType if set, e.g. by key or content. the type is
+	// stored with every entry, so entries of any types read back.
+	CompressionFor func(key string, value []byte) CompressionType
+	// CompressionType applies to redis cache only, lru cache keeps values uncompressed so its hits need no
+	// decompression. set to compress lru cache entries too, trading cpu on every lru hit for memory.
+	LRUCompress bool
+	// zstd format dictionaries(e.g. trained by `zstd --train` on sample values), the first is written with if
+	// CompressionType is zstd, and all of them can be read, so a new dictionary can be rolled out before the old is
+	// removed
+	ZstdDictionaries [][]byte
+	TrackValueSizes  bool // record written value lengths into Stats().ValueSizes
+	// if > 0, a loader returning more keys than this(e.g. the whole table by a bug) fails with
+	// ErrLoaderResultTooLarge, and nothing of it is cached. set TruncateLoaderResult to keep the requested keys of it
+	// instead, as keys not requested are always dropped.
+	LoaderMaxResultKeys  int
+	TruncateLoaderResult bool
+	// by default a panic in Loader is recovered and returned as an error, set to let it crash for debugging
+	DisableLoaderRecover bool
+	Clock                Clock // time source of modify time and soft timeout, default to the real clock
+	// values hit in lru cache share memory with the cached entry, so callers must not modify them in place.
+	// set to return a copy instead, at the cost of an allocation per lru hit.
+	CopyOnRead bool
+	// limits keys per second passed to loaders across all calls of the cache, no limit if nil
+	LoaderRateLimiter *LoaderRateLimiterOptions
+	// if MaxLoaderCostPerCall > 0, keys of a call to be loaded costing more in total by KeyCost are not loaded, and
+	// MGet returns ErrLoaderCostExceeded with their stale values if any. if LoaderCostPartial is set, keys fitting
+	// the limit in the order requested are loaded still.
+	KeyCost              func(key string) int
+	MaxLoaderCostPerCall int
+	LoaderCostPartial    bool
+	// retries loader calls failed with retryable errors, no retry if nil
+	LoaderRetry       *LoaderRetryOptions
+	OnDecompressError DecompressErrorPolicy // treatment of redis entries failed to decompress, default to miss
+	// write a checksum of every redis entry and verify it on read, a mismatch is handled like a decompress error.
+	// entries without a checksum are not verified.
+	VerifyChecksum bool
+	// write the uncompressed length of every redis entry and verify it after decompression, catching truncation. a
+	// mismatch is handled like a decompress error, entries without the length are not verified.
+	VerifyLength bool
+	// if > 0, at most MaxConcurrentMGet MGet calls(MGetInto, MGetStream and MGetDetailed included) run at the same
+	// time, the others wait for their turn or ctx, or fail with ErrTooManyMGet if FailFastMGet is set
+	MaxConcurrentMGet int
+	FailFastMGet      bool
+	// if > 0, loads of the same key within this instance wait for each other by that many striped locks, and the
+	// later ones read what the first loaded from cache. costs a cache lookup of the keys to load after locking.
+	LoaderLockStripes int
+	// routes keys to lru shards(LRUCacheOptions.LRUShards) and loader lock stripes, so one policy spreads keys
+	// everywhere. must be deterministic, default to 64 bit FNV-1a.
+	Hasher func(key string) uint64
+	// derives objects from values for Cache.MGetDecorated(e.g. parsed ones), which are kept as long as the lru cache
+	// value they are derived from, so a value is decorated once per lru entry. objects are shared by callers, which must
+	// not modify them.
+	Decorator func(key string, raw []byte) (interface{}, error)
+	// if set, keys to load are grouped by partition and each group is passed to its own loader call, one after
+	// another, so keys stored together at the source are loaded together. keys of failed groups are reported by a
+	// LoaderKeysError, those of the others are still cached.
+	LoaderPartitioner func(key string) string
+	// if > 0, keys to load of calls arriving within the window are loaded by one loader call, with the ctx of the
+	// first call. every load waits up to the window longer.
+	LoaderCoalesceWindow time.Duration
+	// checks keys of MGet, MSet and MDel(and their variants) besides being non empty. invalid keys are skipped like
+	// empty ones, or fail the whole call with ErrInvalidKey if FailOnInvalidKey is set.
+	KeyValidator     func(key string) error
+	FailOnInvalidKey bool
+	// keys missed by loader are cached as misses only after missing more than MissRetries times in a row(within a
+	// minute between misses), so a flapping source does not get absences cached
+	MissRetries int
+	// called with values loaded(which must not be modified) and keys to be cached as misses after each load,
+	// returns those cached instead, e.g. without error placeholders. what the caller gets is not affected.
+	OnLoaded func(ctx context.Context, results map[string][]byte, missKeys []string) (cacheKVs map[string][]byte,
+		cacheMiss []string)
+	// if > 0, caps every ttl written to lru and redis cache(timeouts, per key ttls and Touch included), guarding
+	// against a misconfigured one. a HardTimeout of 0, never expiring, is capped too. clamping is logged.
+	MaxTTL time.Duration
+	// portion of the budget of Cache.MGetWithBudget for reading lru and redis cache, default to 0.3
+	CacheBudgetShare float64
+	// called with errors of lru cache(LevelLRU) and redis cache(LevelRedis) reads that are logged only, as the keys
+	// fall through to the next level, e.g. redis unavailable while loader serves the call. loader errors are returned
+	// by MGet instead.
+	OnLevelError func(level string, err error)
+	// called with the ttl each key is written to lru cache(LevelLRU) and redis cache(LevelRedis) with by MSet and
+	// loads, after jitter and MaxTTL are applied, e.g. to debug ttls
+	OnSet func(key string, level string, ttl time.Duration)
+	// keys resolved as misses, negatively cached or missed by loader right now, are false in valids of MGet and
+	// MGetInto instead of absent, telling them from keys not resolved(e.g. on errors)
+	ReportNegative bool
+	// which value to return when lru cache value is expired and redis cache value is soft expired too, a valid value
+	// always wins. default to the lru cache one.
+	StaleResolution StaleResolution
 }
 
+// levels of Options.OnLevelError and Options.OnSet
+const (
+	LevelLRU   = "lru"
+	LevelRedis = "redis"
+)
+
+// LRUPolicy eviction policy of lru cache
+type LRUPolicy int
+
+const (
+	// LRUPolicyLRU evicts the least recently used keys
+	LRUPolicyLRU LRUPolicy = iota
+	// LRUPolicyLFU evicts the least frequently used keys, by hits counted while they are cached and halved as more
+	// keys are read. for workloads of steadily hot keys among many read once.
+	LRUPolicyLFU
+	// LRUPolicyFIFO evicts the earliest set keys, reads do not matter
+	LRUPolicyFIFO
+)
+
+// StaleResolution choice between an expired lru cache value and a soft expired redis cache value
+type StaleResolution int
+
+const (
+	// StalePreferLRU returns the lru cache value
+	StalePreferLRU StaleResolution = iota
+	// StalePreferFreshest returns the value modified later, the redis cache one if at the same second
+	StalePreferFreshest
+	// StalePreferRedis returns the redis cache value
+	StalePreferRedis
+)
+
+// DecompressErrorPolicy treatment of a redis entry failed to decompress
+type DecompressErrorPolicy int
+
+const (
+	// DecompressErrorMiss treats the key as a miss, so loader reloads and overwrites it
+	DecompressErrorMiss DecompressErrorPolicy = iota
+	// DecompressErrorReturn returns an error from MGet, keys yet to be looked up are not loaded
+	DecompressErrorReturn
+	// DecompressErrorDelete deletes the entry from redis, then reloads like a miss
+	DecompressErrorDelete
+)
+
 // LRUCacheOptions lru cache options
 type LRUCacheOptions struct {
-	Size        int64 // items count
+	Size        int64 // items count, may be exceeded briefly as ccache evicts in its background goroutine
+	LRUMaxBytes int64 // alternative to Size, evict by approximate bytes(key, value and per item overhead) instead
 	Timeout     time.Duration
-	MissTimeout time.Duration // if zero, do not cache empty result
+	// if zero, do not cache empty result in lru, including misses read from redis, so negative caching is done only
+	// by the shared redis cache
+	MissTimeout time.Duration
+	LRUShards   int // if > 1, Size is divided across that many lru instances to reduce lock contention
+	// random offset in [0, MissTimeoutJitter) added to MissTimeout per key, so misses do not expire all at once
+	MissTimeoutJitter time.Duration
+	// called from ccache's background goroutine when its gc evicts items. ccache reports evictions one item at a
+	// time, so dropped is 1 per call. explicit deletes and overwrites are not reported.
+	OnGC func(dropped int)
+	// keep entries and their last use aside ccache, which Cache.TrimLRU and Cache.DumpLRU require, at the cost of an
+	// extra map entry per item
+	Trimmable bool
+	// expired entries are returned as stale values without calling loader for them, until evicted, for an
+	// expensive loader and tolerable staleness. not allowed with redis cache, whose entries refresh lru cache instead.
+	LRUServeStaleWithoutRefresh bool
+	// if > 0, lru hits of up to that many keys are counted for Cache.HotKeys. once full, counts are halved and the
+	// keys dropping to 0 forgotten, so lately hot keys rank first.
+	HotKeysCapacity int
+	// a write of more keys than Size, e.g. loaded by an MGet batch larger than Size, evicts keys of its own and
+	// everything else, so later reads all miss. it is logged, and skipped by lru cache(keeping what is cached apart
+	// from older entries of its keys, which are deleted) if this is set.
+	SkipOversizedBatch bool
+	// create the lru cache on first use instead of by NewCache, so a cache never used allocates neither its shards
+	// nor their ccache gc goroutines
+	LazyInit bool
+	// which keys to evict once full, default to the least recently used
+	EvictionPolicy LRUPolicy
 }
 
 // RedisCacheOptions redis cache options
 type RedisCacheOptions struct {
-	Client      *redis.Client
-	Prefix      string // real key is prefix_${key}
-	HardTimeout time.Duration
-	SoftTimeout time.Duration // at least ms precision
-	MissTimeout time.Duration
+	Client        *redis.Client
+	ContextClient RedisClient // used instead of Client if set, e.g. an adapter of a context aware client
+	Prefix        string      // real key is prefix_${key}, or prefix:v${version}_${key} if PrefixVersion > 0
+	// returns prefix of key used instead of Prefix unless empty, e.g. by tenant in ctx, so one cache serves many
+	// prefixes. lru keys are qualified by it too, and tags by PrefixFunc(ctx, tag). ctx is nil if the caller passed
+	// nil.
+	PrefixFunc func(ctx context.Context, key string) string
+	// builds the real key of key from its prefix(with the version if PrefixVersion > 0) instead of prefix_${key},
+	// e.g. for hash tags or splitting a tenant off key. must be stable across processes sharing the cache.
+	RedisKeyBuilder func(prefix, key string) string
+	// bumped by Cache.BumpVersion to make all keys of older versions unreachable, they expire by their ttl.
+	// the version bumped is kept in redis key prefix:version, other processes sharing the prefix pick it up by
+	// VersionSyncInterval or need it configured.
+	PrefixVersion int64
+	HardTimeout   time.Duration
+	SoftTimeout   time.Duration // at least ms precision
+	MissTimeout   time.Duration
+	// replaces the soft timeout check of redis entries if set, e.g. for freshness by business hours or by a version in
+	// the value. data is as stored, Raw may be compressed. CacheControl.MaxStale still counts from the soft timeout.
+	IsFresh func(key string, data *Data, now time.Time) bool
+	// reads the version kept in redis at NewCache and then every interval, using it if greater than PrefixVersion
+	VersionSyncInterval time.Duration
+	// random offset in [0, MissTimeoutJitter) added to MissTimeout per key, so misses do not expire all at once
+	MissTimeoutJitter time.Duration
+	// two phase negative caching, replaces MissTimeout if MissHardTimeout is set.
+	// a miss is served until MissSoftTimeout(seconds precision), then loader is called again, and the entry is kept
+	// until MissHardTimeout.
+	MissSoftTimeout time.Duration
+	MissHardTimeout time.Duration
+	// for migrating from keys of another prefix, keys missed in redis are read again from LegacyKeyFunc(key) as is,
+	// and a hit is copied to the real key with HardTimeout. the legacy entry must be in the same format, "" for no
+	// legacy key.
+	LegacyKeyFunc func(key string) string
+	// redis gets and sets of cache entries taking longer are logged with key count and elapsed time, 0 to disable
+	SlowRedisThreshold time.Duration
+	// write redis cache by MSet and loads in background goroutines, lru cache is still written synchronously and
+	// errors are logged only. beyond MaxAsyncWrites(default 64) writes in flight, writes are synchronous again.
+	// Cache.Close waits for writes in flight.
+	AsyncWrite     bool
+	MaxAsyncWrites int
+	// MDel writes a miss for MissTimeout instead of deleting redis entries, so other instances reading redis see
+	// the key deleted rather than loading it again. lru caches of other instances still hold it until they expire.
+	TombstoneOnDel bool
+	// evict lru entries of keys of Prefix changed or expired in redis, by other instances included, by a keyspace
+	// notification subscriber running until Cache.Close, not with RedisKeyBuilder or PrefixFunc. redis must have
+	// notify-keyspace-events enabled(e.g. "Kg$x"), and the client must implement RedisSubscriber. writes of this
+	// instance evict its own entries too, which are read from redis again once.
+	EnableInvalidation bool
+	// values loaded and misses of loader are cached to lru cache only, e.g. by a read replica process which must not
+	// churn a shared redis. redis hits are still copied to lru cache, and MSet and the like still write redis.
+	SkipRedisWrite bool
+	// values loaded and misses of loader are written by a lua script only to keys absent or modified before the load
+	// started(seconds precision), so what another instance writes meanwhile is not overwritten, and the lru entry of
+	// a key not written is dropped to read it from redis. requires lua scripting.
+	FillIfNewer bool
+	// if set, values and misses of keys it rejects are not written to redis by MSet, MSetWithMeta and loads, e.g.
+	// ephemeral keys served by lru cache only. MSetNX and MSetXX write keys it rejects to neither level.
+	RedisWriteFilter func(key string) bool
+	// if > 0, redis writes are split into pipelines of at most about this many bytes of keys and values, e.g. for a
+	// proxy rejecting larger ones. an entry over it is written by a pipeline of its own.
+	MaxPipelineBytes int
+}
+
+// LoaderRateLimiterOptions token bucket limiting keys passed to loaders
+type LoaderRateLimiterOptions struct {
+	Rate  float64 // keys per second
+	Burst int     // max keys at once
+	// wait at most MaxWait for the limit, keys still over the limit are not loaded and MGet returns
+	// ErrLoaderRateLimited, with their stale values if any. 0 for not waiting.
+	MaxWait time.Duration
+}
+
+// LoaderRetryOptions retries of a loader call, by the real clock since it sleeps
+type LoaderRetryOptions struct {
+	MaxAttempts int // attempts at most, the first included
+	// the n-th retry waits BaseBackoff*2^(n-1) plus a random offset in [0, Jitter), or until ctx is done
+	BaseBackoff time.Duration
+	Jitter      time.Duration
+	IsRetryable func(err error) bool // errors not retryable fail right away
 }
 
 func (options *Options) isValid() error {
@@ -41,6 +277,85 @@ func (options *Options) isValid() error {
 		return errs.New("both lrucache and rediscache options nil")
 	}
 
+	if options.Loader != nil && options.TTLLoader != nil {
+		return errs.New("both loader and ttl loader set")
+	}
+
+	if options.FallbackLoader != nil && options.Loader == nil && options.TTLLoader == nil {
+		return errs.New("fallback loader without loader")
+	}
+
+	for _, dict := range options.ZstdDictionaries {
+		if _, err := zstdDictID(dict); err != nil {
+			return errs.Trace(err)
+		}
+	}
+
+	if limiter := options.LoaderRateLimiter; limiter != nil &&
+		(limiter.Rate <= 0 || limiter.Burst <= 0 || limiter.MaxWait < 0) {
+		return errs.New("loader rate limiter invalid")
+	}
+	if options.MaxLoaderCostPerCall < 0 || (options.MaxLoaderCostPerCall > 0 && options.KeyCost == nil) {
+		return errs.New("max loader cost per call invalid")
+	}
+	if retry := options.LoaderRetry; retry != nil &&
+		(retry.MaxAttempts <= 0 || retry.BaseBackoff < 0 || retry.Jitter < 0 || retry.IsRetryable == nil) {
+		return errs.New("loader retry invalid")
+	}
+
+	if options.MaxConcurrentMGet < 0 {
+		return errs.New("max concurrent mget invalid")
+	}
+
+	if options.LoaderLockStripes < 0 {
+		return errs.New("loader lock stripes invalid")
+	}
+
+	if options.MissRetries < 0 {
+		return errs.New("miss retries invalid")
+	}
+
+	if options.LoaderMaxResultKeys < 0 {
+		return errs.New("loader max result keys invalid")
+	}
+
+	if options.CacheBudgetShare < 0 || options.CacheBudgetShare > 1 {
+		return errs.New("cache budget share invalid")
+	}
+
+	if options.MaxTTL < 0 {
+		return errs.New("max ttl invalid")
+	}
+
+	if options.LoaderCoalesceWindow < 0 {
+		return errs.New("loader coalesce window invalid")
+	}
+	if options.LRUCacheOptions != nil && options.LRUCacheOptions.LRUServeStaleWithoutRefresh &&
+		options.RedisCacheOptions != nil {
+		return errs.New("lrucache serve stale without refresh conflicts with rediscache")
+	}
+
+	if options.RedisCacheOptions != nil && options.RedisCacheOptions.EnableInvalidation && options.LRUCacheOptions == nil {
+		return errs.New("invalidation requires lrucache")
+	}
+	if options.RedisCacheOptions != nil && options.RedisCacheOptions.SkipRedisWrite && options.LRUCacheOptions == nil {
+		return errs.New("skip redis write requires lrucache")
+	}
+
+	// a batch is loaded with the ctx of one call, which is of one tenant only
+	if options.LoaderCoalesceWindow > 0 && options.RedisCacheOptions != nil &&
+		options.RedisCacheOptions.PrefixFunc != nil {
+		return errs.New("loader coalesce window conflicts with prefix func")
+	}
+
+	if options.StaleResolution < StalePreferLRU || options.StaleResolution > StalePreferRedis {
+		return errs.New("stale resolution invalid")
+	}
+
+	if options.OnDecompressError < DecompressErrorMiss || options.OnDecompressError > DecompressErrorDelete {
+		return errs.New("decompress error policy invalid")
+	}
+
 	if err := options.LRUCacheOptions.isValid(); err != nil {
 		return errs.Trace(err)
 	}
@@ -56,12 +371,24 @@ func (options *LRUCacheOptions) isValid() error {
 		return nil
 	}
 
-	if options.Size <= 0 {
+	if options.LRUMaxBytes < 0 || (options.Size <= 0) == (options.LRUMaxBytes == 0) {
 		return errs.New("lrucache size invalid")
 	}
+	if options.LRUShards < 0 || (options.Size > 0 && int64(options.LRUShards) > options.Size) {
+		return errs.New("lrucache shards invalid")
+	}
 	if options.MissTimeout != 0 && options.MissTimeout < time.Millisecond {
 		return errs.New("lrucache miss timeout at least 1ms")
 	}
+	if options.MissTimeoutJitter < 0 {
+		return errs.New("lrucache miss timeout jitter invalid")
+	}
+	if options.HotKeysCapacity < 0 {
+		return errs.New("lrucache hot keys capacity invalid")
+	}
+	if options.EvictionPolicy < LRUPolicyLRU || options.EvictionPolicy > LRUPolicyFIFO {
+		return errs.New("lrucache eviction policy invalid")
+	}
 	if options.Timeout <= 0 || (options.MissTimeout != 0 && options.Timeout <= options.MissTimeout) {
 		return errs.New("lrucache timeout invalid")
 	}
@@ -73,14 +400,44 @@ func (options *RedisCacheOptions) isValid() error {
 		return nil
 	}
 
-	if options.Client == nil {
+	if (options.Client == nil) == (options.ContextClient == nil) {
 		return errs.New("redis client invalid")
 	}
 	if options.Prefix == "" {
 		return errs.New("rediscache prefix invalid")
 	}
+	if options.PrefixVersion < 0 {
+		return errs.New("rediscache prefix version invalid")
+	}
+	if options.VersionSyncInterval < 0 {
+		return errs.New("rediscache version sync interval invalid")
+	}
 	if options.MissTimeout != 0 && options.MissTimeout < time.Millisecond {
 		return errs.New("rediscache miss timeout at least 1ms")
 	}
+	if options.MissTimeoutJitter < 0 {
+		return errs.New("rediscache miss timeout jitter invalid")
+	}
+	if options.MissHardTimeout != 0 &&
+		(options.MissSoftTimeout <= 0 || options.MissSoftTimeout > options.MissHardTimeout) {
+		return errs.New("rediscache miss soft/hard timeout invalid")
+	}
+	if options.MaxAsyncWrites < 0 {
+		return errs.New("rediscache max async writes invalid")
+	}
+	if options.MaxPipelineBytes < 0 {
+		return errs.New("max pipeline bytes invalid")
+	}
+	if options.TombstoneOnDel && options.MissTimeout == 0 {
+		return errs.New("rediscache tombstone requires miss timeout")
+	}
+	if options.EnableInvalidation && (options.RedisKeyBuilder != nil || options.PrefixFunc != nil) {
+		return errs.New("rediscache invalidation requires the default key format")
+	}
+	if options.EnableInvalidation && options.ContextClient != nil {
+		if _, ok := options.ContextClient.(RedisSubscriber); !ok {
+			return errs.New("rediscache invalidation requires a redis subscriber")
+		}
+	}
 	return nil
 }
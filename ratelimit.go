@@ -0,0 +1,150 @@
+package levelcache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLoaderRateLimited returned by MGet if some keys are not loaded because of Options.LoaderRateLimiter
+	ErrLoaderRateLimited = errors.New("loader rate limited")
+
+	// ErrLoaderCostExceeded returned by MGet if some keys are not loaded because of Options.MaxLoaderCostPerCall
+	ErrLoaderCostExceeded = errors.New("loader cost exceeded")
+
+	// ErrTooManyMGet returned by MGet beyond Options.MaxConcurrentMGet if Options.FailFastMGet is set
+	ErrTooManyMGet = errors.New("too many concurrent mget")
+)
+
+// rateLimiter token bucket of keys, by the real clock since it sleeps
+type rateLimiter struct {
+	options *LoaderRateLimiterOptions
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(options *LoaderRateLimiterOptions) *rateLimiter {
+	return &rateLimiter{
+		options: options,
+		tokens:  float64(options.Burst),
+		last:    time.Now(),
+	}
+}
+
+// take takes up to n tokens, waiting at most MaxWait, returns tokens taken
+func (l *rateLimiter) take(ctx context.Context, n int) int {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(float64(l.options.Burst), l.tokens+now.Sub(l.last).Seconds()*l.options.Rate)
+	l.last = now
+
+	// tokens may go negative, later callers wait for those reserved here
+	available := math.Floor(l.tokens + l.options.MaxWait.Seconds()*l.options.Rate)
+	taken := int(math.Max(0, math.Min(float64(n), available)))
+	wait := time.Duration((float64(taken) - l.tokens) / l.options.Rate * float64(time.Second))
+	l.tokens -= float64(taken)
+	l.mu.Unlock()
+
+	if taken == 0 || wait <= 0 {
+		return taken
+	}
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return taken
+	case <-done:
+		// give the reservation back
+		l.mu.Lock()
+		l.tokens += float64(taken)
+		l.mu.Unlock()
+		return 0
+	}
+}
+
+// limitLoaderKeys returns keys allowed to be loaded, the leading ones of keys
+func (cache *cacheImpl) limitLoaderKeys(ctx context.Context, keys []string) ([]string, error) {
+	if cache.limiter == nil {
+		return keys, nil
+	}
+
+	taken := cache.limiter.take(ctx, len(keys))
+	if taken == len(keys) {
+		return keys, nil
+	}
+	return keys[:taken], ErrLoaderRateLimited
+}
+
+// limitLoaderCost returns keys within Options.MaxLoaderCostPerCall, none of keys over it unless LoaderCostPartial
+func (cache *cacheImpl) limitLoaderCost(keys []string) ([]string, error) {
+	limit := cache.options.MaxLoaderCostPerCall
+	if limit == 0 {
+		return keys, nil
+	}
+
+	costs := make([]int, len(keys))
+	total := 0
+	for i, key := range keys {
+		costs[i] = cache.options.KeyCost(key)
+		total += costs[i]
+	}
+	if total <= limit {
+		return keys, nil
+	}
+	if !cache.options.LoaderCostPartial {
+		return nil, ErrLoaderCostExceeded
+	}
+
+	var allowed []string
+	total = 0
+	for i, key := range keys {
+		if total+costs[i] <= limit {
+			allowed = append(allowed, key)
+			total += costs[i]
+		}
+	}
+	return allowed, ErrLoaderCostExceeded
+}
+
+// acquireMGet takes a slot of MaxConcurrentMGet, releaseMGet must be called after if nil is returned
+func (cache *cacheImpl) acquireMGet(ctx context.Context) error {
+	if cache.mGetSlots == nil {
+		return nil
+	}
+
+	select {
+	case cache.mGetSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	if cache.options.FailFastMGet {
+		return ErrTooManyMGet
+	}
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case cache.mGetSlots <- struct{}{}:
+		return nil
+	case <-done:
+		return ctx.Err()
+	}
+}
+
+func (cache *cacheImpl) releaseMGet() {
+	if cache.mGetSlots != nil {
+		<-cache.mGetSlots
+	}
+}
@@ -0,0 +1,284 @@
+package levelcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisClient redis commands used by levelcache.
+// the ctx of the cache call is passed to every command, so a context aware client(e.g. go-redis v8/v9) can be
+// adapted by implementing this interface and set as RedisCacheOptions.ContextClient. batch commands are expected to
+// be sent in one pipeline.
+type RedisClient interface {
+	// Get gets keys, results[i] is of keys[i]. error is the first command error, missing keys are not errors.
+	Get(ctx context.Context, keys []string) ([]RedisResult, error)
+
+	// Set sets entries
+	Set(ctx context.Context, entries []RedisEntry) error
+
+	Del(ctx context.Context, keys []string) error
+
+	// Exists checks keys, exists[i] is of keys[i]
+	Exists(ctx context.Context, keys []string) ([]bool, error)
+
+	// PTTL gets remaining ttls of keys, ttls[i] is of keys[i], not positive if key does not exist or has no ttl
+	PTTL(ctx context.Context, keys []string) ([]time.Duration, error)
+
+	// PExpire sets ttl of existing keys, missing keys are skipped
+	PExpire(ctx context.Context, keys []string, ttl time.Duration) error
+
+	// SAdd adds members to sets by key and resets their ttls, the sets never expire if ttl is not positive
+	SAdd(ctx context.Context, sets map[string][]string, ttl time.Duration) error
+
+	// SPopAll removes all members of set key at once and returns them, the set is deleted
+	SPopAll(ctx context.Context, key string) ([]string, error)
+
+	Ping(ctx context.Context) error
+
+	// Eval runs a lua script, the reply is as returned by go-redis, e.g. int64 for integers and []interface{} for
+	// arrays
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisSubscriber implemented by a RedisClient which can subscribe to channels, required by
+// RedisCacheOptions.EnableInvalidation. the go-redis v6 Client implements it.
+type RedisSubscriber interface {
+	// PSubscribe subscribes to channels matching the redis glob pattern, messages is closed once ctx is done or the
+	// subscription is lost
+	PSubscribe(ctx context.Context, pattern string) (messages <-chan RedisMessage, err error)
+}
+
+// RedisConditionalSetter implemented by a RedisClient which can set keys conditionally, required by Cache.MSetNX and
+// Cache.MSetXX. the go-redis v6 Client implements it.
+type RedisConditionalSetter interface {
+	// SetNX sets entries of keys not existing, written[i] is of entries[i]
+	SetNX(ctx context.Context, entries []RedisEntry) (written []bool, err error)
+
+	// SetXX sets entries of keys existing, written[i] is of entries[i]
+	SetXX(ctx context.Context, entries []RedisEntry) (written []bool, err error)
+}
+
+// RedisMessage a message published to Channel
+type RedisMessage struct {
+	Channel string
+	Payload string
+}
+
+// RedisResult result of a redis get, Found is false if key does not exist or Err is not nil
+type RedisResult struct {
+	Value []byte
+	Found bool
+	Err   error
+}
+
+// RedisEntry a redis key value with ttl
+type RedisEntry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// redisV6Client adapts go-redis v6 client, which takes no ctx
+type redisV6Client struct {
+	client *redis.Client
+}
+
+func (c *redisV6Client) Get(ctx context.Context, keys []string) ([]RedisResult, error) {
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.StringCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipe.Get(key))
+	}
+	// Exec only reports the first failed command, the results of the others are still used
+	_, _ = pipe.Exec()
+
+	var firstErr error
+	results := make([]RedisResult, len(keys))
+	for i, cmd := range cmds {
+		v, err := cmd.Bytes()
+		switch {
+		case err == nil:
+			results[i] = RedisResult{Value: v, Found: true}
+		case err == redis.Nil:
+		default:
+			results[i] = RedisResult{Err: err}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return results, firstErr
+}
+
+func (c *redisV6Client) Set(ctx context.Context, entries []RedisEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+	for _, entry := range entries {
+		pipe.Set(entry.Key, entry.Value, entry.TTL)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *redisV6Client) SetNX(ctx context.Context, entries []RedisEntry) ([]bool, error) {
+	return c.setIf(entries, redis.Pipeliner.SetNX)
+}
+
+func (c *redisV6Client) SetXX(ctx context.Context, entries []RedisEntry) ([]bool, error) {
+	return c.setIf(entries, redis.Pipeliner.SetXX)
+}
+
+func (c *redisV6Client) setIf(entries []RedisEntry,
+	set func(pipe redis.Pipeliner, key string, value interface{}, ttl time.Duration) *redis.BoolCmd) ([]bool, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.BoolCmd, 0, len(entries))
+	for _, entry := range entries {
+		cmds = append(cmds, set(pipe, entry.Key, entry.Value, entry.TTL))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	written := make([]bool, len(entries))
+	for i, cmd := range cmds {
+		written[i] = cmd.Val()
+	}
+	return written, nil
+}
+
+func (c *redisV6Client) Del(ctx context.Context, keys []string) error {
+	return c.client.Del(keys...).Err()
+}
+
+func (c *redisV6Client) Exists(ctx context.Context, keys []string) ([]bool, error) {
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.IntCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipe.Exists(key))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	exists := make([]bool, len(keys))
+	for i, cmd := range cmds {
+		exists[i] = cmd.Val() > 0
+	}
+	return exists, nil
+}
+
+func (c *redisV6Client) PTTL(ctx context.Context, keys []string) ([]time.Duration, error) {
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.DurationCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipe.PTTL(key))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	ttls := make([]time.Duration, len(keys))
+	for i, cmd := range cmds {
+		ttls[i] = cmd.Val()
+	}
+	return ttls, nil
+}
+
+func (c *redisV6Client) PExpire(ctx context.Context, keys []string, ttl time.Duration) error {
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+	for _, key := range keys {
+		pipe.PExpire(key, ttl)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *redisV6Client) SAdd(ctx context.Context, sets map[string][]string, ttl time.Duration) error {
+	pipe := c.client.Pipeline()
+	defer pipe.Close()
+	for key, members := range sets {
+		args := make([]interface{}, 0, len(members))
+		for _, member := range members {
+			args = append(args, member)
+		}
+		pipe.SAdd(key, args...)
+		// EXPIRE of 0 deletes the key
+		if ttl > 0 {
+			pipe.PExpire(key, ttl)
+		} else {
+			pipe.Persist(key)
+		}
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *redisV6Client) SPopAll(ctx context.Context, key string) ([]string, error) {
+	pipe := c.client.TxPipeline()
+	defer pipe.Close()
+	members := pipe.SMembers(key)
+	pipe.Del(key)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	return members.Val(), nil
+}
+
+func (c *redisV6Client) Ping(ctx context.Context) error {
+	return c.client.Ping().Err()
+}
+
+func (c *redisV6Client) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{},
+	error) {
+	return c.client.Eval(script, keys, args...).Result()
+}
+
+func (c *redisV6Client) PSubscribe(ctx context.Context, pattern string) (<-chan RedisMessage, error) {
+	pubsub := c.client.PSubscribe(pattern)
+	// the confirmation, so a failed subscription is returned
+	if _, err := pubsub.Receive(); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+
+	messages := make(chan RedisMessage)
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+		ch := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case messages <- RedisMessage{Channel: msg.Channel, Payload: msg.Payload}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
@@ -1,14 +1,21 @@
 package levelcache_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"testing"
 	"time"
 
 	"github.com/agiledragon/gomonkey"
 	"github.com/ericuni/levelcache"
 	"github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -60,6 +67,32 @@ func (s *RedisCacheSuite) SetupTest() {
 func (s *RedisCacheSuite) TearDownTest() {
 }
 
+func (s *RedisCacheSuite) TestMaxStale() {
+	assert := s.Assert()
+
+	clock := newFakeClock()
+	options := *s.options
+	options.Clock = clock
+	cache := levelcache.NewCache("levelcache.test.redis.max_stale", &options)
+
+	key := s.keys[0]
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+	clock.Add(options.RedisCacheOptions.SoftTimeout + time.Second)
+
+	ctx := levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{MaxStale: 2 * time.Second})
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal("v", string(values[key]))
+	assert.False(valids[key])
+
+	clock.Add(2 * time.Second)
+	_, _, err = cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+}
+
 func (s *RedisCacheSuite) TestMDel() {
 	assert := s.Assert()
 	t := s.T()
@@ -112,6 +145,124 @@ func (s *RedisCacheSuite) TestMDel() {
 	})
 }
 
+func (s *RedisCacheSuite) TestMDelAfterAsyncWrite() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.AsyncWrite = true
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.redis.mdel_after_async_write", &options)
+
+	// an async write scheduled before the delete is never written after it
+	key := s.keys[0]
+	for i := 0; i < 100; i++ {
+		assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+		assert.Nil(cache.MDel(s.ctx, []string{key}))
+	}
+	assert.Nil(cache.Close())
+	n, err := s.client.Exists(redisOptions.Prefix + "_" + key).Result()
+	assert.Nil(err)
+	assert.Zero(n)
+}
+
+type blockingSetClient struct {
+	levelcache.RedisClient
+	block func(entries []levelcache.RedisEntry)
+}
+
+func (c *blockingSetClient) Set(ctx context.Context, entries []levelcache.RedisEntry) error {
+	c.block(entries)
+	return c.RedisClient.Set(ctx, entries)
+}
+
+func (s *RedisCacheSuite) TestAsyncWriteInFlight() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	client := &blockingSetClient{RedisClient: levelcache.NewRedisV6Client(s.client)}
+	client.block = func(entries []levelcache.RedisEntry) {
+		if entries[0].Key == s.options.RedisCacheOptions.Prefix+"_"+key {
+			close(blocked)
+			<-release
+		}
+	}
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = nil
+	redisOptions.ContextClient = client
+	redisOptions.AsyncWrite = true
+	options.RedisCacheOptions = &redisOptions
+	// stripes as async writes used to lock
+	options.LoaderLockStripes = 1024
+	cache := levelcache.NewCache("levelcache.test.redis.async_write_in_flight", &options)
+
+	stripe := levelcache.LoaderLockStripe(cache, key)
+	other := ""
+	for i := 0; other == ""; i++ {
+		if k := fmt.Sprintf("other%d", i); k != key {
+			if levelcache.LoaderLockStripe(cache, k) == stripe {
+				other = k
+			}
+		}
+	}
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+	<-blocked
+
+	// other keys are not held up by the write in flight, the key is until it is written
+	assert.Nil(cache.MDel(s.ctx, []string{other}))
+	deleted := make(chan struct{})
+	go func() {
+		defer close(deleted)
+		assert.Nil(cache.MDel(s.ctx, []string{key}))
+	}()
+	select {
+	case <-deleted:
+		assert.Fail("deleted while written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-deleted
+
+	assert.Nil(cache.Close())
+	n, err := s.client.Exists(redisOptions.Prefix + "_" + key).Result()
+	assert.Nil(err)
+	assert.Zero(n)
+}
+
+func (s *RedisCacheSuite) TestPing() {
+	assert := s.Assert()
+
+	assert.Nil(s.cache.Ping(s.ctx))
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.redis.ping", &options)
+	assert.NotNil(cache.Ping(s.ctx))
+}
+
+func (s *RedisCacheSuite) TestNameAndOptions() {
+	assert := s.Assert()
+
+	assert.Equal("levelcache.test.redis", s.cache.Name())
+
+	options := s.cache.Options()
+	assert.Nil(options.LRUCacheOptions)
+	assert.Nil(options.RedisCacheOptions.Client)
+	assert.Equal(s.options.RedisCacheOptions.Prefix, options.RedisCacheOptions.Prefix)
+	assert.Equal(s.options.RedisCacheOptions.SoftTimeout, options.RedisCacheOptions.SoftTimeout)
+
+	// a copy, the cache is not affected
+	options.RedisCacheOptions.Prefix = "other"
+	assert.Equal("levelcache.test.redis", s.options.RedisCacheOptions.Prefix)
+	assert.NotNil(s.options.RedisCacheOptions.Client)
+}
+
 func (s *RedisCacheSuite) TestEmpty() {
 	assert := s.Assert()
 	t := s.T()
@@ -130,6 +281,20 @@ func (s *RedisCacheSuite) TestEmpty() {
 		assert.Nil(valids)
 	})
 
+	t.Run("empty string key", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.mget([]string{"", s.keys[0]})
+		assert.Equal([]string{s.keys[0]}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+
+		assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"": []byte("v")}))
+		n, err := s.client.Exists(s.options.RedisCacheOptions.Prefix + "_").Result()
+		assert.Nil(err)
+		assert.Equal(int64(0), n)
+	})
+
 	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte, error) {
 		return nil, errors.New("loader error")
 	})
@@ -241,6 +406,80 @@ func (s *RedisCacheSuite) TestHitLoader() {
 	})
 }
 
+func (s *RedisCacheSuite) TestClock() {
+	assert := s.Assert()
+	t := s.T()
+
+	clock := newFakeClock()
+	options := s.options
+	options.Clock = clock
+	cache := levelcache.NewCache("levelcache.test.redis.clock", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	key := s.keys[0]
+	value := "value"
+
+	loaderErr := false
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		if loaderErr {
+			return nil, errors.New("loader error")
+		}
+		return map[string][]byte{key: []byte(value)}, nil
+	})
+	defer patches.Reset()
+
+	t.Run("hit loader", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(value, values[key])
+		assert.True(valids[key])
+	})
+
+	t.Run("within soft timeout", func(t *testing.T) {
+		clock.Add(options.RedisCacheOptions.SoftTimeout - time.Second)
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(value, values[key])
+		assert.True(valids[key])
+	})
+
+	t.Run("soft timeout and loader error", func(t *testing.T) {
+		clock.Add(2 * time.Second)
+		loaderErr = true
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.NotNil(err)
+		assert.Equal(value, values[key])
+		assert.False(valids[key])
+	})
+
+	t.Run("soft timeout and hit loader agagin", func(t *testing.T) {
+		loaderErr = false
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(value, values[key])
+		assert.True(valids[key])
+	})
+
+	t.Run("refreshed", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		_, valids, err := s.get(key)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.True(valids[key])
+	})
+}
+
 func (s *RedisCacheSuite) TestMiss() {
 	assert := s.Assert()
 	t := s.T()
@@ -281,6 +520,62 @@ func (s *RedisCacheSuite) TestMiss() {
 	})
 }
 
+func (s *RedisCacheSuite) TestMissSoftTimeout() {
+	assert := s.Assert()
+	t := s.T()
+
+	clock := newFakeClock()
+	options := s.options
+	options.Clock = clock
+	options.RedisCacheOptions.MissSoftTimeout = time.Second
+	options.RedisCacheOptions.MissHardTimeout = 3 * time.Second
+	cache := levelcache.NewCache("levelcache.test.redis.miss_soft_timeout", options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	key := s.keys[0]
+	redisKey := options.RedisCacheOptions.Prefix + "_" + key
+
+	t.Run("loader miss", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+
+		ttl, err := s.client.PTTL(redisKey).Result()
+		assert.Nil(err)
+		assert.True(ttl > options.RedisCacheOptions.MissSoftTimeout)
+	})
+
+	t.Run("within miss soft timeout", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+	})
+
+	t.Run("miss soft timeout and loader again", func(t *testing.T) {
+		clock.Add(2 * time.Second)
+
+		bs, err := s.client.Get(redisKey).Bytes()
+		assert.Nil(err)
+		var data levelcache.Data
+		assert.Nil(proto.Unmarshal(bs, &data))
+		assert.True(data.Miss)
+
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Empty(values)
+		assert.Empty(valids)
+	})
+}
+
 func (s *RedisCacheSuite) TestCompression() {
 	assert := s.Assert()
 
@@ -318,6 +613,616 @@ func (s *RedisCacheSuite) TestCompression() {
 	assert.Empty(s.loaderRequestKeys)
 }
 
+func (s *RedisCacheSuite) TestMaxStaleness() {
+	assert := s.Assert()
+
+	clock := newFakeClock()
+	options := *s.options
+	options.Clock = clock
+	cache := levelcache.NewCache("levelcache.test.redis.max_staleness", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	key := s.keys[0]
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v")}))
+	clock.Add(options.RedisCacheOptions.SoftTimeout + time.Second)
+
+	// modified 11s ago
+	ctx := levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{MaxStaleness: 15 * time.Second})
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal("v", string(values[key]))
+	assert.False(valids[key])
+
+	ctx = levelcache.WithCacheControl(s.ctx, levelcache.CacheControl{MaxStaleness: 5 * time.Second})
+	_, _, err = cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+}
+
+func (s *RedisCacheSuite) TestIsFresh() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	clock := newFakeClock()
+	options := *s.options
+	options.Clock = clock
+	redisOptions := *options.RedisCacheOptions
+	// k1 never goes stale
+	redisOptions.IsFresh = func(key string, data *levelcache.Data, now time.Time) bool {
+		return key == k1 || now.Sub(time.Unix(data.ModifyTime, 0)) <= redisOptions.SoftTimeout
+	}
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.redis.is_fresh", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1"), k2: []byte("v2")}))
+	clock.Add(redisOptions.SoftTimeout + time.Second)
+
+	s.loaderRequestKeys = nil
+	values, valids, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal([]string{k2}, s.loaderRequestKeys)
+	assert.Equal(map[string]string{k1: "v1", k2: "v2"}, convert(values))
+	assert.Equal(map[string]bool{k1: true}, valids)
+}
+
+func (s *RedisCacheSuite) TestInspectRedis() {
+	assert := s.Assert()
+
+	clock := newFakeClock()
+	options := *s.options
+	options.Clock = clock
+	options.CompressionType = levelcache.CompressionType_Snappy
+	cache := levelcache.NewCache("levelcache.test.redis.inspect", &options)
+	assert.NotNil(cache)
+	s.cache = cache
+
+	k1, k2 := s.keys[0], s.keys[1]
+	value := "bigvalue_xxxxxxxxxxxx_bigvalue"
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{k1: []byte(value)}))
+	modifyTime := clock.Now().Unix()
+
+	// soft timeout does not matter
+	clock.Add(options.RedisCacheOptions.SoftTimeout + time.Second)
+	data, err := cache.InspectRedis(s.ctx, k1)
+	assert.Nil(err)
+	assert.Equal(modifyTime, data.ModifyTime)
+	assert.Equal(levelcache.CompressionType_Snappy, data.CompressionType)
+	assert.NotEqual(value, string(data.Raw))
+	assert.False(data.Miss)
+
+	_, err = cache.InspectRedis(s.ctx, k2)
+	assert.NotNil(err)
+
+	_, _, err = cache.MGet(s.ctx, []string{k2})
+	assert.Nil(err)
+	_, err = cache.InspectRedis(s.ctx, k2)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "negatively cached")
+}
+
+func (s *RedisCacheSuite) TestCompressionFor() {
+	assert := s.Assert()
+
+	options := *s.options
+	options.CompressionFor = func(key string, value []byte) levelcache.CompressionType {
+		if key == s.keys[0] {
+			return levelcache.CompressionType_Snappy
+		}
+		return levelcache.CompressionType_Zstd
+	}
+	cache := levelcache.NewCache("levelcache.test.redis.compression_for", &options)
+
+	kvs := map[string]string{
+		s.keys[0]: "text value text value text value text value",
+		s.keys[1]: "binary value binary value binary value",
+	}
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{s.keys[0]: []byte(kvs[s.keys[0]]),
+		s.keys[1]: []byte(kvs[s.keys[1]])}))
+
+	entries, _, err := cache.MGetRaw(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(levelcache.CompressionType_Snappy, entries[s.keys[0]].CompressionType)
+	assert.Equal(levelcache.CompressionType_Zstd, entries[s.keys[1]].CompressionType)
+
+	// read by the type stored, not by CompressionFor
+	values, valids, err := s.cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(kvs, convert(values))
+	assert.Len(valids, 2)
+}
+
+func (s *RedisCacheSuite) TestIncompressible() {
+	assert := s.Assert()
+
+	random := make([]byte, 1024)
+	_, _ = rand.Read(random)
+	kvs := map[string][]byte{s.keys[0]: random, s.keys[1]: bytes.Repeat([]byte("compressible "), 100)}
+	for _, compressionType := range []levelcache.CompressionType{levelcache.CompressionType_Snappy,
+		levelcache.CompressionType_Zstd} {
+		options := *s.options
+		options.CompressionType = compressionType
+		cache := levelcache.NewCache("levelcache.test.redis.incompressible", &options)
+		assert.Nil(cache.MSet(s.ctx, kvs))
+
+		// random bytes grow, so they are stored as is
+		entries, _, err := cache.MGetRaw(s.ctx, s.keys)
+		assert.Nil(err)
+		assert.Equal(levelcache.CompressionType_None, entries[s.keys[0]].CompressionType, compressionType)
+		assert.Equal(random, entries[s.keys[0]].Raw)
+		assert.Equal(compressionType, entries[s.keys[1]].CompressionType)
+
+		values, valids, err := cache.MGet(s.ctx, s.keys)
+		assert.Nil(err)
+		assert.Equal(kvs, values)
+		assert.Len(valids, 2)
+	}
+}
+
+func (s *RedisCacheSuite) TestMarshalError() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+
+	reset := levelcache.SetMarshalData(func(data *levelcache.Data) ([]byte, error) {
+		return nil, errors.New("marshal error")
+	})
+	err := s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("new v1"), k2: []byte("v2")})
+	reset()
+	assert.NotNil(err)
+
+	// not overwritten by bad bytes
+	values, valids, err := s.mget(s.keys)
+	assert.Nil(err)
+	assert.Equal("v1", values[k1])
+	assert.True(valids[k1])
+	_, ok := values[k2]
+	assert.False(ok)
+}
+
+func (s *RedisCacheSuite) TestDecompressError() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := s.keys[0]
+	redisKey := s.options.RedisCacheOptions.Prefix + "_" + key
+	corrupt := func() {
+		bs, err := proto.Marshal(&levelcache.Data{
+			Raw:             []byte("not snappy"),
+			ModifyTime:      time.Now().Unix(),
+			CompressionType: levelcache.CompressionType_Snappy,
+		})
+		assert.Nil(err)
+		assert.Nil(s.client.Set(redisKey, bs, time.Minute).Err())
+	}
+
+	loaderErr := errors.New("loader error")
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return nil, loaderErr
+	})
+	defer patches.Reset()
+
+	newCache := func(policy levelcache.DecompressErrorPolicy) levelcache.Cache {
+		options := *s.options
+		options.OnDecompressError = policy
+		return levelcache.NewCache("levelcache.test.redis", &options)
+	}
+
+	t.Run("miss", func(t *testing.T) {
+		corrupt()
+		s.loaderRequestKeys = nil
+		values, _, err := s.get(key)
+		assert.True(errors.Is(err, loaderErr))
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		_, ok := values[key]
+		assert.False(ok)
+	})
+
+	t.Run("return", func(t *testing.T) {
+		corrupt()
+		s.loaderRequestKeys = nil
+		values, _, err := newCache(levelcache.DecompressErrorReturn).MGet(s.ctx, []string{key})
+		assert.NotNil(err)
+		assert.False(errors.Is(err, loaderErr))
+		assert.Empty(s.loaderRequestKeys)
+		assert.Empty(values)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		corrupt()
+		s.loaderRequestKeys = nil
+		_, _, err := newCache(levelcache.DecompressErrorDelete).MGet(s.ctx, []string{key})
+		assert.True(errors.Is(err, loaderErr))
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+
+		n, err := s.client.Exists(redisKey).Result()
+		assert.Nil(err)
+		assert.Equal(int64(0), n)
+	})
+}
+
+func (s *RedisCacheSuite) TestZstdDictionary() {
+	assert := s.Assert()
+
+	// trained on values like these
+	dict, err := ioutil.ReadFile("testdata/json.dict")
+	assert.Nil(err)
+
+	var keys []string
+	kvs := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("zstd_%d", i)
+		keys = append(keys, key)
+		kvs[key] = []byte(fmt.Sprintf(`{"id":%d,"name":"user_%d","email":"user_%d@example.com","status":"active",`+
+			`"roles":["reader","writer"],"created_at":"2021-04-%02dT10:00:00Z","settings":{"theme":"dark",`+
+			`"language":"en","notifications":true}}`, i, i, i, i%28+1))
+	}
+	defer s.cache.MDel(s.ctx, keys)
+
+	// total stored bytes of kvs
+	rawSize := func(dicts [][]byte) int {
+		options := *s.options
+		options.CompressionType = levelcache.CompressionType_Zstd
+		options.ZstdDictionaries = dicts
+		cache := levelcache.NewCache("levelcache.test.redis.zstd", &options)
+		assert.Nil(cache.MSet(s.ctx, kvs))
+
+		values, valids, err := cache.MGet(s.ctx, keys)
+		assert.Nil(err)
+		assert.Equal(kvs, values)
+		assert.Len(valids, len(keys))
+
+		entries, _, err := cache.MGetRaw(s.ctx, keys)
+		assert.Nil(err)
+		size := 0
+		for _, entry := range entries {
+			assert.Equal(levelcache.CompressionType_Zstd, entry.CompressionType)
+			size += len(entry.Raw)
+		}
+		return size
+	}
+
+	withoutDict := rawSize(nil)
+	withDict := rawSize([][]byte{dict})
+	s.T().Logf("without dictionary %d bytes, with dictionary %d bytes", withoutDict, withDict)
+	assert.Less(withDict, withoutDict/2)
+
+	assert.Panics(func() {
+		options := *s.options
+		options.ZstdDictionaries = [][]byte{[]byte("not a dictionary")}
+		levelcache.NewCache("levelcache.test.redis.zstd", &options)
+	})
+}
+
+func (s *RedisCacheSuite) TestTouch() {
+	assert := s.Assert()
+
+	k1, k2 := s.keys[0], s.keys[1]
+	prefix := s.options.RedisCacheOptions.Prefix
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{k1: []byte("v1")}))
+	// rejected rather than deleting k1
+	assert.NotNil(s.cache.Touch(s.ctx, []string{k1}, 0))
+	assert.Nil(s.cache.Touch(s.ctx, []string{k1, k2}, time.Minute))
+
+	ttl, err := s.client.PTTL(prefix + "_" + k1).Result()
+	assert.Nil(err)
+	assert.True(ttl > s.options.RedisCacheOptions.HardTimeout)
+
+	n, err := s.client.Exists(prefix + "_" + k2).Result()
+	assert.Nil(err)
+	assert.Equal(int64(0), n)
+}
+
+func (s *RedisCacheSuite) TestSoftTimeoutOverride() {
+	assert := s.Assert()
+	t := s.T()
+
+	clock := newFakeClock()
+	options := s.options
+	options.Clock = clock
+	cache := levelcache.NewCache("levelcache.test.redis.soft_timeout", options)
+	s.cache = cache
+
+	k1, k2 := s.keys[0], s.keys[1]
+	err := cache.MSetWithMeta(s.ctx, map[string]levelcache.MetaEntry{
+		k1: {Value: []byte("v1"), SoftTimeout: 2 * time.Second},
+		k2: {Value: []byte("v2")},
+	})
+	assert.Nil(err)
+
+	t.Run("all valid", func(t *testing.T) {
+		clock.Add(time.Second)
+		s.loaderRequestKeys = nil
+		values, valids, err := s.mget(s.keys)
+		assert.Nil(err)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Equal(map[string]string{k1: "v1", k2: "v2"}, values)
+		assert.Len(valids, 2)
+	})
+
+	t.Run("k1 soft expired", func(t *testing.T) {
+		clock.Add(2 * time.Second)
+		s.loaderRequestKeys = nil
+		values, valids, err := s.mget(s.keys)
+		assert.Nil(err)
+		assert.Equal([]string{k1}, s.loaderRequestKeys)
+		assert.Equal(map[string]string{k1: "v1", k2: "v2"}, values)
+		assert.False(valids[k1])
+		assert.True(valids[k2])
+	})
+
+	t.Run("k2 soft expired", func(t *testing.T) {
+		clock.Add(options.RedisCacheOptions.SoftTimeout)
+		s.loaderRequestKeys = nil
+		_, valids, err := s.mget([]string{k2})
+		assert.Nil(err)
+		assert.Equal([]string{k2}, s.loaderRequestKeys)
+		assert.False(valids[k2])
+	})
+}
+
+func (s *RedisCacheSuite) TestChecksum() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	redisKey := s.options.RedisCacheOptions.Prefix + "_" + key
+	options := *s.options
+	options.VerifyChecksum = true
+	cache := levelcache.NewCache("levelcache.test.redis.checksum", &options)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{key: []byte("value")}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("value")}))
+
+	// flip a bit of raw
+	bs, err := s.client.Get(redisKey).Bytes()
+	assert.Nil(err)
+	var data levelcache.Data
+	assert.Nil(proto.Unmarshal(bs, &data))
+	assert.NotZero(data.Checksum)
+	data.Raw[0] ^= 1
+	bs, err = proto.Marshal(&data)
+	assert.Nil(err)
+	assert.Nil(s.client.Set(redisKey, bs, time.Minute).Err())
+
+	// only detected with VerifyChecksum
+	values, _, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal("walue", values[key])
+
+	s.cache = cache
+	s.loaderRequestKeys = nil
+	values, valids, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+	assert.Equal("value", values[key])
+	assert.True(valids[key])
+}
+
+func (s *RedisCacheSuite) TestVerifyLength() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	redisKey := s.options.RedisCacheOptions.Prefix + "_" + key
+	options := *s.options
+	options.CompressionType = levelcache.CompressionType_Snappy
+	options.VerifyLength = true
+	cache := levelcache.NewCache("levelcache.test.redis.verify_length", &options)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{key: []byte("value")}, nil
+	})
+	defer patches.Reset()
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("value")}))
+
+	bs, err := s.client.Get(redisKey).Bytes()
+	assert.Nil(err)
+	var data levelcache.Data
+	assert.Nil(proto.Unmarshal(bs, &data))
+	assert.Equal(uint32(len("value")), data.UncompressedLen)
+	data.UncompressedLen++
+	bs, err = proto.Marshal(&data)
+	assert.Nil(err)
+	assert.Nil(s.client.Set(redisKey, bs, time.Minute).Err())
+
+	// only detected with VerifyLength
+	values, _, err := s.get(key)
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+	assert.Equal("value", values[key])
+
+	s.cache = cache
+	values, valids, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal([]string{key}, s.loaderRequestKeys)
+	assert.Equal("value", values[key])
+	assert.True(valids[key])
+}
+
+func (s *RedisCacheSuite) TestRecompress() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	value := "bigvalue_xxxxxxxxxxxx_bigvalue"
+	redisKey := s.options.RedisCacheOptions.Prefix + "_" + key
+
+	getData := func() *levelcache.Data {
+		bs, err := s.client.Get(redisKey).Bytes()
+		assert.Nil(err)
+		var data levelcache.Data
+		assert.Nil(proto.Unmarshal(bs, &data))
+		return &data
+	}
+
+	err := s.cache.MSet(s.ctx, map[string][]byte{key: []byte(value)})
+	assert.Nil(err)
+	before := getData()
+	assert.Equal(levelcache.CompressionType_None, before.CompressionType)
+
+	options := *s.options
+	options.CompressionType = levelcache.CompressionType_Snappy
+	cache := levelcache.NewCache("levelcache.test.redis.recompress", &options)
+	assert.Nil(cache.Recompress(s.ctx, []string{key, s.keys[1]}))
+
+	after := getData()
+	assert.Equal(levelcache.CompressionType_Snappy, after.CompressionType)
+	assert.Equal(before.ModifyTime, after.ModifyTime)
+	assert.NotEqual(before.Raw, after.Raw)
+
+	ttl, err := s.client.PTTL(redisKey).Result()
+	assert.Nil(err)
+	assert.True(ttl > 0 && ttl <= s.options.RedisCacheOptions.HardTimeout)
+
+	values, valids, err := s.get(key)
+	assert.Nil(err)
+	assert.Equal(value, values[key])
+	assert.True(valids[key])
+
+	exists, err := s.client.Exists(s.options.RedisCacheOptions.Prefix + "_" + s.keys[1]).Result()
+	assert.Nil(err)
+	assert.Equal(int64(0), exists)
+
+	// a write while recompressing is kept
+	options.CompressionType = levelcache.CompressionType_None
+	cache = levelcache.NewCache("levelcache.test.redis.recompress.concurrent", &options)
+	var written bool
+	restore := levelcache.SetMarshalData(func(data *levelcache.Data) ([]byte, error) {
+		if !written {
+			written = true
+			assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte("newer")}))
+		}
+		return proto.Marshal(data)
+	})
+	assert.Nil(cache.Recompress(s.ctx, []string{key}))
+	restore()
+	values, _, err = s.get(key)
+	assert.Nil(err)
+	assert.Equal("newer", values[key])
+
+	// redis errors are returned rather than rewriting nothing
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	options.RedisCacheOptions = &redisOptions
+	cache = levelcache.NewCache("levelcache.test.redis.recompress.down", &options)
+	assert.NotNil(cache.Recompress(s.ctx, []string{key}))
+}
+
+func (s *RedisCacheSuite) TestMGetRaw() {
+	assert := s.Assert()
+
+	options := s.options
+	options.CompressionType = levelcache.CompressionType_Snappy
+	cache := levelcache.NewCache("levelcache.test.redis.mget_raw", options)
+	s.cache = cache
+
+	key := s.keys[0]
+	value := "bigvalue_xxxxxxxxxxxx_bigvalue"
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{key: []byte(value)}))
+
+	bs, err := s.client.Get(options.RedisCacheOptions.Prefix + "_" + key).Bytes()
+	assert.Nil(err)
+	var data levelcache.Data
+	assert.Nil(proto.Unmarshal(bs, &data))
+
+	entries, valids, err := s.cache.MGetRaw(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Len(entries, 1)
+	assert.Equal(data.Raw, entries[key].Raw)
+	assert.Equal(levelcache.CompressionType_Snappy, entries[key].CompressionType)
+	assert.NotEqual([]byte(value), entries[key].Raw)
+	assert.True(valids[key])
+
+	raw, err := snappy.Decode(nil, entries[key].Raw)
+	assert.Nil(err)
+	assert.Equal(value, string(raw))
+
+	// redis errors are returned rather than reporting keys missing
+	downOptions := *options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.Client = redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	downOptions.RedisCacheOptions = &redisOptions
+	cache = levelcache.NewCache("levelcache.test.redis.mget_raw.down", &downOptions)
+	entries, _, err = cache.MGetRaw(s.ctx, []string{key})
+	assert.NotNil(err)
+	assert.Empty(entries)
+}
+
+func (s *RedisCacheSuite) TestLegacyKey() {
+	assert := s.Assert()
+
+	key := s.keys[0]
+	legacyOptions := *s.options.RedisCacheOptions
+	legacyOptions.Prefix = "levelcache.test.redis.legacy"
+	legacy := levelcache.NewCache("levelcache.test.redis.legacy", &levelcache.Options{
+		RedisCacheOptions: &legacyOptions,
+	})
+	assert.Nil(legacy.MDel(s.ctx, s.keys))
+	assert.Nil(legacy.MSet(s.ctx, map[string][]byte{key: []byte("legacy value")}))
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.LegacyKeyFunc = func(key string) string {
+		return legacyOptions.Prefix + "_" + key
+	}
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.redis.legacy_key", &options)
+
+	values, valids, err := cache.MGet(s.ctx, s.keys)
+	assert.Nil(err)
+	assert.Equal(map[string]string{key: "legacy value"}, convert(values))
+	assert.True(valids[key])
+	assert.Equal([]string{s.keys[1]}, s.loaderRequestKeys)
+
+	// copied to the real key
+	assert.Nil(legacy.MDel(s.ctx, s.keys))
+	raw, valids, err := s.cache.MGetRaw(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("legacy value", string(raw[key].Raw))
+	assert.True(valids[key])
+}
+
+func TestNewRedisCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	key := "k1"
+	cache := levelcache.NewRedisCache("levelcache.test.new_redis_cache", getRedisClient(),
+		"levelcache.test.new_redis_cache", 11*time.Second, 10*time.Second, 500*time.Millisecond, nil)
+	assert.NotNil(cache)
+	assert.Nil(cache.MDel(ctx, []string{key}))
+
+	assert.Nil(cache.MSet(ctx, map[string][]byte{key: []byte("v1")}))
+	values, valids, err := cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal(map[string][]byte{key: []byte("v1")}, values)
+	assert.True(valids[key])
+
+	assert.Nil(cache.MDel(ctx, []string{key}))
+	values, _, err = cache.MGet(ctx, []string{key})
+	assert.Nil(err)
+	assert.Empty(values)
+
+	assert.Panics(func() {
+		levelcache.NewRedisCache("levelcache.test.new_redis_cache.invalid", nil, "prefix", time.Second, time.Second, 0,
+			nil)
+	})
+}
+
 func TestRedisCache(t *testing.T) {
 	suite.Run(t, new(RedisCacheSuite))
 }
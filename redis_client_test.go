@@ -0,0 +1,567 @@
+package levelcache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey"
+	"github.com/ericuni/levelcache"
+	"github.com/ericuni/levelcache/levelcachetest"
+	"github.com/stretchr/testify/suite"
+)
+
+type contextKey struct{}
+
+// ContextClientSuite runs the redis path on levelcachetest.RedisClient, checking the ctx of every command
+type ContextClientSuite struct {
+	suite.Suite
+	LevelCacheTest
+	client *levelcachetest.RedisClient
+
+	mu   sync.Mutex
+	ctxs []context.Context
+}
+
+func (s *ContextClientSuite) SetupTest() {
+	assert := s.Assert()
+
+	s.ctx = context.WithValue(context.Background(), contextKey{}, "request")
+	s.client = levelcachetest.NewRedisClient()
+	s.ctxs = nil
+	s.client.OnCommand(func(ctx context.Context) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.ctxs = append(s.ctxs, ctx)
+	})
+
+	options := levelcache.Options{
+		RedisCacheOptions: &levelcache.RedisCacheOptions{
+			ContextClient: s.client,
+			Prefix:        "levelcache.test.context_client",
+			HardTimeout:   11 * time.Second,
+			SoftTimeout:   10 * time.Second,
+			MissTimeout:   500 * time.Millisecond,
+		},
+		Loader: func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			s.loaderRequestKeys = keys
+			return nil, nil
+		},
+	}
+	s.options = &options
+
+	cache := levelcache.NewCache("levelcache.test.context_client", s.options)
+	assert.NotNil(cache)
+	s.cache = cache
+	s.loaderRequestKeys = nil
+}
+
+func (s *ContextClientSuite) assertContexts() {
+	assert := s.Assert()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.NotEmpty(s.ctxs)
+	for _, ctx := range s.ctxs {
+		assert.Equal("request", ctx.Value(contextKey{}))
+	}
+	s.ctxs = nil
+}
+
+func (s *ContextClientSuite) TestRoundTrip() {
+	assert := s.Assert()
+	t := s.T()
+
+	key := "k1"
+	value := "value"
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		s.loaderRequestKeys = keys
+		return map[string][]byte{key: []byte(value)}, nil
+	})
+	defer patches.Reset()
+
+	t.Run("hit loader", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Equal([]string{key}, s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(value, values[key])
+		assert.True(valids[key])
+		s.assertContexts()
+
+		_, ok := s.client.Value(s.options.RedisCacheOptions.Prefix + "_" + key)
+		assert.True(ok)
+	})
+
+	t.Run("hit cache", func(t *testing.T) {
+		s.loaderRequestKeys = nil
+		values, valids, err := s.get(key)
+		assert.Empty(s.loaderRequestKeys)
+		assert.Nil(err)
+		assert.Equal(value, values[key])
+		assert.True(valids[key])
+		s.assertContexts()
+	})
+
+	t.Run("del cache", func(t *testing.T) {
+		assert.Nil(s.cache.MDel(s.ctx, []string{key}))
+		s.assertContexts()
+
+		_, ok := s.client.Value(s.options.RedisCacheOptions.Prefix + "_" + key)
+		assert.False(ok)
+	})
+}
+
+func (s *ContextClientSuite) TestTags() {
+	assert := s.Assert()
+
+	err := s.cache.MSetTagged(s.ctx, map[string][]byte{"k1": []byte("v1")}, map[string][]string{"k1": {"tag"}})
+	assert.Nil(err)
+	assert.Nil(s.cache.InvalidateTag(s.ctx, "tag"))
+	s.assertContexts()
+
+	values, _, err := s.get("k1")
+	assert.Nil(err)
+	assert.Empty(values)
+	assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+}
+
+func (s *ContextClientSuite) TestPing() {
+	assert := s.Assert()
+
+	assert.Nil(s.cache.Ping(s.ctx))
+
+	pingErr := errors.New("connection refused")
+	s.client.SetPingError(pingErr)
+	err := s.cache.Ping(s.ctx)
+	assert.NotNil(err)
+	assert.True(errors.Is(err, pingErr))
+	s.assertContexts()
+}
+
+func (s *ContextClientSuite) TestPartialGetError() {
+	assert := s.Assert()
+
+	prefix := s.options.RedisCacheOptions.Prefix
+	assert.Nil(s.cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2")}))
+	s.client.SetGetError(prefix+"_k2", errors.New("i/o timeout"))
+
+	values, valids, err := s.mget([]string{"k1", "k2"})
+	assert.Nil(err)
+	assert.Equal([]string{"k2"}, s.loaderRequestKeys)
+	assert.Equal(map[string]string{"k1": "v1"}, values)
+	assert.True(valids["k1"])
+}
+
+func (s *ContextClientSuite) TestOnLevelError() {
+	assert := s.Assert()
+
+	type levelError struct {
+		level string
+		err   error
+	}
+	var levelErrs []levelError
+	options := *s.options
+	options.OnLevelError = func(level string, err error) {
+		levelErrs = append(levelErrs, levelError{level: level, err: err})
+	}
+	cache := levelcache.NewCache("levelcache.test.context_client.level_error", &options)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		return map[string][]byte{"k1": []byte("v1")}, nil
+	})
+	defer patches.Reset()
+
+	getErr := errors.New("i/o timeout")
+	s.client.SetGetError(options.RedisCacheOptions.Prefix+"_k1", getErr)
+	values, valids, err := cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"k1": "v1"}, convert(values))
+	assert.True(valids["k1"])
+	assert.Len(levelErrs, 1)
+	assert.Equal(levelcache.LevelRedis, levelErrs[0].level)
+	assert.True(errors.Is(levelErrs[0].err, getErr))
+}
+
+// setCountingClient counts entries of every Set
+type setCountingClient struct {
+	*levelcachetest.RedisClient
+	sets []int
+}
+
+func (c *setCountingClient) Set(ctx context.Context, entries []levelcache.RedisEntry) error {
+	c.sets = append(c.sets, len(entries))
+	return c.RedisClient.Set(ctx, entries)
+}
+
+func (c *setCountingClient) SetNX(ctx context.Context, entries []levelcache.RedisEntry) ([]bool, error) {
+	c.sets = append(c.sets, len(entries))
+	return c.RedisClient.SetNX(ctx, entries)
+}
+
+func (s *ContextClientSuite) TestMaxPipelineBytes() {
+	assert := s.Assert()
+
+	client := &setCountingClient{RedisClient: s.client}
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.ContextClient = client
+	redisOptions.MaxPipelineBytes = 3000
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.context_client.max_pipeline_bytes", &options)
+
+	// about 1k each, so 2 per pipeline
+	kvs := make(map[string][]byte)
+	keys := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		kvs[key] = bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		keys = append(keys, key)
+	}
+	assert.Nil(cache.MSet(s.ctx, kvs))
+	assert.Equal([]int{2, 2, 1}, client.sets)
+
+	values, valids, err := cache.MGet(s.ctx, keys)
+	assert.Nil(err)
+	assert.Len(values, 5)
+	assert.Len(valids, 5)
+	assert.Equal(kvs["k3"], values["k3"])
+}
+
+func (s *ContextClientSuite) TestMSetNXWrites() {
+	assert := s.Assert()
+
+	// MSetNX writes like MSet, by pipelines of MaxPipelineBytes, filtered and reported
+	client := &setCountingClient{RedisClient: s.client}
+	var sets []string
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.ContextClient = client
+	redisOptions.MaxPipelineBytes = 3000
+	redisOptions.SlowRedisThreshold = time.Nanosecond
+	redisOptions.RedisWriteFilter = func(key string) bool {
+		return key != "k4"
+	}
+	options.RedisCacheOptions = &redisOptions
+	options.OnSet = func(key string, level string, ttl time.Duration) {
+		if level == levelcache.LevelRedis {
+			sets = append(sets, key)
+		}
+	}
+	cache := levelcache.NewCache("levelcache.test.context_client.mset_nx_writes", &options)
+
+	// about 1k each, so 2 per pipeline
+	kvs := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		kvs[fmt.Sprintf("k%d", i)] = bytes.Repeat([]byte{byte('a' + i)}, 1000)
+	}
+	assert.Nil(cache.MSetNX(s.ctx, kvs))
+	assert.Equal([]int{2, 2}, client.sets)
+	assert.ElementsMatch([]string{"k0", "k1", "k2", "k3"}, sets)
+	assert.Equal(int64(2), cache.Stats().SlowRedisOps)
+	_, ok := s.client.Value(redisOptions.Prefix + "_k3")
+	assert.True(ok)
+	_, ok = s.client.Value(redisOptions.Prefix + "_k4")
+	assert.False(ok)
+}
+
+func (s *ContextClientSuite) TestMissRetriesOfTenants() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.PrefixFunc = func(ctx context.Context, key string) string {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return tenant
+	}
+	options.RedisCacheOptions = &redisOptions
+	options.MissRetries = 1
+	cache := levelcache.NewCache("levelcache.test.context_client.miss_retries_of_tenants", &options)
+
+	// misses of tenant a do not count for tenant b
+	ctxA := context.WithValue(s.ctx, tenantKey{}, "tenant_a")
+	ctxB := context.WithValue(s.ctx, tenantKey{}, "tenant_b")
+	for _, ctx := range []context.Context{ctxA, ctxB, ctxB} {
+		s.loaderRequestKeys = nil
+		_, _, err := cache.MGet(ctx, []string{"k1"})
+		assert.Nil(err)
+		assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+	}
+	_, ok := s.client.Value("tenant_a_k1")
+	assert.False(ok)
+	_, ok = s.client.Value("tenant_b_k1")
+	assert.True(ok)
+}
+
+func (s *ContextClientSuite) TestMiss() {
+	assert := s.Assert()
+
+	values, valids, err := s.get("k1")
+	assert.Nil(err)
+	assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+	assert.Empty(values)
+	assert.Empty(valids)
+
+	// negative cached
+	s.loaderRequestKeys = nil
+	_, _, err = s.get("k1")
+	assert.Nil(err)
+	assert.Empty(s.loaderRequestKeys)
+
+	time.Sleep(s.options.RedisCacheOptions.MissTimeout)
+	_, _, err = s.get("k1")
+	assert.Nil(err)
+	assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+}
+
+func (s *ContextClientSuite) TestSlowRedis() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.SlowRedisThreshold = 10 * time.Millisecond
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.context_client.slow", &options)
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	_, _, err := cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Zero(cache.Stats().SlowRedisOps)
+
+	s.client.OnCommand(func(ctx context.Context) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	_, _, err = cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal(int64(2), cache.Stats().SlowRedisOps)
+}
+
+func (s *ContextClientSuite) TestAsyncWrite() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.AsyncWrite = true
+	options.RedisCacheOptions = &redisOptions
+	options.LRUCacheOptions = &levelcache.LRUCacheOptions{Size: 10, Timeout: time.Second}
+	cache := levelcache.NewCache("levelcache.test.context_client.async_write", &options)
+
+	patches := gomonkey.ApplyFunc(s.options.Loader, func(ctx context.Context, keys []string) (map[string][]byte,
+		error) {
+		return map[string][]byte{"k1": []byte("v1")}, nil
+	})
+	defer patches.Reset()
+
+	// the get goes through, the set after load blocks until released
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var commands int32
+	s.client.OnCommand(func(ctx context.Context) {
+		s.mu.Lock()
+		s.ctxs = append(s.ctxs, ctx)
+		s.mu.Unlock()
+		if atomic.AddInt32(&commands, 1) == 2 {
+			close(blocked)
+			<-release
+		}
+	})
+
+	values, valids, err := cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("v1", string(values["k1"]))
+	assert.True(valids["k1"])
+
+	// returned while the set is still in flight
+	<-blocked
+	close(release)
+	assert.Nil(cache.Close())
+	_, ok := s.client.Value(redisOptions.Prefix + "_k1")
+	assert.True(ok)
+	s.assertContexts()
+}
+
+func (s *ContextClientSuite) TestMaxTTL() {
+	assert := s.Assert()
+
+	options := *s.options
+	options.MaxTTL = time.Second
+	cache := levelcache.NewCache("levelcache.test.context_client.max_ttl", &options)
+	key := options.RedisCacheOptions.Prefix + "_k1"
+
+	// HardTimeout of 11s is clamped
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	ttls, err := s.client.PTTL(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.True(ttls[0] > 0 && ttls[0] <= time.Second, ttls[0])
+
+	assert.Nil(cache.Touch(s.ctx, []string{"k1"}, time.Hour))
+	ttls, err = s.client.PTTL(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.True(ttls[0] > 0 && ttls[0] <= time.Second, ttls[0])
+
+	// so is a HardTimeout never expiring
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.HardTimeout = 0
+	options.RedisCacheOptions = &redisOptions
+	cache = levelcache.NewCache("levelcache.test.context_client.max_ttl.no_expiry", &options)
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	ttls, err = s.client.PTTL(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.True(ttls[0] > 0 && ttls[0] <= time.Second, ttls[0])
+}
+
+func (s *ContextClientSuite) TestInvalidation() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.EnableInvalidation = true
+	options.RedisCacheOptions = &redisOptions
+	options.LRUCacheOptions = &levelcache.LRUCacheOptions{Size: 10, Timeout: time.Minute}
+	cache := levelcache.NewCache("levelcache.test.context_client.invalidation", &options)
+
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("v1")}))
+	values, _, err := cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("v1", string(values["k1"]))
+
+	// another instance writes redis only, the lru entry is stale until notified
+	other := levelcache.NewCache("levelcache.test.context_client.invalidation.other", s.options)
+	assert.Nil(other.MSet(s.ctx, map[string][]byte{"k1": []byte("v2")}))
+	values, _, err = cache.MGet(s.ctx, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("v1", string(values["k1"]))
+
+	// published until the subscriber running in background has subscribed
+	channel := "__keyspace@0__:" + redisOptions.Prefix + "_k1"
+	assert.Eventually(func() bool {
+		s.client.Publish(channel, "set")
+		values, _, err := cache.MGet(s.ctx, []string{"k1"})
+		return err == nil && string(values["k1"]) == "v2"
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Nil(cache.Close())
+
+	// channels are of Prefix only
+	redisOptions.PrefixFunc = func(ctx context.Context, key string) string {
+		return ""
+	}
+	assert.Panics(func() {
+		levelcache.NewCache("levelcache.test.context_client.invalidation.prefix_func", &options)
+	})
+}
+
+func (s *ContextClientSuite) TestRedisKeyBuilder() {
+	assert := s.Assert()
+
+	// tenant of key as a hash tag
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.RedisKeyBuilder = func(prefix, key string) string {
+		i := strings.Index(key, ":")
+		return prefix + ":{" + key[:i] + "}:" + key[i+1:]
+	}
+	options.RedisCacheOptions = &redisOptions
+	cache := levelcache.NewCache("levelcache.test.context_client.key_builder", &options)
+
+	key := "tenant123:resource456"
+	redisKey := redisOptions.Prefix + ":{tenant123}:resource456"
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{key: []byte("v1")}))
+	_, ok := s.client.Value(redisKey)
+	assert.True(ok)
+
+	values, valids, err := cache.MGet(s.ctx, []string{key})
+	assert.Nil(err)
+	assert.Equal("v1", string(values[key]))
+	assert.True(valids[key])
+	assert.Empty(s.loaderRequestKeys)
+
+	assert.Nil(cache.MDel(s.ctx, []string{key}))
+	_, ok = s.client.Value(redisKey)
+	assert.False(ok)
+}
+
+type tenantKey struct{}
+
+func (s *ContextClientSuite) TestPrefixFunc() {
+	assert := s.Assert()
+
+	options := *s.options
+	redisOptions := *options.RedisCacheOptions
+	redisOptions.PrefixFunc = func(ctx context.Context, key string) string {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return tenant
+	}
+	options.RedisCacheOptions = &redisOptions
+	options.LRUCacheOptions = &levelcache.LRUCacheOptions{Size: 10, Timeout: time.Second}
+	cache := levelcache.NewCache("levelcache.test.context_client.prefix_func", &options)
+
+	ctxA := context.WithValue(s.ctx, tenantKey{}, "tenant_a")
+	ctxB := context.WithValue(s.ctx, tenantKey{}, "tenant_b")
+	assert.Nil(cache.MSet(ctxA, map[string][]byte{"k1": []byte("a")}))
+	_, ok := s.client.Value("tenant_a_k1")
+	assert.True(ok)
+	_, ok = s.client.Value(redisOptions.Prefix + "_k1")
+	assert.False(ok)
+
+	// neither lru nor redis entries of tenant a are seen by tenant b
+	values, valids, err := cache.MGet(ctxB, []string{"k1"})
+	assert.Nil(err)
+	assert.Empty(values)
+	assert.Empty(valids)
+	assert.Equal([]string{"k1"}, s.loaderRequestKeys)
+
+	assert.Nil(cache.MSet(ctxB, map[string][]byte{"k1": []byte("b")}))
+	values, _, err = cache.MGet(ctxA, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("a", string(values["k1"]))
+	values, _, err = cache.MGet(ctxB, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("b", string(values["k1"]))
+
+	// calls without a tenant use Prefix
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"k1": []byte("default")}))
+	_, ok = s.client.Value(redisOptions.Prefix + "_k1")
+	assert.True(ok)
+	values, _, err = cache.MGet(ctxA, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("a", string(values["k1"]))
+
+	// a key of the default tenant looking like a key of a tenant is its own lru entry
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"tenant_a_k1": []byte("other")}))
+	values, _, err = cache.MGet(ctxA, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("a", string(values["k1"]))
+	// so is one looking like a qualified lru key
+	assert.Nil(cache.MSet(s.ctx, map[string][]byte{"8:tenant_ak1": []byte("other")}))
+	values, _, err = cache.MGet(ctxA, []string{"k1"})
+	assert.Nil(err)
+	assert.Equal("a", string(values["k1"]))
+
+	// tags are indexed by tenant
+	assert.Nil(cache.MSetTagged(ctxA, map[string][]byte{"k2": []byte("a")}, map[string][]string{"k2": {"t"}}))
+	assert.Nil(cache.MSetTagged(ctxB, map[string][]byte{"k2": []byte("b")}, map[string][]string{"k2": {"t"}}))
+	assert.Nil(cache.InvalidateTag(ctxA, "t"))
+	_, ok = s.client.Value("tenant_a_k2")
+	assert.False(ok)
+	values, _, err = cache.MGet(ctxB, []string{"k2"})
+	assert.Nil(err)
+	assert.Equal("b", string(values["k2"]))
+	assert.Nil(cache.InvalidateTag(ctxB, "t"))
+	_, ok = s.client.Value("tenant_b_k2")
+	assert.False(ok)
+}
+
+func TestContextClient(t *testing.T) {
+	suite.Run(t, new(ContextClientSuite))
+}
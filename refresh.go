@@ -0,0 +1,182 @@
+package levelcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+)
+
+// RegisterRefresh .
+func (cache *cacheImpl) RegisterRefresh(keys []string, interval time.Duration) error {
+	if !cache.hasLoader() {
+		return errs.New("loader not configured")
+	}
+	if interval <= 0 {
+		return errs.New("refresh interval invalid")
+	}
+
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	keys = append([]string(nil), keys...)
+
+	cache.refreshMu.Lock()
+	defer cache.refreshMu.Unlock()
+	if cache.closed {
+		return errs.New("cache closed")
+	}
+	if cache.refreshCtx == nil {
+		cache.refreshCtx, cache.refreshCancel = context.WithCancel(context.Background())
+	}
+
+	cache.refreshWG.Add(1)
+	go cache.refreshLoop(cache.refreshCtx, keys, interval)
+	return nil
+}
+
+// Close .
+func (cache *cacheImpl) Close() error {
+	cache.refreshMu.Lock()
+	cache.closed = true
+	if cache.refreshCancel != nil {
+		cache.refreshCancel()
+	}
+	cache.refreshMu.Unlock()
+	if cache.invalidationCancel != nil {
+		cache.invalidationCancel()
+	}
+	if cache.versionCancel != nil {
+		cache.versionCancel()
+	}
+
+	cache.refreshWG.Wait()
+	cache.invalidationWG.Wait()
+	cache.versionWG.Wait()
+	cache.asyncWriteWG.Wait()
+	return nil
+}
+
+// refreshLoop refreshes keys right away and then every interval. runs are sequential in this goroutine, so a slow
+// refresh delays the next one instead of overlapping it.
+func (cache *cacheImpl) refreshLoop(ctx context.Context, keys []string, interval time.Duration) {
+	defer cache.refreshWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cache.refresh(ctx, keys)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh loads keys and writes them to all levels regardless of what is cached
+func (cache *cacheImpl) refresh(ctx context.Context, keys []string) {
+	values, ttls, err := cache.load(ctx, keys)
+	if err != nil {
+		glog.Errorf("%s refresh loader error %+v", cache.name, err)
+	}
+	if succeeded, succeededValues, ok := succeededKeys(err, keys, values); ok {
+		keys, values = succeeded, succeededValues
+	} else if err != nil {
+		// misses are not trusted when loader failed
+		if err := cache.mSetLoaded(ctx, values, ttls, nil); err != nil {
+			glog.Errorf("%s refresh set error %+v", cache.name, err)
+		}
+		return
+	}
+
+	missKeys := cache.loaderMissKeys(ctx, keys, values)
+	if err := cache.mSetLoaded(ctx, values, ttls, missKeys); err != nil {
+		glog.Errorf("%s refresh set error %+v", cache.name, err)
+	}
+}
+
+// MGetWithBudget .
+func (cache *cacheImpl) MGetWithBudget(ctx context.Context, keys []string, budget time.Duration) (map[string][]byte,
+	map[string]bool, error) {
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return nil, nil, err
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	// waiting for a slot is within the budget
+	if err := cache.acquireMGet(ctx); err != nil {
+		return nil, nil, errs.Trace(err)
+	}
+	defer cache.releaseMGet()
+
+	share := cache.options.CacheBudgetShare
+	if share == 0 {
+		share = 0.3
+	}
+	cacheCtx, cacheCancel := context.WithTimeout(ctx, time.Duration(float64(budget)*share))
+	defer cacheCancel()
+
+	// keys redis fails to read in time are loaded with the rest of the budget
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	missKeys, err := cache.mGetCached(cacheCtx, keys, valuesMap, validsMap, cache.reportNegative(validsMap))
+	if err != nil || len(missKeys) == 0 || !cache.hasLoader() {
+		return valuesMap, validsMap, errs.Trace(err)
+	}
+
+	// the load writes its own maps, as it may outlive the call
+	loadedValues := make(map[string][]byte, len(missKeys))
+	loadedValids := make(map[string]bool, len(missKeys))
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.mLoad(ctx, missKeys, loadedValues, loadedValids, cache.reportNegative(loadedValids))
+	}()
+	select {
+	case err := <-done:
+		for k, v := range loadedValues {
+			valuesMap[k] = v
+		}
+		for k, v := range loadedValids {
+			validsMap[k] = v
+		}
+		return valuesMap, validsMap, errs.Trace(err)
+	case <-ctx.Done():
+		return valuesMap, validsMap, errs.Trace(ctx.Err())
+	}
+}
+
+// MGetWithRefresh .
+func (cache *cacheImpl) MGetWithRefresh(ctx context.Context, keys []string) (map[string][]byte,
+	<-chan map[string][]byte, error) {
+	fresh := make(chan map[string][]byte, 1)
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		close(fresh)
+		return nil, fresh, err
+	}
+
+	values := make(map[string][]byte, len(keys))
+	missKeys, err := cache.mGetCached(ctx, keys, values, make(map[string]bool, len(keys)), nil)
+	if err != nil || len(missKeys) == 0 || !cache.hasLoader() {
+		close(fresh)
+		return values, fresh, errs.Trace(err)
+	}
+
+	go func() {
+		defer close(fresh)
+		loaded := make(map[string][]byte, len(missKeys))
+		if err := cache.mLoad(ctx, missKeys, loaded, make(map[string]bool, len(missKeys)), nil); err != nil {
+			glog.Errorf("%s refresh load error %+v", cache.name, err)
+		}
+		fresh <- loaded
+	}()
+	return values, fresh, nil
+}
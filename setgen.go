@@ -0,0 +1,102 @@
+package levelcache
+
+import (
+	"sync"
+)
+
+// setGenerations counts sets of keys with async writes scheduled if AsyncWrite is set, so an async write can tell a
+// key was set or deleted after the write was scheduled, and leave it alone. only keys with async writes scheduled
+// are counted, the count of a key is dropped once its last async write is done.
+type setGenerations struct {
+	mu   sync.Mutex
+	gens map[string]*setGeneration
+}
+
+type setGeneration struct {
+	gen      uint64
+	refs     int           // async writes scheduled
+	inflight int           // async writes writing it
+	done     chan struct{} // closed once inflight drops to 0
+}
+
+func newSetGenerations() *setGenerations {
+	return &setGenerations{gens: make(map[string]*setGeneration)}
+}
+
+// set is called before keys are written or deleted. it waits for async writes of keys in flight, so those are not
+// written after.
+func (g *setGenerations) set(keys []string) {
+	var waits []chan struct{}
+	g.mu.Lock()
+	for _, key := range keys {
+		if gen, ok := g.gens[key]; ok {
+			gen.gen++
+			if gen.inflight > 0 {
+				waits = append(waits, gen.done)
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	for _, done := range waits {
+		<-done
+	}
+}
+
+// schedule returns generations of keys of an async write, which must call start once
+func (g *setGenerations) schedule(keys []string) []uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gens := make([]uint64, len(keys))
+	for i, key := range keys {
+		gen, ok := g.gens[key]
+		if !ok {
+			gen = &setGeneration{}
+			g.gens[key] = gen
+		}
+		gen.refs++
+		gens[i] = gen.gen
+	}
+	return gens
+}
+
+// start returns keys not set since scheduled with gens, which are in flight until the returned function is called
+// once they are written
+func (g *setGenerations) start(keys []string, gens []uint64) ([]string, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	unset := make([]string, 0, len(keys))
+	for i, key := range keys {
+		gen := g.gens[key]
+		if gen.gen != gens[i] {
+			continue
+		}
+		if gen.inflight == 0 {
+			gen.done = make(chan struct{})
+		}
+		gen.inflight++
+		unset = append(unset, key)
+	}
+	return unset, func() {
+		g.done(keys, unset)
+	}
+}
+
+func (g *setGenerations) done(keys []string, unset []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range unset {
+		gen := g.gens[key]
+		gen.inflight--
+		if gen.inflight == 0 {
+			close(gen.done)
+		}
+	}
+	for _, key := range keys {
+		gen := g.gens[key]
+		gen.refs--
+		if gen.refs == 0 {
+			delete(g.gens, key)
+		}
+	}
+}
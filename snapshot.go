@@ -0,0 +1,168 @@
+package levelcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/protobuf/proto"
+)
+
+// lruSnapshotVersion starts a DumpLRU output, followed by records of uvarint length prefixed lru key, varint expiry
+// in unix ms and uvarint length prefixed Data. misses are Data with Miss set, as kept in lru. version 1 had keys
+// not qualified by their version, version 2 qualified keys of no qualifier too.
+const lruSnapshotVersion = 3
+
+// DumpLRU .
+func (cache *cacheImpl) DumpLRU(w io.Writer) error {
+	if err := cache.checkTrimmable(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	write := func(bs []byte) {
+		_, _ = bw.Write(bs)
+	}
+	write(buf[:binary.PutUvarint(buf, lruSnapshotVersion)])
+	for _, key := range cache.lruData.Keys() {
+		item := cache.lruData.Peek(key)
+		if item == nil || item.Expired() {
+			continue
+		}
+
+		data, ok := lruValue(item).(*Data)
+		if !ok {
+			continue
+		}
+		bs, err := proto.Marshal(data)
+		if err != nil {
+			return errs.Trace(err)
+		}
+
+		write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+		write([]byte(key))
+		write(buf[:binary.PutVarint(buf, item.Expires().UnixNano()/int64(time.Millisecond))])
+		write(buf[:binary.PutUvarint(buf, uint64(len(bs)))])
+		write(bs)
+	}
+	// bufio keeps the first write error
+	if err := bw.Flush(); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// PrewarmFromRedis .
+func (cache *cacheImpl) PrewarmFromRedis(ctx context.Context, keys []string) error {
+	if cache.options.LRUCacheOptions == nil || cache.options.RedisCacheOptions == nil {
+		return errs.New("both lrucache and rediscache required")
+	}
+	keys, err := cache.validKeys(keys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	// soft expired values are left to reads, which load them again
+	valuesMap := make(map[string][]byte, len(keys))
+	validsMap := make(map[string]bool, len(keys))
+	modifyTimes := make(map[string]int64, len(keys))
+	missKeys, staleKeys, err := cache.mGetFromRedisCache(ctx, keys, valuesMap, validsMap, modifyTimes)
+	hitKeys := substract(substract(keys, missKeys), staleKeys)
+	values := make(map[string][]byte, len(hitKeys))
+	var negativeKeys []string
+	for _, key := range hitKeys {
+		if v, ok := valuesMap[key]; ok {
+			values[key] = v
+		} else {
+			negativeKeys = append(negativeKeys, key)
+		}
+	}
+	cache.mSetLRUCacheModified(ctx, values, negativeKeys, modifyTimes)
+	return errs.Trace(err)
+}
+
+// LoadLRU .
+func (cache *cacheImpl) LoadLRU(r io.Reader) error {
+	if cache.options.LRUCacheOptions == nil {
+		return errs.New("lrucache not configured")
+	}
+
+	br := bufio.NewReader(r)
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	if version != lruSnapshotVersion {
+		return errs.New("lru snapshot version %d unknown", version)
+	}
+
+	for {
+		key, err := readSnapshotBytes(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errs.Trace(err)
+		}
+		expires, err := binary.ReadVarint(br)
+		if err != nil {
+			return errs.Trace(noEOF(err))
+		}
+		bs, err := readSnapshotBytes(br)
+		if err != nil {
+			return errs.Trace(noEOF(err))
+		}
+
+		ttl := time.Until(time.Unix(0, expires*int64(time.Millisecond)))
+		if ttl <= 0 {
+			continue
+		}
+		ttl = cache.capTTL(ttl)
+		data := &Data{}
+		if err := proto.Unmarshal(bs, data); err != nil {
+			return errs.Trace(err)
+		}
+		cache.lruData.Set(string(key), data, ttl)
+	}
+}
+
+// checkTrimmable returns an error unless lru cache is configured and trimmable
+func (cache *cacheImpl) checkTrimmable() error {
+	options := cache.options.LRUCacheOptions
+	if options == nil {
+		return errs.New("lrucache not configured")
+	}
+	if !options.Trimmable {
+		return errs.New("lrucache not trimmable")
+	}
+	return nil
+}
+
+// readSnapshotBytes reads uvarint length prefixed bytes, io.EOF only if nothing is read
+func readSnapshotBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, errs.New("lru snapshot record of %d bytes", n)
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, br, int64(n)); err != nil {
+		return nil, noEOF(err)
+	}
+	return b.Bytes(), nil
+}
+
+// noEOF converts io.EOF of a truncated record
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
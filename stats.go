@@ -0,0 +1,90 @@
+package levelcache
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// value size histogram upper bounds in bytes, the last bucket holds everything bigger
+var valueSizeBounds = []int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, math.MaxInt32}
+
+// Stats cache statistics
+type Stats struct {
+	ValueSizes      []ValueSizeBucket // nil unless Options.TrackValueSizes is set
+	LoaderExtraKeys int64             // keys returned by loaders but not requested, they are dropped
+	SlowRedisOps    int64             // redis gets and sets slower than RedisCacheOptions.SlowRedisThreshold
+	Hits            int64             // keys served with valid values by lru cache or redis cache
+	NegativeHits    int64             // keys served as misses by negative cache entries, without calling loader
+}
+
+// ValueSizeBucket counts written values whose length is in (previous bucket's UpperBound, UpperBound]
+type ValueSizeBucket struct {
+	UpperBound int // bytes
+	Count      int64
+}
+
+type stats struct {
+	valueSizes      []int64
+	loaderExtraKeys int64
+	slowRedisOps    int64
+	hits            int64
+	negativeHits    int64
+}
+
+func newStats(options *Options) *stats {
+	s := &stats{}
+	if options.TrackValueSizes {
+		s.valueSizes = make([]int64, len(valueSizeBounds))
+	}
+	return s
+}
+
+func (s *stats) recordValueSizes(kvs map[string][]byte) {
+	if s.valueSizes == nil {
+		return
+	}
+
+	for _, v := range kvs {
+		for i, bound := range valueSizeBounds {
+			if len(v) <= bound {
+				atomic.AddInt64(&s.valueSizes[i], 1)
+				break
+			}
+		}
+	}
+}
+
+func (s *stats) recordLoaderExtraKeys(n int) {
+	atomic.AddInt64(&s.loaderExtraKeys, int64(n))
+}
+
+func (s *stats) recordSlowRedisOp() {
+	atomic.AddInt64(&s.slowRedisOps, 1)
+}
+
+func (s *stats) recordHit() {
+	atomic.AddInt64(&s.hits, 1)
+}
+
+func (s *stats) recordNegativeHit() {
+	atomic.AddInt64(&s.negativeHits, 1)
+}
+
+func (s *stats) snapshot() Stats {
+	res := Stats{
+		LoaderExtraKeys: atomic.LoadInt64(&s.loaderExtraKeys),
+		SlowRedisOps:    atomic.LoadInt64(&s.slowRedisOps),
+		Hits:            atomic.LoadInt64(&s.hits),
+		NegativeHits:    atomic.LoadInt64(&s.negativeHits),
+	}
+	if s.valueSizes != nil {
+		res.ValueSizes = make([]ValueSizeBucket, len(valueSizeBounds))
+		for i, bound := range valueSizeBounds {
+			res.ValueSizes[i] = ValueSizeBucket{
+				UpperBound: bound,
+				Count:      atomic.LoadInt64(&s.valueSizes[i]),
+			}
+		}
+	}
+	return res
+}
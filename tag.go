@@ -0,0 +1,84 @@
+package levelcache
+
+import (
+	"context"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+)
+
+// MSetTagged .
+func (cache *cacheImpl) MSetTagged(ctx context.Context, kvs map[string][]byte, tags map[string][]string) error {
+	options := cache.options.RedisCacheOptions
+	if options == nil {
+		return errs.New("rediscache not configured")
+	}
+
+	// keys not written are not indexed either
+	kvs, err := cache.validKVs(kvs)
+	if err != nil {
+		return err
+	}
+	if err := cache.MSet(ctx, kvs); err != nil {
+		return errs.Trace(err)
+	}
+
+	// tag -> keys
+	tagKeys := make(map[string][]string)
+	for key, keyTags := range tags {
+		if _, ok := kvs[key]; !ok {
+			continue
+		}
+		for _, tag := range keyTags {
+			tagKeys[tag] = append(tagKeys[tag], key)
+		}
+	}
+
+	if len(tagKeys) == 0 {
+		return nil
+	}
+	sets := make(map[string][]string, len(tagKeys))
+	for tag, keys := range tagKeys {
+		sets[cache.mkRedisTagKey(ctx, tag)] = keys
+	}
+	// tagged keys are gone after hard timeout, so is the index
+	if err := cache.redis.SAdd(ctx, sets, cache.capRedisTTL(options.HardTimeout)); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// InvalidateTag .
+func (cache *cacheImpl) InvalidateTag(ctx context.Context, tag string) error {
+	if cache.options.RedisCacheOptions == nil {
+		return errs.New("rediscache not configured")
+	}
+
+	// keys tagged meanwhile go to a new index, rather than being dropped by a later delete of the index
+	redisKey := cache.mkRedisTagKey(ctx, tag)
+	keys, err := cache.redis.SPopAll(ctx, redisKey)
+	if err != nil {
+		return errs.Trace(err)
+	}
+
+	if err := cache.MDel(ctx, keys); err != nil {
+		// so the tag can be invalidated again
+		ttl := cache.capRedisTTL(cache.options.RedisCacheOptions.HardTimeout)
+		if err := cache.redis.SAdd(ctx, map[string][]string{redisKey: keys}, ttl); err != nil {
+			glog.Errorf("%s restore tag %s error %+v", cache.name, tag, err)
+		}
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// mkRedisTagKey uses a different separator from mkRedisKey, so a tag never collides with a key. tags are of the
+// tenant PrefixFunc returns for the tag, and of the current version.
+func (cache *cacheImpl) mkRedisTagKey(ctx context.Context, tag string) string {
+	prefix := cache.tenantPrefix(ctx, tag)
+	if prefix == "" {
+		prefix = cache.options.RedisCacheOptions.Prefix
+	}
+	suffix, _ := cache.versionSuffix.Load().(string)
+	return prefix + suffix + "#tag_" + tag
+}
@@ -0,0 +1,114 @@
+package levelcache
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/ericuni/errs"
+	"github.com/golang/glog"
+)
+
+// bumpVersionScript increases the version kept in KEYS[1] to at least ARGV[1] + 1 and replies it, so a process
+// configured with a greater PrefixVersion than redis keeps still moves on
+const bumpVersionScript = `
+local v = redis.call('INCR', KEYS[1])
+local least = tonumber(ARGV[1]) + 1
+if v < least then
+	v = least
+	redis.call('SET', KEYS[1], v)
+end
+return v
+`
+
+// BumpVersion .
+func (cache *cacheImpl) BumpVersion(ctx context.Context) error {
+	if cache.options.RedisCacheOptions == nil {
+		return errs.New("rediscache not configured")
+	}
+
+	cache.versionMu.Lock()
+	current := cache.version
+	cache.versionMu.Unlock()
+	reply, err := cache.redis.Eval(ctx, bumpVersionScript, []string{cache.versionKey()}, current)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	version, ok := reply.(int64)
+	if !ok {
+		return errs.New("unexpected bump version reply %v", reply)
+	}
+
+	// lru keys are qualified by the version, so entries of the old version are never read again
+	cache.updateVersion(version)
+	return nil
+}
+
+// versionKey is the redis key keeping the version bumped
+func (cache *cacheImpl) versionKey() string {
+	return cache.options.RedisCacheOptions.Prefix + ":version"
+}
+
+// updateVersion moves to version unless the current one is greater
+func (cache *cacheImpl) updateVersion(version int64) {
+	cache.versionMu.Lock()
+	defer cache.versionMu.Unlock()
+	if version > cache.version {
+		cache.setVersion(version)
+	}
+}
+
+func (cache *cacheImpl) setVersion(version int64) {
+	cache.version = version
+	suffix := ""
+	if version > 0 {
+		suffix = ":v" + strconv.FormatInt(version, 10)
+	}
+	cache.versionSuffix.Store(suffix)
+}
+
+// syncVersion reads the version kept in redis, a missing key is version 0
+func (cache *cacheImpl) syncVersion(ctx context.Context) error {
+	results, err := cache.redis.Get(ctx, []string{cache.versionKey()})
+	if err != nil {
+		return errs.Trace(err)
+	}
+	if len(results) == 0 || !results[0].Found {
+		return nil
+	}
+	version, err := strconv.ParseInt(string(results[0].Value), 10, 64)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	cache.updateVersion(version)
+	return nil
+}
+
+// startVersionSync reads the version kept in redis right away and then every interval in the background until Close
+func (cache *cacheImpl) startVersionSync(interval time.Duration) {
+	if err := cache.syncVersion(context.Background()); err != nil {
+		glog.Errorf("%s sync version error %+v", cache.name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cache.versionCancel = cancel
+	cache.versionWG.Add(1)
+	go cache.versionLoop(ctx, interval)
+}
+
+func (cache *cacheImpl) versionLoop(ctx context.Context, interval time.Duration) {
+	defer cache.versionWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := cache.syncVersion(ctx); err != nil {
+				glog.Errorf("%s sync version error %+v", cache.name, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package levelcache
+
+import (
+	"encoding/binary"
+
+	"github.com/ericuni/errs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictMagic starts a zstd dictionary, followed by the little endian dictionary id
+const zstdDictMagic = 0xEC30A437
+
+// zstdCodec zstd encoder and decoder, both safe for concurrent EncodeAll and DecodeAll
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	dictID  uint32          // id of the dictionary written with, 0 for none
+	dictIDs map[uint32]bool // ids of dictionaries can be read
+}
+
+func newZstdCodec(dicts [][]byte) (*zstdCodec, error) {
+	c := &zstdCodec{dictIDs: make(map[uint32]bool, len(dicts))}
+
+	var encoderOptions []zstd.EOption
+	if len(dicts) > 0 {
+		c.dictID, _ = zstdDictID(dicts[0])
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dicts[0]))
+	}
+	for _, dict := range dicts {
+		id, err := zstdDictID(dict)
+		if err != nil {
+			return nil, errs.Trace(err)
+		}
+		c.dictIDs[id] = true
+	}
+
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	c.encoder = encoder
+	c.decoder = decoder
+	return c, nil
+}
+
+func (c *zstdCodec) compress(bs []byte) []byte {
+	return c.encoder.EncodeAll(bs, nil)
+}
+
+func (c *zstdCodec) decompress(dictID uint32, bs []byte) ([]byte, error) {
+	if dictID != 0 && !c.dictIDs[dictID] {
+		return nil, errs.New("unknown zstd dictionary %d", dictID)
+	}
+	decompressed, err := c.decoder.DecodeAll(bs, nil)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	return decompressed, nil
+}
+
+// zstdDictID returns id of a zstd format dictionary, as built by `zstd --train`
+func zstdDictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != zstdDictMagic {
+		return 0, errs.New("not a zstd dictionary")
+	}
+	id := binary.LittleEndian.Uint32(dict[4:])
+	if id == 0 {
+		return 0, errs.New("zstd dictionary id 0")
+	}
+	return id, nil
+}